@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+const (
+	AttachmentTypeDocument = iota
+	AttachmentTypePhoto
+	AttachmentTypeAnimation // GIF or MP4 without sound
+	AttachmentTypeVideo
+	AttachmentTypeAudio
+	AttachmentTypeVoice
+)
+
+var (
+	audioContentTypes = []string{"audio/mpeg", "audio/mp3", "audio/mp4", "audio/m4a", "audio/x-m4a"}
+	voiceContentTypes = []string{"audio/ogg", "audio/opus"}
+)
+
+// AttachmentTypeOf returns the type an attachment is sent to Telegram as.
+func AttachmentTypeOf(contentType string, content []byte) int {
+	switch {
+	case FileIsImage(contentType):
+		return AttachmentTypePhoto
+	case contentType == "image/gif":
+		return AttachmentTypeAnimation
+	case contentType == "video/mp4":
+		if mp4IsSilent(content) {
+			return AttachmentTypeAnimation
+		}
+		return AttachmentTypeVideo
+	case slices.Contains(audioContentTypes, contentType):
+		return AttachmentTypeAudio
+	case slices.Contains(voiceContentTypes, contentType):
+		return AttachmentTypeVoice
+	}
+	return AttachmentTypeDocument
+}
+
+// maxAttachmentSize returns the size limit of an attachment type.
+func (c *TelegramConfig) maxAttachmentSize(fileType int) int {
+	switch fileType {
+	case AttachmentTypePhoto:
+		return c.ForwardedAttachmentMaxPhotoSize
+	case AttachmentTypeAnimation:
+		return c.ForwardedAttachmentMaxAnimationSize
+	case AttachmentTypeVideo:
+		return c.ForwardedAttachmentMaxVideoSize
+	case AttachmentTypeAudio:
+		return c.ForwardedAttachmentMaxAudioSize
+	case AttachmentTypeVoice:
+		return c.ForwardedAttachmentMaxVoiceSize
+	}
+	return c.ForwardedAttachmentMaxSize
+}
+
+// mp4IsSilent reports whether an MP4 file has tracks, but none of them is a
+// sound track. Files which can't be parsed aren't silent.
+func mp4IsSilent(data []byte) bool {
+	var handlers []string
+	// Boxes start with a 32-bit size and a 4 byte type. The type of a track
+	// is in moov/trak/mdia/hdlr, after the version, flags and pre_defined.
+	var walk func(data []byte)
+	walk = func(data []byte) {
+		for len(data) >= 8 {
+			size := uint64(binary.BigEndian.Uint32(data))
+			boxType := string(data[4:8])
+			header := uint64(8)
+			switch size {
+			case 0: // up to the end of the file
+				size = uint64(len(data))
+			case 1: // 64-bit size
+				if len(data) < 16 {
+					return
+				}
+				size = binary.BigEndian.Uint64(data[8:16])
+				header = 16
+			}
+			if size < header || size > uint64(len(data)) {
+				return
+			}
+			body := data[header:size]
+			switch boxType {
+			case "moov", "trak", "mdia":
+				walk(body)
+			case "hdlr":
+				if len(body) >= 12 {
+					handlers = append(handlers, string(body[8:12]))
+				}
+			}
+			data = data[size:]
+		}
+	}
+	walk(data)
+	return len(handlers) > 0 && !slices.Contains(handlers, "soun")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func mp4Box(boxType string, body ...[]byte) []byte {
+	content := bytes.Join(body, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(content)))
+	return append(append(box, boxType...), content...)
+}
+
+// mp4WithTracks returns a minimal MP4 file with tracks of the handler types.
+func mp4WithTracks(handlers ...string) []byte {
+	var tracks [][]byte
+	for _, handler := range handlers {
+		hdlr := mp4Box("hdlr", make([]byte, 8), []byte(handler), make([]byte, 12))
+		tracks = append(tracks, mp4Box("trak", mp4Box("tkhd", make([]byte, 84)), mp4Box("mdia", hdlr)))
+	}
+	return append(mp4Box("ftyp", []byte("isom")), mp4Box("moov", tracks...)...)
+}
+
+func TestAttachmentTypeOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		content     []byte
+		want        int
+	}{
+		{"jpeg", "image/jpeg", nil, AttachmentTypePhoto},
+		{"gif", "image/gif", nil, AttachmentTypeAnimation},
+		{"silent mp4", "video/mp4", mp4WithTracks("vide"), AttachmentTypeAnimation},
+		{"mp4 with sound", "video/mp4", mp4WithTracks("vide", "soun"), AttachmentTypeVideo},
+		{"mp4 without tracks", "video/mp4", mp4WithTracks(), AttachmentTypeVideo},
+		{"truncated mp4", "video/mp4", mp4WithTracks("vide")[:30], AttachmentTypeVideo},
+		{"mp3", "audio/mpeg", nil, AttachmentTypeAudio},
+		{"m4a", "audio/x-m4a", nil, AttachmentTypeAudio},
+		{"ogg", "audio/ogg", nil, AttachmentTypeVoice},
+		{"pdf", "application/pdf", nil, AttachmentTypeDocument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, AttachmentTypeOf(tt.contentType, tt.content))
+		})
+	}
+}
+
+func TestMediaAttachmentsDelivery(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.ForwardedAttachmentMaxSize = 1024
+	telegramConfig.ForwardedAttachmentMaxAnimationSize = 1024
+	telegramConfig.ForwardedAttachmentMaxVideoSize = 1024
+	telegramConfig.ForwardedAttachmentMaxAudioSize = 1024
+	telegramConfig.ForwardedAttachmentMaxVoiceSize = 1024
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	clip := mp4WithTracks("vide", "soun")
+	send := func() {
+		t.Helper()
+		m := gomail.NewMessage()
+		m.SetHeader("From", "from@test")
+		m.SetHeader("To", "to@test")
+		m.SetHeader("Subject", "Media")
+		m.SetBody("text/plain", "Text body")
+		m.Attach("a.gif", goMailBody([]byte("GIF89a")))
+		m.Attach("clip.mp4", goMailBody(clip))
+		m.Attach("song.mp3", goMailBody([]byte("ID3")))
+		m.Attach("memo.ogg", goMailBody([]byte("OggS")))
+		require.NoError(t, gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "").DialAndSend(m))
+	}
+	fileTypes := func() []int {
+		var types []int
+		for _, doc := range h.RequestDocuments {
+			types = append(types, doc.FileType)
+		}
+		return types
+	}
+
+	send()
+	media := []int{AttachmentTypeAnimation, AttachmentTypeVideo, AttachmentTypeAudio, AttachmentTypeVoice}
+	require.Equal(t, append(media, media...), fileTypes())
+	require.Equal(t, clip, h.RequestDocuments[1].Content)
+	require.Empty(t, h.RequestMediaGroups)
+
+	// Media Telegram rejects is sent as a document, to the other chat right away
+	h.RequestDocuments = nil
+	h.RequestFileIDs = nil
+	h.RejectMethods = []string{"sendVoice"}
+	send()
+	media[3] = AttachmentTypeDocument
+	require.Equal(t, append(media, media...), fileTypes())
+	require.Equal(t, "memo.ogg", h.RequestDocuments[7].Filename)
+	require.NotEmpty(t, h.RequestFileIDs[7])
+
+	// Media over its own limit is sent as a document
+	h.RequestDocuments = nil
+	telegramConfig.ForwardedAttachmentMaxVideoSize = 10
+	send()
+	require.Equal(t, AttachmentTypeDocument, h.RequestDocuments[1].FileType)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+var (
+	errInvalidCIDR           = errors.New("invalid CIDR")
+	errClientDenied          = errors.New("client address is not allowed")
+	errClientRateLimit       = errors.New("rate limit exceeded")
+	errClientMessageTooLarge = errors.New("message is larger than the hourly byte limit")
+)
+
+// ClientAccessConfig is the client_access section of the config file.
+type ClientAccessConfig struct {
+	Allow     []string        `yaml:"allow"`
+	Deny      []string        `yaml:"deny"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+}
+
+type RateLimitConfig struct {
+	MessagesPerMinute int    `yaml:"messages_per_minute"`
+	BytesPerHour      string `yaml:"bytes_per_hour"` // e.g. 50m
+}
+
+// ClientAccess decides which SMTP clients may submit mail and how much.
+type ClientAccess struct {
+	allow   []netip.Prefix // empty allows every address not denied
+	deny    []netip.Prefix
+	limiter *RateLimiter // nil without rate limits
+}
+
+// NewClientAccess compiles the client_access section, returning nil if it
+// is empty.
+func NewClientAccess(config *ClientAccessConfig) (*ClientAccess, error) {
+	allow, err := parsePrefixes(config.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("client_access.allow: %w", err)
+	}
+	deny, err := parsePrefixes(config.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("client_access.deny: %w", err)
+	}
+	var bytesPerHour int64
+	if config.RateLimit.BytesPerHour != "" {
+		bytesPerHour, err = units.FromHumanSize(config.RateLimit.BytesPerHour)
+		if err != nil {
+			return nil, fmt.Errorf("client_access.rate_limit.bytes_per_hour: %w", err)
+		}
+	}
+	access := &ClientAccess{allow: allow, deny: deny}
+	if config.RateLimit.MessagesPerMinute > 0 || bytesPerHour > 0 {
+		access.limiter = NewRateLimiter(config.RateLimit.MessagesPerMinute, bytesPerHour)
+	}
+	if len(allow) == 0 && len(deny) == 0 && access.limiter == nil {
+		return nil, nil
+	}
+	return access, nil
+}
+
+// keepRateLimits takes over the rate limiter state of old if the limits are
+// unchanged, so that a config reload doesn't reset them.
+func (a *ClientAccess) keepRateLimits(old *ClientAccess) {
+	if old == nil || old.limiter == nil || a.limiter == nil {
+		return
+	}
+	if old.limiter.messagesPerMinute == a.limiter.messagesPerMinute && old.limiter.bytesPerHour == a.limiter.bytesPerHour {
+		a.limiter = old.limiter
+	}
+}
+
+// parsePrefixes parses CIDRs, single addresses are taken as a whole prefix.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w %q", errInvalidCIDR, value)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q", errInvalidCIDR, value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Allowed reports whether the client address may submit mail. Deny entries
+// take precedence over allow entries.
+func (a *ClientAccess) Allowed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	addr = addr.Unmap()
+	for _, prefix := range a.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, prefix := range a.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimiter holds a token bucket of messages and one of bytes per client
+// address. Idle clients are forgotten once their buckets are full again.
+type RateLimiter struct {
+	messagesPerMinute int
+	bytesPerHour      int64
+
+	mu        sync.Mutex
+	clients   map[string]*clientBuckets
+	lastPrune time.Time
+}
+
+type clientBuckets struct {
+	messages float64
+	bytes    float64
+	updated  time.Time
+	rejected int
+}
+
+// NewRateLimiter returns a limiter allowing bursts of messagesPerMinute
+// messages and bytesPerHour bytes. Zero disables the corresponding limit.
+func NewRateLimiter(messagesPerMinute int, bytesPerHour int64) *RateLimiter {
+	return &RateLimiter{
+		messagesPerMinute: messagesPerMinute,
+		bytesPerHour:      bytesPerHour,
+		clients:           make(map[string]*clientBuckets),
+	}
+}
+
+// TakeMessage consumes a message from the client's bucket. When the limit
+// is exceeded nothing is consumed and the number of messages rejected so far
+// for the client is returned with the error.
+func (l *RateLimiter) TakeMessage(ip string, now time.Time) (rejected int, err error) {
+	if l.messagesPerMinute == 0 {
+		return 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.buckets(ip, now)
+	if c.messages < 1 {
+		c.rejected++
+		return c.rejected, fmt.Errorf("%w: more than %d messages per minute", errClientRateLimit, l.messagesPerMinute)
+	}
+	c.messages--
+	return c.rejected, nil
+}
+
+// TakeBytes consumes the size of a received message from the client's
+// bucket, like TakeMessage.
+func (l *RateLimiter) TakeBytes(ip string, size int64, now time.Time) (rejected int, err error) {
+	if l.bytesPerHour == 0 {
+		return 0, nil
+	}
+	if size > l.bytesPerHour {
+		return 0, fmt.Errorf("%w (%s)", errClientMessageTooLarge, units.HumanSize(float64(l.bytesPerHour)))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.buckets(ip, now)
+	if c.bytes < float64(size) {
+		c.rejected++
+		return c.rejected, fmt.Errorf("%w: more than %s per hour", errClientRateLimit, units.HumanSize(float64(l.bytesPerHour)))
+	}
+	c.bytes -= float64(size)
+	return c.rejected, nil
+}
+
+// buckets returns the refilled buckets of the client.
+func (l *RateLimiter) buckets(ip string, now time.Time) *clientBuckets {
+	l.prune(now)
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &clientBuckets{messages: float64(l.messagesPerMinute), bytes: float64(l.bytesPerHour), updated: now}
+		l.clients[ip] = c
+	}
+	l.refill(c, now)
+	return c
+}
+
+func (l *RateLimiter) refill(c *clientBuckets, now time.Time) {
+	elapsed := now.Sub(c.updated)
+	if elapsed <= 0 {
+		return
+	}
+	c.updated = now
+	c.messages = min(float64(l.messagesPerMinute), c.messages+elapsed.Minutes()*float64(l.messagesPerMinute))
+	c.bytes = min(float64(l.bytesPerHour), c.bytes+elapsed.Hours()*float64(l.bytesPerHour))
+}
+
+// prune forgets the clients whose buckets have refilled, at most once a minute.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for ip, c := range l.clients {
+		l.refill(c, now)
+		if c.messages >= float64(l.messagesPerMinute) && c.bytes >= float64(l.bytesPerHour) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// ClientAccessProcessorFactory answers with a temporary failure to messages
+// over the client's hourly byte limit, known once they are received. Clients
+// outside the allowed networks are refused when they connect, and messages
+// over the per-minute limit at MAIL, by the SMTP session.
+func ClientAccessProcessorFactory() func() backends.Decorator {
+	return func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(
+				func(envelope *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+					access := currentRules().ClientAccess
+					if task != backends.TaskSaveMail || access == nil || access.limiter == nil {
+						return p.Process(envelope, task)
+					}
+					rejected, err := access.limiter.TakeBytes(envelope.RemoteIP, int64(envelope.Data.Len()), time.Now())
+					if errors.Is(err, errClientMessageTooLarge) {
+						logger.Warningf("Rejecting email from %s: %s", envelope.RemoteIP, err)
+						metricEmailsRejected.Inc("rate_limit")
+						return backends.NewResult(fmt.Sprintf("552 Error: %s", err)), err
+					}
+					if err != nil {
+						logger.Warningf("Deferring email from %s: %s (%d rejected so far)", envelope.RemoteIP, err, rejected)
+						metricEmailsRejected.Inc("rate_limit")
+						return backends.NewResult(fmt.Sprintf("450 Error: %s", err)), err
+					}
+					return p.Process(envelope, task)
+				},
+			)
+		}
+	}
+}
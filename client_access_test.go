@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func TestClientAccessAllowed(t *testing.T) {
+	access, err := NewClientAccess(&ClientAccessConfig{
+		Allow: []string{"10.0.0.0/8", "192.168.1.5", "2001:db8::/32"},
+		Deny:  []string{"10.0.0.13/32"},
+	})
+	require.NoError(t, err)
+
+	require.True(t, access.Allowed("10.1.2.3"))
+	require.True(t, access.Allowed("::ffff:10.1.2.3"))
+	require.True(t, access.Allowed("192.168.1.5"))
+	require.True(t, access.Allowed("2001:db8::1"))
+	require.False(t, access.Allowed("10.0.0.13"))
+	require.False(t, access.Allowed("192.168.1.6"))
+	require.False(t, access.Allowed("not an ip"))
+}
+
+func TestNewClientAccess(t *testing.T) {
+	access, err := NewClientAccess(&ClientAccessConfig{})
+	require.NoError(t, err)
+	require.Nil(t, access)
+
+	_, err = NewClientAccess(&ClientAccessConfig{Deny: []string{"10.0.0.0/33"}})
+	require.ErrorIs(t, err, errInvalidCIDR)
+
+	_, err = NewClientAccess(&ClientAccessConfig{RateLimit: RateLimitConfig{BytesPerHour: "lots"}})
+	require.Error(t, err)
+}
+
+func TestRateLimiterMessages(t *testing.T) {
+	l := NewRateLimiter(2, 0)
+	now := time.Now()
+
+	_, err := l.TakeMessage("10.0.0.1", now)
+	require.NoError(t, err)
+	_, err = l.TakeMessage("10.0.0.1", now)
+	require.NoError(t, err)
+	rejected, err := l.TakeMessage("10.0.0.1", now)
+	require.ErrorIs(t, err, errClientRateLimit)
+	require.Equal(t, 1, rejected)
+
+	// Other clients have their own buckets.
+	_, err = l.TakeMessage("10.0.0.2", now)
+	require.NoError(t, err)
+
+	// One message is refilled every 30 seconds.
+	_, err = l.TakeMessage("10.0.0.1", now.Add(30*time.Second))
+	require.NoError(t, err)
+	_, err = l.TakeMessage("10.0.0.1", now.Add(30*time.Second))
+	require.ErrorIs(t, err, errClientRateLimit)
+
+	// The byte limit is disabled.
+	_, err = l.TakeBytes("10.0.0.1", 1<<30, now)
+	require.NoError(t, err)
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	l := NewRateLimiter(0, 1000)
+	now := time.Now()
+
+	_, err := l.TakeBytes("10.0.0.1", 2000, now)
+	require.ErrorIs(t, err, errClientMessageTooLarge)
+	_, err = l.TakeBytes("10.0.0.1", 600, now)
+	require.NoError(t, err)
+	rejected, err := l.TakeBytes("10.0.0.1", 600, now)
+	require.ErrorIs(t, err, errClientRateLimit)
+	require.Equal(t, 1, rejected)
+	_, err = l.TakeBytes("10.0.0.1", 600, now.Add(15*time.Minute))
+	require.NoError(t, err)
+
+	// The message limit is disabled.
+	_, err = l.TakeMessage("10.0.0.1", now)
+	require.NoError(t, err)
+}
+
+func TestRateLimiterForgetsIdleClients(t *testing.T) {
+	l := NewRateLimiter(1, 0)
+	now := time.Now()
+	_, err := l.TakeMessage("10.0.0.1", now)
+	require.NoError(t, err)
+	_, err = l.TakeMessage("10.0.0.2", now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Len(t, l.clients, 1)
+}
+
+func sendClientAccessTestMail() error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Test subj")
+	m.SetBody("text/plain", "Text body")
+	return gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "").DialAndSend(m)
+}
+
+func TestSMTPClientDenied(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = writeTestConfig(t, "client_access:\n  deny: [127.0.0.0/8]\n")
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+	defer activeRules.Store(nil)
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	// The client is refused in the greeting
+	conn, err := net.Dial("tcp", smtpConfig.Listen)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	tc := textproto.NewConn(conn)
+	_, msg, err := tc.ReadResponse(220)
+	var smtpErr *textproto.Error
+	require.ErrorAs(t, err, &smtpErr)
+	require.Equal(t, 554, smtpErr.Code)
+	require.Contains(t, msg, errClientDenied.Error())
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+
+	require.Error(t, sendClientAccessTestMail())
+	require.Empty(t, h.RequestMessages)
+}
+
+func TestSMTPClientRateLimited(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = writeTestConfig(t, "client_access:\n  allow: [127.0.0.1]\n  rate_limit:\n    messages_per_minute: 1\n")
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+	defer activeRules.Store(nil)
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	rejected := metricEmailsRejected.Value("rate_limit")
+	require.NoError(t, sendClientAccessTestMail())
+	// The second email is deferred at MAIL, before it is sent
+	c, err := smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	err = c.Mail("from@test")
+	var smtpErr *textproto.Error
+	require.ErrorAs(t, err, &smtpErr)
+	require.Equal(t, 450, smtpErr.Code)
+	require.Equal(t, "4.7.1 Error: "+errClientRateLimit.Error()+": more than 1 messages per minute", smtpErr.Msg)
+	require.Len(t, h.RequestMessages, 2) // the first email, sent to both chats
+	require.Equal(t, rejected+1, metricEmailsRejected.Value("rate_limit"))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const configCheckInterval = 5 * time.Second
+
+// Rules are the parts of the config file which are reloaded at runtime. Active
+// rules are never modified, a reload replaces them as a whole.
+type Rules struct {
+	FilterRules  []FilterRule
+	Routing      RoutingConfig
+	ClientAccess *ClientAccess // nil without a client_access section
+	Auth         *SMTPAuth     // nil without smtp_auth users
+
+	replyChatIDs []int64 // chats mail can be routed to
+}
+
+var activeRules atomic.Pointer[Rules]
+
+// currentRules returns the active rules, empty ones without a config file.
+func currentRules() *Rules {
+	if rules := activeRules.Load(); rules != nil {
+		return rules
+	}
+	return &Rules{}
+}
+
+func newRules(config *AppConfig, access *ClientAccess, auth *SMTPAuth) (*Rules, error) {
+	rules := &Rules{
+		FilterRules: config.FilterRules,
+		Routing: RoutingConfig{
+			Routes:         config.Routes,
+			DefaultChatIDs: config.DefaultChatIDs,
+			RejectUnrouted: config.RejectUnrouted,
+		},
+		ClientAccess: access,
+		Auth:         auth,
+	}
+	chatIDs := rules.Routing.AllChatIDs()
+	for i := range rules.FilterRules {
+		chatIDs = append(chatIDs, rules.FilterRules[i].ChatIDs...)
+	}
+	var err error
+	rules.replyChatIDs, err = parseChatIDs(strings.Join(chatIDs, ","))
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// isReplyChat reports whether a route or a route action sends mail to the chat.
+func (r *Rules) isReplyChat(chatID int64) bool {
+	return slices.Contains(r.replyChatIDs, chatID)
+}
+
+// reloadConfig activates the rules of the config file. The active rules are
+// kept if the file is invalid.
+func reloadConfig(filename string) error {
+	_, rules, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+	if rules.ClientAccess != nil {
+		rules.ClientAccess.keepRateLimits(currentRules().ClientAccess)
+	}
+	activeRules.Store(rules)
+	logger.Infof("Reloaded %d filter rules and %d routes from %s", len(rules.FilterRules), len(rules.Routing.Routes), filename)
+	return nil
+}
+
+// WatchConfig reloads the config file on a signal from hup and, if interval
+// is not zero, when the file's modification time changes, until ctx is done.
+func WatchConfig(ctx context.Context, filename string, interval time.Duration, hup <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	mtime := fileMtime(filename)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Infof("Reloading %s on SIGHUP", filename)
+		case <-tick:
+			if fileMtime(filename).Equal(mtime) {
+				continue
+			}
+			logger.Infof("Reloading %s, the file changed", filename)
+		}
+		mtime = fileMtime(filename)
+		if err := reloadConfig(filename); err != nil {
+			logger.Errorf("Failed to reload %s, keeping the previous config: %s", filename, err)
+		}
+	}
+}
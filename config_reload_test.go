@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func TestConfigReload(t *testing.T) {
+	writeConfig := func(path, rejectedSubject string) {
+		t.Helper()
+		content := `filter_rules:
+  - name: reject-` + rejectedSubject + `
+    conditions:
+      - field: subject
+        pattern: '` + rejectedSubject + `'
+client_access:
+  rate_limit:
+    messages_per_minute: 100
+`
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = writeTestConfig(t, "")
+	writeConfig(smtpConfig.ConfigFile, "alpha")
+	telegramConfig := makeTelegramConfig()
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+	defer activeRules.Store(nil)
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hup := make(chan os.Signal)
+	go WatchConfig(ctx, smtpConfig.ConfigFile, 10*time.Millisecond, hup)
+	// The channel is unbuffered, so the second signal is received once the
+	// reload of the first one is done.
+	reload := func() {
+		hup <- syscall.SIGHUP
+		hup <- syscall.SIGHUP
+	}
+
+	send := func(subject string) error {
+		m := gomail.NewMessage()
+		m.SetHeader("From", "from@test")
+		m.SetHeader("To", "to@test")
+		m.SetHeader("Subject", subject)
+		m.SetBody("text/plain", "Text body")
+		return gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "").DialAndSend(m)
+	}
+
+	require.Error(t, send("alpha"))
+	limiter := currentRules().ClientAccess.limiter
+
+	// An invalid config keeps the active one
+	require.NoError(t, os.WriteFile(smtpConfig.ConfigFile, []byte("filter_rules:\n  - name: broken\n    action: drop\n"), 0o600))
+	reload()
+	require.Equal(t, "reject-alpha", currentRules().FilterRules[0].Name)
+	require.Error(t, send("alpha"))
+
+	writeConfig(smtpConfig.ConfigFile, "beta")
+	reload()
+	require.NoError(t, send("alpha"))
+	require.Error(t, send("beta"))
+	// Unchanged rate limits keep their state
+	require.Same(t, limiter, currentRules().ClientAccess.limiter)
+
+	// Changes of the file are picked up without a signal
+	writeConfig(smtpConfig.ConfigFile, "gamma")
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(smtpConfig.ConfigFile, future, future))
+	require.Eventually(t, func() bool {
+		return send("gamma") != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, send("beta"))
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	FilterActionReject   = "reject"   // 554, the default
+	FilterActionDiscard  = "discard"  // 250 without forwarding
+	FilterActionRoute    = "route"    // forward to the rule's chat_ids
+	FilterActionSilent   = "silent"   // forward with disable_notification
+	FilterActionTag      = "tag"      // prefix the Telegram message with the rule's tag
+	FilterActionContinue = "continue" // only record the match and evaluate the following rules
+
+	filterHeaderPrefix = "header:"
+)
+
+var (
+	// filterTextFields are matched with a pattern, as well as "header:<name>".
+	filterTextFields = []string{
+		"from", "envelope_from", "to", "subject", "body", "html", "body_or_html",
+		"attachment_name", "attachment_type", "client_ip", "helo", "auth_user",
+	}
+	// filterNumberFields are compared with an operator and a value.
+	filterNumberFields = []string{"size", "attachment_count"}
+	filterOperators    = []string{"<", "<=", ">", ">=", "==", "!="}
+	filterActions      = []string{
+		FilterActionReject, FilterActionDiscard, FilterActionRoute, FilterActionSilent, FilterActionTag,
+		FilterActionContinue,
+	}
+
+	errInvalidMatchType = errors.New("invalid match type")
+	errInvalidAction    = errors.New("invalid action")
+	errInvalidField     = errors.New("invalid field")
+	errInvalidOperator  = errors.New("invalid operator")
+	errInvalidValue     = errors.New("invalid value")
+	errRejectedByFilter = errors.New("email rejected by filter rule")
+)
+
+type FilterCondition struct {
+	Field    string         `yaml:"field"`
+	Pattern  string         `yaml:"pattern"`
+	Operator string         `yaml:"operator"` // number fields only
+	Value    string         `yaml:"value"`    // number fields only, sizes may use units like 10m
+	regex    *regexp.Regexp // compiled pattern
+	number   int64          // parsed value
+}
+
+type FilterRule struct {
+	Name       string            `yaml:"name"`
+	Match      string            `yaml:"match"` // "all" or "any"
+	Conditions []FilterCondition `yaml:"conditions"`
+	Action     string            `yaml:"action"`   // FilterAction*, reject if empty
+	ChatIDs    []string          `yaml:"chat_ids"` // route only
+	Tag        string            `yaml:"tag"`      // tag only
+	// Continue evaluates the following rules after a match, so that route,
+	// silent and tag rules can be combined. Rules with the continue action
+	// always do.
+	Continue bool `yaml:"continue"`
+}
+
+// FilterDecision is the outcome of the filter rules for an email.
+type FilterDecision struct {
+	Action   string   // FilterActionReject or FilterActionDiscard, empty to forward
+	RuleName string   // rule which ended the evaluation, empty if none did
+	Matched  []string // names of all matching rules
+	ChatIDs  []string // of the first matching route rule, replacing the routes
+	Silent   bool
+	Tags     []string
+}
+
+// FilterInput is the email and connection data filter rules are checked against.
+type FilterInput struct {
+	From         string
+	EnvelopeFrom string
+	To           string
+	Subject      string
+	Body         string
+	HTML         string
+	Headers      textproto.MIMEHeader // decoded header values
+	Attachments  []AttachmentInfo
+	Size         int64 // of the raw message
+	ClientIP     string
+	Helo         string
+	AuthUser     string // SMTP AUTH username, "" without authentication
+}
+
+func newFilterInput(message *FormattedEmail, envelope *mail.Envelope) *FilterInput {
+	return &FilterInput{
+		From:         message.From,
+		EnvelopeFrom: message.EnvelopeFrom,
+		To:           message.To,
+		Subject:      message.Subject,
+		Body:         message.Text,
+		HTML:         message.HTML,
+		Headers:      message.Headers,
+		Attachments:  message.AttachmentInfos,
+		Size:         int64(envelope.Data.Len()),
+		ClientIP:     envelope.RemoteIP,
+		Helo:         envelope.Helo,
+		AuthUser:     authUser(envelope),
+	}
+}
+
+// compileFilterRules validates the rules and compiles their conditions in place.
+func compileFilterRules(rules []FilterRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		// Default match to "all" if not specified
+		if rule.Match == "" {
+			rule.Match = "all"
+		}
+		if rule.Match != "all" && rule.Match != "any" {
+			return fmt.Errorf("rule '%s': %w '%s' (must be 'all' or 'any')", rule.Name, errInvalidMatchType, rule.Match)
+		}
+		if err := validateFilterAction(rule); err != nil {
+			return fmt.Errorf("rule '%s': %w", rule.Name, err)
+		}
+		for j := range rule.Conditions {
+			if err := compileFilterCondition(&rule.Conditions[j]); err != nil {
+				return fmt.Errorf("rule '%s': %w", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateFilterAction(rule *FilterRule) error {
+	if rule.Action == "" {
+		rule.Action = FilterActionReject
+	}
+	if !slices.Contains(filterActions, rule.Action) {
+		return fmt.Errorf("%w '%s' (must be one of: %s)", errInvalidAction, rule.Action, strings.Join(filterActions, ", "))
+	}
+	if (rule.Action == FilterActionRoute) != (len(rule.ChatIDs) > 0) {
+		return fmt.Errorf("%w: chat_ids must be set exactly for the route action", errInvalidAction)
+	}
+	if err := validateChatIDs(rule.ChatIDs); err != nil {
+		return err
+	}
+	if (rule.Action == FilterActionTag) != (rule.Tag != "") {
+		return fmt.Errorf("%w: tag must be set exactly for the tag action", errInvalidAction)
+	}
+	if rule.Continue && (rule.Action == FilterActionReject || rule.Action == FilterActionDiscard) {
+		return fmt.Errorf("%w: %s can't continue", errInvalidAction, rule.Action)
+	}
+	if rule.Action == FilterActionContinue {
+		rule.Continue = true
+	}
+	return nil
+}
+
+func compileFilterCondition(cond *FilterCondition) error {
+	if slices.Contains(filterNumberFields, cond.Field) {
+		if cond.Pattern != "" {
+			return fmt.Errorf("%w: field '%s' takes an operator and a value, not a pattern", errInvalidField, cond.Field)
+		}
+		if !slices.Contains(filterOperators, cond.Operator) {
+			return fmt.Errorf("%w '%s' for field '%s' (must be one of: %s)",
+				errInvalidOperator, cond.Operator, cond.Field, strings.Join(filterOperators, ", "))
+		}
+		var err error
+		if cond.Field == "size" {
+			cond.number, err = units.FromHumanSize(cond.Value)
+		} else {
+			cond.number, err = strconv.ParseInt(cond.Value, 10, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("%w '%s' for field '%s'", errInvalidValue, cond.Value, cond.Field)
+		}
+		return nil
+	}
+
+	if !isValidFilterField(cond.Field) {
+		return fmt.Errorf("%w '%s' (must be one of: %s, %s<name>, %s)", errInvalidField, cond.Field,
+			strings.Join(filterTextFields, ", "), filterHeaderPrefix, strings.Join(filterNumberFields, ", "))
+	}
+	if cond.Operator != "" || cond.Value != "" {
+		return fmt.Errorf("%w: field '%s' takes a pattern, operator and value are for %s",
+			errInvalidOperator, cond.Field, strings.Join(filterNumberFields, " and "))
+	}
+	// Make pattern case-insensitive
+	pattern := cond.Pattern
+	if !strings.HasPrefix(pattern, "(?i)") {
+		pattern = "(?i)" + pattern
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid regex pattern '%s': %w", cond.Pattern, err)
+	}
+	cond.regex = compiled
+	return nil
+}
+
+// isValidFilterField reports whether field is matched with a pattern.
+func isValidFilterField(field string) bool {
+	if name, ok := strings.CutPrefix(field, filterHeaderPrefix); ok {
+		// Header field names are printable ASCII without colons, RFC 5322 2.2.
+		return name != "" && !strings.ContainsFunc(name, func(r rune) bool {
+			return r <= ' ' || r > '~' || r == ':'
+		})
+	}
+	return slices.Contains(filterTextFields, field)
+}
+
+// checkFilterRules applies the rules in order. A matching rule ends the
+// evaluation unless it continues; reject and discard always end it.
+func checkFilterRules(input *FilterInput) *FilterDecision {
+	decision := &FilterDecision{}
+	for _, rule := range currentRules().FilterRules {
+		if !evaluateRule(&rule, input) {
+			continue
+		}
+		decision.Matched = append(decision.Matched, rule.Name)
+		switch rule.Action {
+		case FilterActionReject, FilterActionDiscard:
+			decision.Action = rule.Action
+		case FilterActionRoute:
+			if decision.ChatIDs == nil {
+				decision.ChatIDs = rule.ChatIDs
+			}
+		case FilterActionSilent:
+			decision.Silent = true
+		case FilterActionTag:
+			decision.Tags = append(decision.Tags, rule.Tag)
+		}
+		if !rule.Continue {
+			decision.RuleName = rule.Name
+			break
+		}
+	}
+	return decision
+}
+
+func evaluateRule(rule *FilterRule, input *FilterInput) bool {
+	if len(rule.Conditions) == 0 {
+		return false
+	}
+
+	if rule.Match == "any" {
+		// OR logic: at least one condition must match
+		for _, cond := range rule.Conditions {
+			if evaluateCondition(&cond, input) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Default: "all" - AND logic: all conditions must match
+	for _, cond := range rule.Conditions {
+		if !evaluateCondition(&cond, input) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchingConditions returns the conditions of the rule which match.
+func matchingConditions(rule *FilterRule, input *FilterInput) []*FilterCondition {
+	var matching []*FilterCondition
+	for i := range rule.Conditions {
+		if evaluateCondition(&rule.Conditions[i], input) {
+			matching = append(matching, &rule.Conditions[i])
+		}
+	}
+	return matching
+}
+
+func evaluateCondition(cond *FilterCondition, input *FilterInput) bool {
+	if name, ok := strings.CutPrefix(cond.Field, filterHeaderPrefix); ok {
+		// Any value of a repeated header may match, a missing header never does.
+		return slices.ContainsFunc(input.Headers.Values(name), cond.regex.MatchString)
+	}
+
+	var value string
+	switch cond.Field {
+	case "from":
+		// The bare address matches too, so patterns written for it keep
+		// working when the header has a display name.
+		return cond.regex.MatchString(input.From) || cond.regex.MatchString(bareAddress(input.From))
+	case "envelope_from":
+		value = input.EnvelopeFrom
+	case "to":
+		value = input.To
+	case "subject":
+		value = input.Subject
+	case "body":
+		value = input.Body
+	case "html":
+		value = input.HTML
+	case "body_or_html":
+		// Match if pattern found in either body OR html
+		return cond.regex.MatchString(input.Body) || cond.regex.MatchString(input.HTML)
+	case "attachment_name":
+		return slices.ContainsFunc(input.Attachments, func(a AttachmentInfo) bool {
+			return cond.regex.MatchString(a.Filename)
+		})
+	case "attachment_type":
+		return slices.ContainsFunc(input.Attachments, func(a AttachmentInfo) bool {
+			return cond.regex.MatchString(a.ContentType)
+		})
+	case "client_ip":
+		value = input.ClientIP
+	case "helo":
+		value = input.Helo
+	case "auth_user":
+		value = input.AuthUser
+	case "size":
+		return compareNumbers(input.Size, cond.Operator, cond.number)
+	case "attachment_count":
+		return compareNumbers(int64(len(input.Attachments)), cond.Operator, cond.number)
+	default:
+		return false
+	}
+	return cond.regex.MatchString(value)
+}
+
+func compareNumbers(a int64, operator string, b int64) bool {
+	switch operator {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	default:
+		return false
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	netmail "net/mail"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/urfave/cli/v3"
+)
+
+// Exit code of test-filter when a message isn't decided as expected.
+const exitExpectationFailed = 2
+
+var (
+	errConfigFileMissing = errors.New("no config file given")
+	errNoMessages        = errors.New("no messages given")
+)
+
+func checkConfigCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "check-config",
+		Usage:     "Validate a config file like on startup and print a summary",
+		ArgsUsage: "[FILE]",
+		Description: "FILE defaults to --config-file. " +
+			"Exits with 1 if the config is invalid.",
+		Action: func(_ context.Context, cmd *cli.Command) error {
+			filename := cmd.Args().First()
+			if filename == "" {
+				filename = cmd.String("config-file")
+			}
+			return CheckConfig(cmd.Root().Writer, filename)
+		},
+	}
+}
+
+func testFilterCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "test-filter",
+		Usage:     "Print the filter rules matching .eml files",
+		ArgsUsage: "MESSAGE.eml...",
+		Description: "Messages are formatted like received ones, with the " +
+			"envelope sender taken from the Return-Path or From header and the " +
+			"recipients from the To and Cc headers unless given. " +
+			"Exits with 1 on errors and with 2 if --expect isn't met.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "Path to YAML configuration file",
+				Sources: cli.EnvVars("ST_CONFIG_FILE"),
+			},
+			&cli.StringFlag{
+				Name:  "expect",
+				Usage: "Fail unless every message matches this rule, or no rule with \"none\"",
+			},
+			&cli.StringFlag{
+				Name:  "mail-from",
+				Usage: "Envelope sender of the messages",
+			},
+			&cli.StringSliceFlag{
+				Name:  "rcpt",
+				Usage: "Envelope recipients of the messages",
+			},
+			&cli.StringFlag{
+				Name:  "client-ip",
+				Usage: "IP address of the SMTP client",
+				Value: "127.0.0.1",
+			},
+			&cli.StringFlag{
+				Name:  "helo",
+				Usage: "HELO name of the SMTP client",
+				Value: "localhost",
+			},
+			&cli.StringFlag{
+				Name:  "auth-user",
+				Usage: "SMTP AUTH username the messages were submitted by",
+			},
+		},
+		Action: func(_ context.Context, cmd *cli.Command) error {
+			telegramConfig, err := newTelegramConfig(cmd)
+			if err != nil {
+				return err
+			}
+			logger, err = log.GetLogger(log.OutputStderr.String(), log.WarnLevel.String())
+			if err != nil {
+				return err
+			}
+			return RunFilterTest(cmd.Root().Writer, &FilterTest{
+				ConfigFile: cmd.String("config"),
+				Messages:   cmd.Args().Slice(),
+				Expect:     cmd.String("expect"),
+				MailFrom:   cmd.String("mail-from"),
+				RcptTo:     cmd.StringSlice("rcpt"),
+				ClientIP:   cmd.String("client-ip"),
+				Helo:       cmd.String("helo"),
+				AuthUser:   cmd.String("auth-user"),
+			}, telegramConfig)
+		},
+	}
+}
+
+// CheckConfig validates a config file without activating it.
+func CheckConfig(w io.Writer, filename string) error {
+	if filename == "" {
+		return errConfigFileMissing
+	}
+	config, rules, err := readConfig(filename)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	fmt.Fprintf(w, "%s: OK\n", filename)
+	fmt.Fprintf(w, "Filter rules: %d\n", len(rules.FilterRules))
+	for i := range rules.FilterRules {
+		rule := &rules.FilterRules[i]
+		fmt.Fprintf(w, "  %s: %s, %s (match %s)\n", rule.Name, describeAction(rule), pluralize(len(rule.Conditions), "condition"), rule.Match)
+	}
+	fmt.Fprintf(w, "Routes: %d\n", len(rules.Routing.Routes))
+	if len(rules.Routing.DefaultChatIDs) > 0 {
+		fmt.Fprintf(w, "Default chat IDs: %s\n", strings.Join(rules.Routing.DefaultChatIDs, ", "))
+	}
+	if rules.Routing.RejectUnrouted {
+		fmt.Fprintln(w, "Unrouted recipients are rejected")
+	}
+	if access := rules.ClientAccess; access != nil {
+		fmt.Fprintf(w, "Client access: %s allowed, %s denied",
+			pluralize(len(access.allow), "network"), pluralize(len(access.deny), "network"))
+		if access.limiter != nil {
+			fmt.Fprint(w, ", rate limited")
+		}
+		fmt.Fprintln(w)
+	}
+	if config.SMTPOut.Host != "" {
+		fmt.Fprintf(w, "SMTP out: %s:%d\n", config.SMTPOut.Host, config.SMTPOut.Port)
+	}
+	if config.SMTPTLS.Enabled() {
+		fmt.Fprintf(w, "SMTP TLS: %s\n", config.SMTPTLS.Mode)
+	}
+	return nil
+}
+
+// FilterTest describes a test-filter run.
+type FilterTest struct {
+	ConfigFile string
+	Messages   []string // paths of .eml files
+	Expect     string   // rule name or "none", empty to only print the results
+	MailFrom   string
+	RcptTo     []string
+	ClientIP   string
+	Helo       string
+	AuthUser   string
+}
+
+// RunFilterTest prints which filter rules match each message and why.
+func RunFilterTest(w io.Writer, test *FilterTest, telegramConfig *TelegramConfig) error {
+	if test.ConfigFile == "" {
+		return errConfigFileMissing
+	}
+	if len(test.Messages) == 0 {
+		return errNoMessages
+	}
+	if _, err := loadConfig(test.ConfigFile); err != nil {
+		return fmt.Errorf("%s: %w", test.ConfigFile, err)
+	}
+
+	var unexpected []string
+	for _, path := range test.Messages {
+		envelope, err := test.envelope(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		message, err := FormatEmail(envelope, telegramConfig, nil)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		input := newFilterInput(message, envelope)
+		decision := checkFilterRules(input)
+
+		switch {
+		case decision.Action != "":
+			fmt.Fprintf(w, "%s: %s by rule '%s'\n", path, decision.Action, decision.RuleName)
+		case len(decision.Matched) == 0:
+			fmt.Fprintf(w, "%s: forward, no rule matched\n", path)
+		default:
+			fmt.Fprintf(w, "%s: forward\n", path)
+		}
+		for _, rule := range currentRules().FilterRules {
+			if !slices.Contains(decision.Matched, rule.Name) {
+				continue
+			}
+			fmt.Fprintf(w, "  %s (%s):", rule.Name, describeAction(&rule))
+			for _, cond := range matchingConditions(&rule, input) {
+				fmt.Fprintf(w, " %s;", describeCondition(cond))
+			}
+			fmt.Fprintln(w)
+		}
+
+		switch {
+		case test.Expect == "":
+		case test.Expect == "none" && len(decision.Matched) > 0,
+			test.Expect != "none" && !slices.Contains(decision.Matched, test.Expect):
+			unexpected = append(unexpected, path)
+		}
+	}
+
+	if len(unexpected) > 0 {
+		return cli.Exit(fmt.Sprintf("Not matching %q: %s", test.Expect, strings.Join(unexpected, ", ")), exitExpectationFailed)
+	}
+	return nil
+}
+
+// envelope returns the envelope of an .eml file as if it was received.
+func (test *FilterTest) envelope(path string) (*mail.Envelope, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // User-specified message path is intentional
+	if err != nil {
+		return nil, err
+	}
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message: %w", err)
+	}
+
+	envelope := &mail.Envelope{
+		RemoteIP: test.ClientIP,
+		Helo:     test.Helo,
+		Values:   make(map[string]any),
+	}
+	if test.AuthUser != "" {
+		envelope.Values[envelopeAuthUser] = test.AuthUser
+	}
+	envelope.Data.Write(data)
+
+	mailFrom := test.MailFrom
+	if mailFrom == "" {
+		for _, header := range []string{"Return-Path", "From"} {
+			if addresses, err := msg.Header.AddressList(header); err == nil && len(addresses) > 0 {
+				mailFrom = addresses[0].Address
+				break
+			}
+		}
+	}
+	envelope.MailFrom = envelopeAddressOf(mailFrom)
+
+	rcptTo := test.RcptTo
+	if len(rcptTo) == 0 {
+		for _, header := range []string{"To", "Cc"} {
+			addresses, _ := msg.Header.AddressList(header)
+			for _, address := range addresses {
+				rcptTo = append(rcptTo, address.Address)
+			}
+		}
+	}
+	for _, rcpt := range rcptTo {
+		envelope.RcptTo = append(envelope.RcptTo, envelopeAddressOf(rcpt))
+	}
+	return envelope, nil
+}
+
+// envelopeAddressOf splits an address into the form of an SMTP envelope.
+func envelopeAddressOf(address string) mail.Address {
+	address = strings.TrimSpace(address)
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 {
+		return mail.Address{User: address}
+	}
+	return mail.Address{User: address[:i], Host: address[i+1:]}
+}
+
+func describeAction(rule *FilterRule) string {
+	action := rule.Action
+	switch rule.Action {
+	case FilterActionRoute:
+		action += " to " + strings.Join(rule.ChatIDs, ", ")
+	case FilterActionTag:
+		action += " " + rule.Tag
+	}
+	if rule.Continue && rule.Action != FilterActionContinue {
+		action += ", continue"
+	}
+	return action
+}
+
+func describeCondition(cond *FilterCondition) string {
+	if cond.Operator != "" {
+		return fmt.Sprintf("%s %s %s", cond.Field, cond.Operator, cond.Value)
+	}
+	return fmt.Sprintf("%s =~ '%s'", cond.Field, cond.Pattern)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+const filterCheckConfig = `filter_rules:
+  - name: tag-newsletter
+    action: tag
+    tag: newsletter
+    continue: true
+    conditions:
+      - field: header:List-Id
+        pattern: '.'
+  - name: reject-spam
+    match: any
+    conditions:
+      - field: subject
+        pattern: 'spam'
+      - field: envelope_from
+        pattern: '@spammer\.example$'
+routes:
+  - recipient: alerts@example.com
+    chat_ids: ['-100123']
+`
+
+func TestCheckConfig(t *testing.T) {
+	var out bytes.Buffer
+	filename := writeTestConfig(t, filterCheckConfig)
+	require.NoError(t, CheckConfig(&out, filename))
+	require.Equal(t,
+		filename+": OK\n"+
+			"Filter rules: 2\n"+
+			"  tag-newsletter: tag newsletter, continue, 1 condition (match all)\n"+
+			"  reject-spam: reject, 2 conditions (match any)\n"+
+			"Routes: 1\n",
+		out.String())
+	// Checking doesn't activate the rules
+	require.Empty(t, currentRules().FilterRules)
+
+	out.Reset()
+	filename = writeTestConfig(t, "client_access:\n  allow: [10.0.0.0/8]\n  deny: [10.1.0.0/16, 10.2.0.0/16]\n")
+	require.NoError(t, CheckConfig(&out, filename))
+	require.Contains(t, out.String(), "Client access: 1 network allowed, 2 networks denied\n")
+
+	err := CheckConfig(&out, writeTestConfig(t, "filter_rules:\n  - name: bad\n    action: drop\n"))
+	require.ErrorIs(t, err, errInvalidAction)
+	require.ErrorIs(t, CheckConfig(&out, ""), errConfigFileMissing)
+}
+
+func TestRunFilterTest(t *testing.T) {
+	defer activeRules.Store(nil)
+	dir := t.TempDir()
+	writeMessage := func(name, headers string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		content := headers + "To: to@test\r\nContent-Type: text/plain\r\n\r\nText body\r\n"
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+	spam := writeMessage("spam.eml", "From: from@test\r\nSubject: Cheap spam\r\n")
+	news := writeMessage("news.eml", "From: News <news@test>\r\nSubject: Weekly\r\nList-Id: <news.test>\r\n")
+	bounce := writeMessage("bounce.eml", "Return-Path: <x@spammer.example>\r\nFrom: from@test\r\nSubject: Hi\r\n")
+	plain := writeMessage("plain.eml", "From: from@test\r\nSubject: Hi\r\n")
+
+	run := func(test *FilterTest) (string, error) {
+		var out bytes.Buffer
+		test.ConfigFile = writeTestConfig(t, filterCheckConfig)
+		err := RunFilterTest(&out, test, makeTelegramConfig())
+		return out.String(), err
+	}
+
+	out, err := run(&FilterTest{Messages: []string{spam, news, bounce, plain}})
+	require.NoError(t, err)
+	require.Equal(t,
+		spam+": reject by rule 'reject-spam'\n"+
+			"  reject-spam (reject): subject =~ 'spam';\n"+
+			news+": forward\n"+
+			"  tag-newsletter (tag newsletter, continue): header:List-Id =~ '.';\n"+
+			bounce+": reject by rule 'reject-spam'\n"+
+			"  reject-spam (reject): envelope_from =~ '@spammer\\.example$';\n"+
+			plain+": forward, no rule matched\n",
+		out)
+
+	// The envelope can be given explicitly
+	out, err = run(&FilterTest{Messages: []string{plain}, MailFrom: "a@spammer.example", Expect: "reject-spam"})
+	require.NoError(t, err)
+	require.Contains(t, out, "envelope_from")
+
+	_, err = run(&FilterTest{Messages: []string{plain}, Expect: "none"})
+	require.NoError(t, err)
+
+	_, err = run(&FilterTest{Messages: []string{spam, news}, Expect: "reject-spam"})
+	var exitErr cli.ExitCoder
+	require.True(t, errors.As(err, &exitErr))
+	require.Equal(t, exitExpectationFailed, exitErr.ExitCode())
+	require.Contains(t, err.Error(), news)
+	require.NotContains(t, err.Error(), spam)
+
+	_, err = run(&FilterTest{})
+	require.ErrorIs(t, err, errNoMessages)
+	_, err = run(&FilterTest{Messages: []string{filepath.Join(dir, "missing.eml")}})
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func TestFilterRulesHeadersAndAttachments(t *testing.T) {
+	_, err := loadConfig(writeTestConfig(t, `filter_rules:
+  - name: mailer
+    conditions:
+      - field: header:x-mailer
+        pattern: '^BulkMailer'
+  - name: executable
+    conditions:
+      - field: attachment_name
+        pattern: '\.(exe|scr)$'
+  - name: zip-from-list
+    conditions:
+      - field: attachment_type
+        pattern: '^application/zip$'
+      - field: header:List-Id
+        pattern: 'promo'
+  - name: client
+    match: any
+    conditions:
+      - field: client_ip
+        pattern: '^192\.0\.2\.'
+      - field: helo
+        pattern: 'spammer\.example$'
+  - name: backup
+    conditions:
+      - field: auth_user
+        pattern: '^backup$'
+`))
+	require.NoError(t, err)
+
+	check := func(input *FilterInput) string {
+		return checkFilterRules(input).RuleName
+	}
+	zip := []AttachmentInfo{{Filename: "a.zip", ContentType: "application/zip"}}
+
+	require.Equal(t, "mailer", check(&FilterInput{Headers: textproto.MIMEHeader{"X-Mailer": {"bulkmailer 2.0"}}}))
+	require.Empty(t, check(&FilterInput{Headers: textproto.MIMEHeader{"X-Mailer": {"Thunderbird"}}}))
+	require.Equal(t, "executable", check(&FilterInput{Attachments: []AttachmentInfo{{Filename: "invoice.pdf"}, {Filename: "invoice.pdf.exe"}}}))
+	// All values of a repeated header are checked
+	require.Equal(t, "zip-from-list", check(&FilterInput{
+		Attachments: zip,
+		Headers:     textproto.MIMEHeader{"List-Id": {"news", "<promo.example.com>"}},
+	}))
+	// A missing header doesn't match
+	require.Empty(t, check(&FilterInput{Attachments: zip}))
+	require.Equal(t, "client", check(&FilterInput{ClientIP: "192.0.2.10"}))
+	require.Equal(t, "client", check(&FilterInput{ClientIP: "127.0.0.1", Helo: "mx.spammer.example"}))
+	require.Empty(t, check(&FilterInput{ClientIP: "127.0.0.1", Helo: "mx.example.com"}))
+	require.Equal(t, "backup", check(&FilterInput{AuthUser: "backup"}))
+	require.Empty(t, check(&FilterInput{AuthUser: "backup-old"}))
+}
+
+func TestFilterRulesSizeAndAttachmentCount(t *testing.T) {
+	_, err := loadConfig(writeTestConfig(t, `filter_rules:
+  - name: too-large
+    conditions:
+      - field: size
+        operator: '>'
+        value: 10m
+  - name: many-attachments
+    conditions:
+      - field: attachment_count
+        operator: '>='
+        value: '3'
+`))
+	require.NoError(t, err)
+
+	decision := checkFilterRules(&FilterInput{Size: 10_000_001})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "too-large", decision.RuleName)
+
+	decision = checkFilterRules(&FilterInput{Size: 10_000_000})
+	require.Empty(t, decision.Action)
+
+	decision = checkFilterRules(&FilterInput{Attachments: make([]AttachmentInfo, 3)})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "many-attachments", decision.RuleName)
+
+	decision = checkFilterRules(&FilterInput{Attachments: make([]AttachmentInfo, 2)})
+	require.Empty(t, decision.Action)
+}
+
+func TestFilterRulesValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+		wantErr   error
+	}{
+		{"unknown field", "field: sender", errInvalidField},
+		{"header without name", "field: 'header:'", errInvalidField},
+		{"header name with space", "field: 'header:X Mailer'", errInvalidField},
+		{"size with pattern", "field: size\n        pattern: '100'", errInvalidField},
+		{"size without operator", "field: size\n        value: 10m", errInvalidOperator},
+		{"unknown operator", "field: size\n        operator: '=>'\n        value: 10m", errInvalidOperator},
+		{"invalid size", "field: size\n        operator: '>'\n        value: big", errInvalidValue},
+		{"invalid count", "field: attachment_count\n        operator: '>'\n        value: 1.5", errInvalidValue},
+		{"operator on text field", "field: subject\n        operator: '>'\n        value: '1'", errInvalidOperator},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, "filter_rules:\n  - name: bad\n    conditions:\n      - "+tt.condition+"\n"))
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Contains(t, err.Error(), "rule 'bad'")
+			require.Nil(t, currentRules().FilterRules)
+		})
+	}
+}
+
+func TestFilteredEmailByHeaderAndClient(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = writeTestConfig(t, `filter_rules:
+  - name: local-mailer
+    conditions:
+      - field: header:X-Mailer
+        pattern: 'BulkMailer'
+      - field: client_ip
+        pattern: '^127\.0\.0\.1$'
+      - field: attachment_name
+        pattern: '\.exe$'
+`)
+	telegramConfig := makeTelegramConfig()
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	send := func(attachment string) error {
+		m := gomail.NewMessage()
+		m.SetHeader("From", "from@test")
+		m.SetHeader("To", "to@test")
+		m.SetHeader("Subject", "Invoice")
+		m.SetHeader("X-Mailer", "BulkMailer 2.0")
+		m.SetBody("text/plain", "See attached")
+		m.Attach(attachment, goMailBody([]byte("MZ")))
+		return gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "").DialAndSend(m)
+	}
+
+	err := send("invoice.exe")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "554")
+	require.Contains(t, err.Error(), "local-mailer")
+
+	require.NoError(t, send("invoice.pdf"))
+	require.Len(t, h.RequestMessages, len(strings.Split(telegramConfig.ChatIDs, ",")))
+}
+
+func TestFilterRulesActions(t *testing.T) {
+	_, err := loadConfig(writeTestConfig(t, `filter_rules:
+  - name: seen-billing
+    action: continue
+    conditions:
+      - field: from
+        pattern: '@billing\.example$'
+  - name: tag-newsletter
+    action: tag
+    tag: newsletter
+    continue: true
+    conditions:
+      - field: header:List-Id
+        pattern: '.'
+  - name: quiet-at-night
+    action: silent
+    continue: true
+    conditions:
+      - field: subject
+        pattern: 'nightly'
+  - name: billing
+    action: route
+    chat_ids: ['-100123:7']
+    conditions:
+      - field: from
+        pattern: '@billing\.example$'
+  - name: drop-promo
+    action: discard
+    conditions:
+      - field: subject
+        pattern: 'promo'
+  - name: reject-spam
+    conditions:
+      - field: subject
+        pattern: 'spam'
+`))
+	require.NoError(t, err)
+
+	list := textproto.MIMEHeader{"List-Id": {"<news.example.com>"}}
+
+	// Non-terminal rules add up until a terminal rule matches
+	decision := checkFilterRules(&FilterInput{Subject: "nightly report", From: "a@billing.example", Headers: list})
+	require.Empty(t, decision.Action)
+	require.Equal(t, "billing", decision.RuleName)
+	require.Equal(t, []string{"seen-billing", "tag-newsletter", "quiet-at-night", "billing"}, decision.Matched)
+	require.Equal(t, []string{"newsletter"}, decision.Tags)
+	require.True(t, decision.Silent)
+	require.Equal(t, []string{"-100123:7"}, decision.ChatIDs)
+
+	// The first terminal match wins: a routed email isn't discarded
+	decision = checkFilterRules(&FilterInput{Subject: "promo", From: "a@billing.example"})
+	require.Empty(t, decision.Action)
+	require.Equal(t, "billing", decision.RuleName)
+
+	decision = checkFilterRules(&FilterInput{Subject: "promo and spam", Headers: list})
+	require.Equal(t, FilterActionDiscard, decision.Action)
+	require.Equal(t, "drop-promo", decision.RuleName)
+	require.Equal(t, []string{"tag-newsletter", "drop-promo"}, decision.Matched)
+
+	decision = checkFilterRules(&FilterInput{Subject: "spam"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "reject-spam", decision.RuleName)
+
+	decision = checkFilterRules(&FilterInput{Subject: "hello"})
+	require.Empty(t, decision.Action)
+	require.Empty(t, decision.Matched)
+}
+
+func TestFilterRulesActionValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+	}{
+		{"unknown action", "action: drop"},
+		{"route without chat_ids", "action: route"},
+		{"chat_ids without route", "chat_ids: ['123']"},
+		{"invalid chat id", "action: route\n    chat_ids: ['abc']"},
+		{"tag without tag", "action: tag"},
+		{"reject with continue", "continue: true"},
+		{"discard with continue", "action: discard\n    continue: true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, "filter_rules:\n  - name: bad\n    "+tt.rule+
+				"\n    conditions:\n      - field: subject\n        pattern: x\n"))
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "rule 'bad'")
+		})
+	}
+}
+
+func TestFilterActionsDelivery(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = writeTestConfig(t, `filter_rules:
+  - name: drop-promo
+    action: discard
+    conditions:
+      - field: subject
+        pattern: 'promo'
+  - name: tag-report
+    action: tag
+    tag: report
+    continue: true
+    conditions:
+      - field: subject
+        pattern: 'report'
+  - name: quiet-report
+    action: silent
+    conditions:
+      - field: subject
+        pattern: 'report'
+`)
+	telegramConfig := makeTelegramConfig()
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	send := func(subject string) error {
+		m := gomail.NewMessage()
+		m.SetHeader("From", "from@test")
+		m.SetHeader("To", "to@test")
+		m.SetHeader("Subject", subject)
+		m.SetBody("text/plain", "Text body")
+		return gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "").DialAndSend(m)
+	}
+
+	// Accepted, but not forwarded
+	require.NoError(t, send("Big promo"))
+	require.Empty(t, h.RequestMessages)
+
+	require.NoError(t, send("Daily report"))
+	require.Len(t, h.RequestMessages, len(strings.Split(telegramConfig.ChatIDs, ",")))
+	require.Equal(t,
+		"🏷 report\n"+
+			"From: from@test\n"+
+			"To: to@test\n"+
+			"Subject: Daily report\n"+
+			"\n"+
+			"Text body",
+		h.RequestMessages[0])
+	require.Equal(t, "true", h.RequestSilent[0])
+
+	require.NoError(t, send("Hello"))
+	require.Empty(t, h.RequestSilent[len(h.RequestSilent)-1])
+}
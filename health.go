@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var health HealthState
+
+// HealthState tracks what the /healthz and /readyz endpoints report.
+type HealthState struct {
+	smtpListening atomic.Bool // the SMTP server accepts connections
+	botReady      atomic.Bool // GetBotUserID succeeded
+}
+
+// healthzHandler reports whether the SMTP server is up.
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	if !health.smtpListening.Load() {
+		http.Error(w, "smtp server is not listening", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// readyzHandler additionally requires the bot token to have been verified.
+func readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	if !health.smtpListening.Load() {
+		http.Error(w, "smtp server is not listening", http.StatusServiceUnavailable)
+		return
+	}
+	if !health.botReady.Load() {
+		http.Error(w, "telegram bot identity is not confirmed", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// StartHTTPServer serves /metrics, /healthz and /readyz on the address.
+func StartHTTPServer(listen string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", metricsHandler)
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.HandleFunc("GET /readyz", readyzHandler)
+
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start HTTP listener: %w", err)
+	}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("HTTP server error: %s", err)
+		}
+	}()
+	logger.Infof("HTTP listener for metrics and health checks started on %s", listen)
+	return server, nil
+}
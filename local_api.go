@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	units "github.com/docker/go-units"
+)
+
+// Upload limits of the Bot API, see https://core.telegram.org/bots/api#sending-files
+// and https://github.com/tdlib/telegram-bot-api#usage
+const (
+	telegramCloudAPIPrefix   = "https://api.telegram.org/"
+	telegramCloudMaxFileSize = 50 * units.MB
+	telegramLocalMaxFileSize = 2000 * units.MB
+	telegramMaxPhotoSize     = 10 * units.MB
+)
+
+var (
+	errLocalModeCloudAPI     = errors.New("--telegram-local-mode needs --telegram-api-prefix of a local Bot API server")
+	errLocalFileDirNotLocal  = errors.New("--telegram-local-file-dir needs --telegram-local-mode")
+	errLocalFileDirNotExists = errors.New("--telegram-local-file-dir is not a directory")
+	errLocalModeEnvelopeSize = errors.New("--smtp-max-envelope-size is too small for the attachment limits")
+)
+
+// validateLocalMode checks the local Bot API server settings and lowers the
+// attachment size limits to what the server accepts.
+func (c *TelegramConfig) validateLocalMode() error {
+	if c.LocalMode && strings.HasPrefix(c.APIPrefix, telegramCloudAPIPrefix) {
+		return errLocalModeCloudAPI
+	}
+	if c.LocalFileDir != "" {
+		if !c.LocalMode {
+			return errLocalFileDirNotLocal
+		}
+		dir, err := filepath.Abs(c.LocalFileDir)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errLocalFileDirNotExists, err)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("%w: %s", errLocalFileDirNotExists, dir)
+		}
+		c.LocalFileDir = dir
+	}
+
+	maxFileSize := telegramCloudMaxFileSize
+	if c.LocalMode {
+		maxFileSize = telegramLocalMaxFileSize
+	}
+	for _, size := range []*int{
+		&c.ForwardedAttachmentMaxSize,
+		&c.ForwardedAttachmentMaxAnimationSize,
+		&c.ForwardedAttachmentMaxVideoSize,
+		&c.ForwardedAttachmentMaxAudioSize,
+		&c.ForwardedAttachmentMaxVoiceSize,
+	} {
+		*size = min(*size, maxFileSize)
+	}
+	c.ForwardedAttachmentMaxPhotoSize = min(c.ForwardedAttachmentMaxPhotoSize, telegramMaxPhotoSize)
+	return nil
+}
+
+// minEnvelopeSize returns the size of an email carrying the largest attachment
+// the limits let through, base64 encoded.
+func (c *TelegramConfig) minEnvelopeSize() int64 {
+	largest := max(
+		c.ForwardedAttachmentMaxSize,
+		c.ForwardedAttachmentMaxPhotoSize,
+		c.ForwardedAttachmentMaxAnimationSize,
+		c.ForwardedAttachmentMaxVideoSize,
+		c.ForwardedAttachmentMaxAudioSize,
+		c.ForwardedAttachmentMaxVoiceSize,
+	)
+	// 4 bytes per 3, in lines of 76 characters.
+	return int64(largest) / 3 * 4 * 78 / 76
+}
+
+// checkEnvelopeSize makes sure that emails with attachments as large as the
+// local server accepts can be received: it raises the default max envelope
+// size, and refuses a max envelope size set too small.
+func (c *TelegramConfig) checkEnvelopeSize(smtpConfig *SMTPConfig, explicit bool) error {
+	minSize := c.minEnvelopeSize()
+	if !c.LocalMode || smtpConfig.MaxEnvelopeSize >= minSize {
+		return nil
+	}
+	if explicit {
+		return fmt.Errorf("%w: %s, at least %s is needed", errLocalModeEnvelopeSize,
+			units.HumanSize(float64(smtpConfig.MaxEnvelopeSize)), units.HumanSize(float64(minSize)))
+	}
+	smtpConfig.MaxEnvelopeSize = minSize
+	return nil
+}
+
+// writeLocalFiles writes the attachments to the directory shared with the
+// local Bot API server and sets their file_ids to the file:// URIs, so that
+// the server reads them from disk rather than from an upload. Attachments
+// which can't be written are uploaded. The returned func removes the files.
+func writeLocalFiles(dir string, attachments []*FormattedAttachment, fileIDs map[*FormattedAttachment]string) func() {
+	var dirs []string
+	for _, attachment := range attachments {
+		path, err := writeLocalFile(dir, attachment)
+		if err != nil {
+			logger.Warningf("Failed to write attachment %s to %s, uploading it: %s", attachment.Filename, dir, err)
+			continue
+		}
+		dirs = append(dirs, filepath.Dir(path))
+		fileIDs[attachment] = "file://" + path
+	}
+	return func() {
+		for _, dir := range dirs {
+			if err := os.RemoveAll(dir); err != nil {
+				logger.Warningf("Failed to remove %s: %s", dir, err)
+			}
+		}
+	}
+}
+
+// writeLocalFile writes the attachment to a directory of its own, as the
+// server names the file after its path.
+func writeLocalFile(dir string, attachment *FormattedAttachment) (string, error) {
+	fileDir, err := os.MkdirTemp(dir, "attachment-")
+	if err != nil {
+		return "", err
+	}
+	// The server usually runs as another user.
+	if err := os.Chmod(fileDir, 0o755); err != nil { //nolint:gosec // the server has to read it
+		_ = os.RemoveAll(fileDir)
+		return "", err
+	}
+	filename := filepath.Base(attachment.Filename)
+	if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+		filename = "attachment"
+	}
+	path := filepath.Join(fileDir, filename)
+	if err := os.WriteFile(path, attachment.Content, 0o644); err != nil { //nolint:gosec // the server has to read it
+		_ = os.RemoveAll(fileDir)
+		return "", err
+	}
+	return path, nil
+}
+
+// readLocalServerFile reads a file downloaded by the local Bot API server,
+// failing on files larger than maxSize.
+func readLocalServerFile(path string, maxSize int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	content, err := io.ReadAll(io.LimitReader(f, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxSize {
+		return nil, errAttachmentTooLarge
+	}
+	return content, nil
+}
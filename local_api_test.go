@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func TestValidateLocalMode(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		config  TelegramConfig
+		wantErr error
+		want    TelegramConfig
+	}{
+		{
+			name:   "cloud limits",
+			config: TelegramConfig{APIPrefix: telegramCloudAPIPrefix, ForwardedAttachmentMaxSize: 100 << 20, ForwardedAttachmentMaxPhotoSize: 5 << 20},
+			want:   TelegramConfig{APIPrefix: telegramCloudAPIPrefix, ForwardedAttachmentMaxSize: 50_000_000, ForwardedAttachmentMaxPhotoSize: 5 << 20},
+		},
+		{
+			name:   "local limits",
+			config: TelegramConfig{APIPrefix: "http://bot-api:8081/", LocalMode: true, ForwardedAttachmentMaxVideoSize: 100 << 20, ForwardedAttachmentMaxPhotoSize: 20 << 20},
+			want:   TelegramConfig{APIPrefix: "http://bot-api:8081/", LocalMode: true, ForwardedAttachmentMaxVideoSize: 100 << 20, ForwardedAttachmentMaxPhotoSize: 10_000_000},
+		},
+		{
+			name:    "local mode of the cloud API",
+			config:  TelegramConfig{APIPrefix: telegramCloudAPIPrefix, LocalMode: true},
+			wantErr: errLocalModeCloudAPI,
+		},
+		{
+			name:    "file dir without local mode",
+			config:  TelegramConfig{APIPrefix: "http://bot-api:8081/", LocalFileDir: dir},
+			wantErr: errLocalFileDirNotLocal,
+		},
+		{
+			name:    "missing file dir",
+			config:  TelegramConfig{APIPrefix: "http://bot-api:8081/", LocalMode: true, LocalFileDir: filepath.Join(dir, "missing")},
+			wantErr: errLocalFileDirNotExists,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validateLocalMode()
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, tt.config)
+		})
+	}
+}
+
+func TestCheckEnvelopeSize(t *testing.T) {
+	local := &TelegramConfig{LocalMode: true, ForwardedAttachmentMaxSize: 10 << 20, ForwardedAttachmentMaxVideoSize: 300 << 20}
+	require.Equal(t, int64(400<<20)*78/76, local.minEnvelopeSize())
+
+	// The default is raised, an explicit value is checked
+	smtpConfig := &SMTPConfig{MaxEnvelopeSize: 50 << 20}
+	require.NoError(t, local.checkEnvelopeSize(smtpConfig, false))
+	require.Equal(t, local.minEnvelopeSize(), smtpConfig.MaxEnvelopeSize)
+	smtpConfig.MaxEnvelopeSize = 50 << 20
+	require.ErrorIs(t, local.checkEnvelopeSize(smtpConfig, true), errLocalModeEnvelopeSize)
+	smtpConfig.MaxEnvelopeSize = 1 << 30
+	require.NoError(t, local.checkEnvelopeSize(smtpConfig, true))
+	require.Equal(t, int64(1<<30), smtpConfig.MaxEnvelopeSize)
+
+	// Without local mode the envelope size is left alone
+	cloud := &TelegramConfig{ForwardedAttachmentMaxSize: 300 << 20}
+	smtpConfig.MaxEnvelopeSize = 50 << 20
+	require.NoError(t, cloud.checkEnvelopeSize(smtpConfig, true))
+	require.Equal(t, int64(50<<20), smtpConfig.MaxEnvelopeSize)
+}
+
+func TestLocalFileDelivery(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.ForwardedAttachmentMaxSize = 1024
+	telegramConfig.LocalMode = true
+	telegramConfig.LocalFileDir = t.TempDir()
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Report")
+	m.SetBody("text/plain", "Text body")
+	m.Attach("report.pdf", goMailBody([]byte("PDF")))
+	require.NoError(t, gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "").DialAndSend(m))
+
+	// The server reads the file from disk, the second chat gets it by file_id
+	require.Len(t, h.RequestFileIDs, 2)
+	require.Regexp(t, "^file://"+regexp.QuoteMeta(telegramConfig.LocalFileDir)+`/[^/]+/report\.pdf$`, h.RequestFileIDs[0])
+	require.Equal(t, "file-1", h.RequestFileIDs[1])
+	exp := &FormattedAttachment{Filename: "report.pdf", Caption: "report.pdf", Content: []byte("PDF"), FileType: AttachmentTypeDocument}
+	require.Equal(t, []*FormattedAttachment{exp, exp}, h.RequestDocuments)
+
+	// and it is removed after sending
+	entries, err := os.ReadDir(telegramConfig.LocalFileDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+)
+
+// mediaGroupMaxSize is the most attachments Telegram allows in an album.
+const mediaGroupMaxSize = 10
+
+var errMediaGroupResult = errors.New("unexpected sendMediaGroup result")
+
+// inputMediaTypes are the types of attachments in albums. Photos and videos
+// can be mixed, audio and documents only with their own type; animations and
+// voice messages can't be in albums.
+var inputMediaTypes = map[int]string{
+	AttachmentTypePhoto:    "photo",
+	AttachmentTypeVideo:    "video",
+	AttachmentTypeAudio:    "audio",
+	AttachmentTypeDocument: "document",
+}
+
+// TelegramInputMedia is an item of an album, see
+// https://core.telegram.org/bots/api#inputmediaphoto
+type TelegramInputMedia struct {
+	Type    string `json:"type"`  // one of inputMediaTypes
+	Media   string `json:"media"` // file_id, or attach://<field> for an upload
+	Caption string `json:"caption,omitempty"`
+}
+
+type TelegramAPIMessagesResult struct {
+	Ok     bool                  `json:"ok"`
+	Result []*TelegramAPIMessage `json:"result"`
+}
+
+// attachmentAlbums splits attachments into the albums Telegram allows, in the
+// order of their first item. Attachments which can't be in an album are
+// albums of their own.
+func attachmentAlbums(attachments []*FormattedAttachment) [][]*FormattedAttachment {
+	var albums [][]*FormattedAttachment
+	last := make(map[int]int) // album kind -> index of its last album
+	for _, attachment := range attachments {
+		kind := attachment.FileType
+		if kind == AttachmentTypeVideo {
+			kind = AttachmentTypePhoto
+		}
+		i, ok := last[kind]
+		if _, album := inputMediaTypes[kind]; !album || !ok || len(albums[i]) == mediaGroupMaxSize {
+			albums = append(albums, nil)
+			i = len(albums) - 1
+			last[kind] = i
+		}
+		albums[i] = append(albums[i], attachment)
+	}
+	return albums
+}
+
+// sendAttachments sends the attachments in reply to the message, as albums
+// where several can be grouped. The attachments of an album which fails
+// are sent one by one, and their errors are returned only if
+// ForwardedAttachmentRespectErrors is set. fileIDs are updated with the
+// file_ids of the sent attachments.
+func sendAttachments(
+	ctx context.Context,
+	attachments []*FormattedAttachment,
+	fileIDs map[*FormattedAttachment]string,
+	target ChatTarget,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+	sentMessage *TelegramAPIMessage,
+) error {
+	for _, album := range attachmentAlbums(attachments) {
+		if len(album) > 1 {
+			sentFileIDs, err := SendMediaGroupToChat(ctx, album, fileIDs, target, telegramConfig, client, sentMessage)
+			if err == nil {
+				for i, attachment := range album {
+					fileIDs[attachment] = sentFileIDs[i]
+					metricAttachments.Inc("sent")
+				}
+				continue
+			}
+			logger.Warningf("Failed to send %d attachments as an album, sending them one by one: %s",
+				len(album), SanitizeBotToken(err.Error(), telegramConfig.BotToken))
+		}
+
+		for _, attachment := range album {
+			fileID, err := sendAttachment(ctx, attachment, fileIDs[attachment], target, telegramConfig, client, sentMessage)
+			if err != nil {
+				metricAttachments.Inc("failed")
+				sanitizedErr := fmt.Errorf("%w: %s", errSanitizedTelegramFail, SanitizeBotToken(err.Error(), telegramConfig.BotToken))
+				if telegramConfig.ForwardedAttachmentRespectErrors {
+					return sanitizedErr
+				}
+				logger.Errorf("Ignoring attachment sending error: %s", sanitizedErr)
+				continue
+			}
+			fileIDs[attachment] = fileID
+			metricAttachments.Inc("sent")
+		}
+	}
+	return nil
+}
+
+// buildMediaGroupForm returns the form writer to send attachments as an
+// album, by their file_id where one is known.
+func buildMediaGroupForm(
+	attachments []*FormattedAttachment,
+	fileIDs map[*FormattedAttachment]string,
+	target ChatTarget,
+	sentMessage *TelegramAPIMessage,
+) (func(w *multipart.Writer) error, error) {
+	// https://core.telegram.org/bots/api#sendmediagroup
+	type upload struct {
+		field, filename string
+		content         []byte
+	}
+	var uploads []upload
+	media := make([]TelegramInputMedia, 0, len(attachments))
+	for i, attachment := range attachments {
+		mediaType, ok := inputMediaTypes[attachment.FileType]
+		if !ok {
+			return nil, fmt.Errorf("%w: %d", errUnknownFileType, attachment.FileType)
+		}
+		item := TelegramInputMedia{Type: mediaType, Media: fileIDs[attachment], Caption: attachment.Caption}
+		if item.Media == "" {
+			field := fmt.Sprintf("file%d", i)
+			item.Media = "attach://" + field
+			uploads = append(uploads, upload{field: field, filename: attachment.Filename, content: attachment.Content})
+		}
+		media = append(media, item)
+	}
+	j, err := json.Marshal(media)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode media: %w", err)
+	}
+
+	targetValues := target.formValues()
+	replyToMessageID := sentMessage.MessageID.String()
+	return func(w *multipart.Writer) error {
+		for key, values := range targetValues {
+			if err := w.WriteField(key, values[0]); err != nil {
+				return fmt.Errorf("failed to write %s: %w", key, err)
+			}
+		}
+		if err := w.WriteField("reply_to_message_id", replyToMessageID); err != nil {
+			return fmt.Errorf("failed to write reply_to_message_id: %w", err)
+		}
+		if err := w.WriteField("media", string(j)); err != nil {
+			return fmt.Errorf("failed to write media: %w", err)
+		}
+		for _, u := range uploads {
+			fileWriter, err := w.CreateFormFile(u.field, u.filename)
+			if err != nil {
+				return fmt.Errorf("failed to create form file: %w", err)
+			}
+			if _, err := fileWriter.Write(u.content); err != nil {
+				return fmt.Errorf("failed to write file content: %w", err)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// SendMediaGroupToChat sends the attachments of an album in reply to the
+// message. It returns the file_ids of the sent attachments.
+func SendMediaGroupToChat(
+	ctx context.Context,
+	attachments []*FormattedAttachment,
+	fileIDs map[*FormattedAttachment]string,
+	target ChatTarget,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+	sentMessage *TelegramAPIMessage,
+) ([]string, error) {
+	writeForm, err := buildMediaGroupForm(attachments, fileIDs, target, sentMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	apiURL := fmt.Sprintf(
+		"%sbot%s/sendMediaGroup?disable_notification=true",
+		telegramConfig.APIPrefix,
+		telegramConfig.BotToken,
+	)
+	resp, err := telegramSender.Do(ctx, client, target.ChatID, newMultipartRequest(ctx, apiURL, writeForm))
+	if err != nil {
+		return nil, err
+	}
+	j, err := readTelegramResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	result := &TelegramAPIMessagesResult{}
+	if err := json.Unmarshal(j, result); err != nil {
+		return nil, fmt.Errorf("%w: %w", errParsingJSON, err)
+	}
+	if !result.Ok {
+		return nil, fmt.Errorf("%w: %s", errResponseNotOK, j)
+	}
+	if len(result.Result) != len(attachments) {
+		return nil, fmt.Errorf("%w: %d messages for %d attachments", errMediaGroupResult, len(result.Result), len(attachments))
+	}
+	sentFileIDs := make([]string, len(result.Result))
+	for i, message := range result.Result {
+		sentFileIDs[i] = message.fileID()
+	}
+	return sentFileIDs, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func TestAttachmentAlbums(t *testing.T) {
+	var attachments []*FormattedAttachment
+	add := func(fileType int) {
+		attachments = append(attachments, &FormattedAttachment{
+			Filename: fmt.Sprintf("%d", len(attachments)),
+			FileType: fileType,
+		})
+	}
+	add(AttachmentTypePhoto)
+	add(AttachmentTypeDocument)
+	for range 10 {
+		add(AttachmentTypePhoto)
+	}
+	add(AttachmentTypeDocument)
+
+	var got [][]string
+	for _, album := range attachmentAlbums(attachments) {
+		var names []string
+		for _, attachment := range album {
+			names = append(names, attachment.Filename)
+		}
+		got = append(got, names)
+	}
+	require.Equal(t, [][]string{
+		{"0", "2", "3", "4", "5", "6", "7", "8", "9", "10"},
+		{"1", "12"},
+		{"11"},
+	}, got)
+}
+
+func TestMediaGroupDelivery(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.ForwardedAttachmentMaxSize = 1024
+	telegramConfig.ForwardedAttachmentMaxPhotoSize = 1024
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	send := func() error {
+		m := gomail.NewMessage()
+		m.SetHeader("From", "from@test")
+		m.SetHeader("To", "to@test")
+		m.SetHeader("Subject", "Photos")
+		m.SetBody("text/plain", "Text body")
+		m.Attach("a.jpg", goMailBody([]byte("JPG1")))
+		m.Attach("b.jpg", goMailBody([]byte("JPG2")))
+		return gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "").DialAndSend(m)
+	}
+	expFiles := []*FormattedAttachment{
+		{Filename: "a.jpg", Caption: "a.jpg", Content: []byte("JPG1"), FileType: AttachmentTypePhoto},
+		{Filename: "b.jpg", Caption: "b.jpg", Content: []byte("JPG2"), FileType: AttachmentTypePhoto},
+	}
+
+	// The album of the second chat reuses the uploaded files
+	require.NoError(t, send())
+	require.Equal(t, []int{2, 2}, h.RequestMediaGroups)
+	require.Equal(t, []string{"", "", "file-1", "file-2"}, h.RequestFileIDs)
+	require.Equal(t, append(expFiles, expFiles...), h.RequestDocuments)
+
+	// Failed albums are sent one by one
+	h.RequestMediaGroups = nil
+	h.RequestDocuments = nil
+	h.RejectMethods = []string{"sendMediaGroup"}
+	require.NoError(t, send())
+	require.Empty(t, h.RequestMediaGroups)
+	require.Equal(t, append(expFiles, expFiles...), h.RequestDocuments)
+
+	// and their errors are handled like before
+	h.RejectAttachments = true
+	err := send()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "554")
+	telegramConfig.ForwardedAttachmentRespectErrors = false
+	require.NoError(t, send())
+}
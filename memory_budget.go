@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var errMemoryBudgetExhausted = errors.New("too many emails in flight, try again later")
+
+// MemoryBudget limits the total size of the emails being received and
+// forwarded at once. An email takes a few times its size in memory while it
+// is parsed and its attachments are uploaded.
+type MemoryBudget struct {
+	limit int64
+
+	mu       sync.Mutex
+	inFlight int64
+}
+
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// Reserve takes size bytes of the budget, if there are enough left. An email
+// is always let through when nothing else is in flight, so that emails larger
+// than the budget are delayed rather than never forwarded.
+func (b *MemoryBudget) Reserve(size int64) bool {
+	return b.grow(0, size)
+}
+
+// grow takes size more bytes for an email which already holds reserved
+// bytes of the budget.
+func (b *MemoryBudget) grow(reserved, size int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.inFlight > reserved && b.inFlight+size > b.limit {
+		return false
+	}
+	b.inFlight += size
+	return true
+}
+
+// Release returns size bytes taken by Reserve to the budget.
+func (b *MemoryBudget) Release(size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight -= size
+}
+
+// memoryReservation is the part of the budget held by one email, from DATA
+// until it is forwarded. Without a budget every reservation succeeds.
+type memoryReservation struct {
+	budget *MemoryBudget // nil without a memory budget
+	size   int64
+}
+
+// growTo makes the reservation at least size bytes large.
+func (r *memoryReservation) growTo(size int64) bool {
+	if size <= r.size {
+		return true
+	}
+	if r.budget != nil && !r.budget.grow(r.size, size-r.size) {
+		return false
+	}
+	r.size = size
+	return true
+}
+
+func (r *memoryReservation) release() {
+	if r.budget != nil {
+		r.budget.Release(r.size)
+	}
+	r.size = 0
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(100)
+
+	// An email larger than the budget gets through alone
+	require.True(t, b.Reserve(150))
+	require.False(t, b.Reserve(1))
+	b.Release(150)
+
+	require.True(t, b.Reserve(60))
+	require.True(t, b.Reserve(40))
+	require.False(t, b.Reserve(1))
+	b.Release(60)
+	require.True(t, b.Reserve(50))
+	require.False(t, b.Reserve(20))
+}
+
+func TestMemoryReservation(t *testing.T) {
+	b := NewMemoryBudget(100)
+
+	// A reservation alone in the budget grows past it
+	r := &memoryReservation{budget: b}
+	require.True(t, r.growTo(60))
+	require.True(t, r.growTo(150))
+	require.True(t, r.growTo(10))
+	r.release()
+
+	r1, r2 := &memoryReservation{budget: b}, &memoryReservation{budget: b}
+	require.True(t, r1.growTo(60))
+	require.True(t, r2.growTo(40))
+	require.False(t, r2.growTo(41))
+	r1.release()
+	require.True(t, r2.growTo(100))
+	r2.release()
+	require.True(t, b.Reserve(100))
+
+	// Without a budget everything fits
+	require.True(t, (&memoryReservation{}).growTo(1<<40))
+}
+
+// holdFirstEmail makes the Telegram API hold the first request until release
+// is closed.
+func holdFirstEmail(t *testing.T) (h *SuccessHandler, started, release chan struct{}, shutdown func()) {
+	t.Helper()
+	started, release = make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	h = NewSuccessHandler()
+	s := HTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+		h.ServeHTTP(w, r)
+	}))
+	return h, started, release, func() { _ = s.Shutdown(context.Background()) }
+}
+
+func TestSMTPMemoryBudgetExhausted(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.MemoryBudget = 1
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	h, started, release, shutdown := holdFirstEmail(t)
+	defer shutdown()
+
+	firstErr := make(chan error)
+	go func() { firstErr <- sendClientAccessTestMail() }()
+	<-started
+
+	// The second email is deferred at DATA, before it is sent
+	c, err := smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	require.NoError(t, c.Mail("from@test"))
+	require.NoError(t, c.Rcpt("to@test"))
+	_, err = c.Data()
+	var smtpErr *textproto.Error
+	require.ErrorAs(t, err, &smtpErr)
+	require.Equal(t, 452, smtpErr.Code)
+	require.Equal(t, "4.3.1 Error: "+errMemoryBudgetExhausted.Error(), smtpErr.Msg)
+	_ = c.Close()
+
+	close(release)
+	require.NoError(t, <-firstErr)
+	require.NoError(t, sendClientAccessTestMail())
+	require.Len(t, h.RequestMessages, 4)
+}
+
+func TestSMTPMemoryBudgetExhaustedWhileReading(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.MemoryBudget = 100 << 10
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	h, started, release, shutdown := holdFirstEmail(t)
+	defer shutdown()
+
+	firstErr := make(chan error)
+	go func() { firstErr <- sendClientAccessTestMail() }()
+	<-started
+
+	// The second email fits at DATA, but not once it turns out larger than
+	// the rest of the budget
+	c, err := smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	require.NoError(t, c.Mail("from@test"))
+	require.NoError(t, c.Rcpt("to@test"))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: Test subj\r\n\r\n" + strings.Repeat("Text body\r\n", 20000)))
+	require.NoError(t, err)
+	err = w.Close()
+	var smtpErr *textproto.Error
+	require.ErrorAs(t, err, &smtpErr)
+	require.Equal(t, 452, smtpErr.Code)
+
+	close(release)
+	require.NoError(t, <-firstErr)
+	// The budget is released once the first email is forwarded
+	require.NoError(t, sendTestMail(t, c))
+	require.Len(t, h.RequestMessages, 4)
+}
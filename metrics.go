@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal implementation of the Prometheus text exposition format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+var (
+	metricEmailsReceived = newCounter("smtp_to_telegram_emails_received_total",
+		"Emails accepted by the SMTP server for processing.")
+	metricEmailsRejected = newCounter("smtp_to_telegram_emails_rejected_total",
+		"Emails rejected by reason (filter_rule, client_access, rate_limit or memory_budget), "+
+			"with the name of the filter rule.", "reason", "rule")
+	metricEmailsDiscarded = newCounter("smtp_to_telegram_emails_discarded_total",
+		"Emails accepted but not forwarded because of a discard filter rule.", "rule")
+	metricEmailsForwarded = newCounter("smtp_to_telegram_emails_forwarded_total",
+		"Emails forwarded to Telegram.")
+	metricEmailsFailed = newCounter("smtp_to_telegram_emails_failed_total",
+		"Emails which could not be forwarded to Telegram.")
+	metricTelegramRequests = newCounter("smtp_to_telegram_telegram_requests_total",
+		"Telegram Bot API requests by method and HTTP status code.", "method", "code")
+	metricAttachments = newCounter("smtp_to_telegram_attachments_total",
+		"Email attachments by outcome (sent, discarded or failed).", "result")
+	metricReplies = newCounter("smtp_to_telegram_replies_total",
+		"Reply emails by outcome (sent or failed).", "result")
+	metricTelegramDuration = newHistogram("smtp_to_telegram_telegram_request_duration_seconds",
+		"Latency of Telegram Bot API requests.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "method")
+	metricEmailSize = newHistogram("smtp_to_telegram_email_size_bytes",
+		"Size of received emails.",
+		[]float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20})
+
+	metricsRegistry = []metricWriter{
+		metricEmailsReceived,
+		metricEmailsRejected,
+		metricEmailsDiscarded,
+		metricEmailsForwarded,
+		metricEmailsFailed,
+		metricTelegramRequests,
+		metricAttachments,
+		metricReplies,
+		metricTelegramDuration,
+		metricEmailSize,
+	}
+)
+
+type metricWriter interface {
+	writeTo(w io.Writer) error
+}
+
+// Counter is a monotonically increasing value, optionally split by labels.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // keyed by formatted label pairs
+}
+
+func newCounter(name, help string, labels ...string) *Counter {
+	return &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+// Value returns the current value for the label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) writeTo(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name); err != nil {
+		return err
+	}
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		_, err := fmt.Fprintf(w, "%s 0\n", c.name)
+		return err
+	}
+	for _, key := range sortedKeys(c.values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations in cumulative buckets, optionally split by labels.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries // keyed by label values
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	count       uint64
+	sum         float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) writeTo(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		labels := append(slices.Clone(h.labels), "le")
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			values := append(slices.Clone(s.labelValues), formatFloat(bound))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), cumulative); err != nil {
+				return err
+			}
+		}
+		values := append(slices.Clone(s.labelValues), "+Inf")
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, formatLabels(labels, values), s.count,
+			h.name, key, formatFloat(s.sum),
+			h.name, key, s.count,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatLabels returns the {name="value",...} part of a sample line.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// observeTelegramRequest records the outcome and latency of a Bot API request.
+func observeTelegramRequest(req *http.Request, start time.Time, resp *http.Response, err error) {
+	method := path.Base(req.URL.Path)
+	if strings.Contains(req.URL.Path, "/file/bot") {
+		method = "file" // downloads are labelled by file path otherwise
+	}
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	metricTelegramRequests.Inc(method, code)
+	metricTelegramDuration.Observe(time.Since(start).Seconds(), method)
+}
+
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricsRegistry {
+		if err := m.writeTo(w); err != nil {
+			logger.Warningf("Failed to write metrics: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterFormat(t *testing.T) {
+	c := newCounter("test_total", "Test counter.", "rule")
+	c.Inc("b")
+	c.Add(2, `a"\`)
+
+	var b strings.Builder
+	require.NoError(t, c.writeTo(&b))
+	require.Equal(t,
+		"# HELP test_total Test counter.\n"+
+			"# TYPE test_total counter\n"+
+			`test_total{rule="a\"\\"} 2`+"\n"+
+			`test_total{rule="b"} 1`+"\n",
+		b.String())
+}
+
+func TestCounterWithoutLabelsStartsAtZero(t *testing.T) {
+	c := newCounter("test_total", "Test counter.")
+	var b strings.Builder
+	require.NoError(t, c.writeTo(&b))
+	require.Contains(t, b.String(), "test_total 0\n")
+}
+
+func TestHistogramFormat(t *testing.T) {
+	h := newHistogram("test_seconds", "Test histogram.", []float64{0.5, 1}, "method")
+	h.Observe(0.2, "getMe")
+	h.Observe(1, "getMe")
+	h.Observe(3, "getMe")
+
+	var b strings.Builder
+	require.NoError(t, h.writeTo(&b))
+	require.Equal(t,
+		"# HELP test_seconds Test histogram.\n"+
+			"# TYPE test_seconds histogram\n"+
+			`test_seconds_bucket{method="getMe",le="0.5"} 1`+"\n"+
+			`test_seconds_bucket{method="getMe",le="1"} 2`+"\n"+
+			`test_seconds_bucket{method="getMe",le="+Inf"} 3`+"\n"+
+			`test_seconds_sum{method="getMe"} 4.2`+"\n"+
+			`test_seconds_count{method="getMe"} 3`+"\n",
+		b.String())
+}
+
+func TestMetricsCollectedForForwardedEmail(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	received := metricEmailsReceived.Value()
+	forwarded := metricEmailsForwarded.Value()
+	sent := metricTelegramRequests.Value("sendMessage", "200")
+
+	err := smtp.SendMail(smtpConfig.Listen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	require.NoError(t, err)
+
+	require.Equal(t, received+1, metricEmailsReceived.Value())
+	require.Equal(t, forwarded+1, metricEmailsForwarded.Value())
+	require.Equal(t, sent+2, metricTelegramRequests.Value("sendMessage", "200"))
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `smtp_to_telegram_telegram_requests_total{method="sendMessage",code="200"}`)
+	require.Contains(t, rec.Body.String(), "smtp_to_telegram_email_size_bytes_count ")
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	defer func(smtp, bot bool) {
+		health.smtpListening.Store(smtp)
+		health.botReady.Store(bot)
+	}(health.smtpListening.Load(), health.botReady.Load())
+
+	check := func(handler http.HandlerFunc) int {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code
+	}
+
+	health.smtpListening.Store(false)
+	health.botReady.Store(false)
+	require.Equal(t, http.StatusServiceUnavailable, check(healthzHandler))
+	require.Equal(t, http.StatusServiceUnavailable, check(readyzHandler))
+
+	health.smtpListening.Store(true)
+	require.Equal(t, http.StatusOK, check(healthzHandler))
+	require.Equal(t, http.StatusServiceUnavailable, check(readyzHandler))
+
+	health.botReady.Store(true)
+	require.Equal(t, http.StatusOK, check(readyzHandler))
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +12,6 @@ import (
 	"net/mail"
 	"net/url"
 	"slices"
-	"strconv"
 	"strings"
 	"time"
 
@@ -25,11 +26,18 @@ type TelegramUpdate struct {
 }
 
 type TelegramUpdateMessage struct {
-	MessageID      int                   `json:"message_id"`
-	Chat           TelegramChat          `json:"chat"`
-	Text           string                `json:"text"`
-	From           *TelegramUser         `json:"from"`
-	ReplyToMessage *TelegramReplyMessage `json:"reply_to_message"`
+	MessageID       int                   `json:"message_id"`
+	MessageThreadID int                   `json:"message_thread_id"`
+	IsTopicMessage  bool                  `json:"is_topic_message"`
+	Chat            TelegramChat          `json:"chat"`
+	Text            string                `json:"text"`
+	Caption         string                `json:"caption"`
+	Photo           []TelegramPhotoSize   `json:"photo"`
+	Document        *TelegramFile         `json:"document"`
+	Voice           *TelegramFile         `json:"voice"`
+	Video           *TelegramFile         `json:"video"`
+	From            *TelegramUser         `json:"from"`
+	ReplyToMessage  *TelegramReplyMessage `json:"reply_to_message"`
 }
 
 type TelegramReplyMessage struct {
@@ -63,6 +71,8 @@ type SMTPOutConfig struct {
 	Port     int
 	Username string
 	Password string
+	// Largest Telegram file attached to a reply email, 0 disables attachments.
+	AttachmentMaxSize int64
 }
 
 func (c *SMTPOutConfig) IsConfigured() bool {
@@ -76,6 +86,24 @@ type ParsedHeaders struct {
 	CC      string
 	ReplyTo string
 	Subject string
+	// Only known for messages found in the message store.
+	MessageID  string
+	References string
+}
+
+// ReplyThread holds the threading headers of a reply email.
+type ReplyThread struct {
+	InReplyTo  string
+	References string
+}
+
+// NewReplyThread returns the threading headers of a reply to the email with
+// the given Message-ID and References.
+func NewReplyThread(messageID, references string) ReplyThread {
+	return ReplyThread{
+		InReplyTo:  messageID,
+		References: strings.Join(strings.Fields(references+" "+messageID), " "),
+	}
 }
 
 var (
@@ -114,6 +142,21 @@ func ParseMessageHeaders(text string) (ParsedHeaders, error) {
 	return headers, nil
 }
 
+// originalEmailHeaders returns the headers of the email a reply refers to.
+// Messages from before the message store was enabled (or pruned from it) are
+// parsed from their text.
+func originalEmailHeaders(store *MessageStore, msg *TelegramUpdateMessage) (ParsedHeaders, error) {
+	if store != nil {
+		stored, err := store.Get(msg.Chat.ID, int64(msg.ReplyToMessage.MessageID))
+		if err != nil {
+			logger.Errorf("Message store lookup failed: %s", err)
+		} else if stored != nil {
+			return stored.headers(), nil
+		}
+	}
+	return ParseMessageHeaders(msg.ReplyToMessage.Text)
+}
+
 // ComposeReplyAddresses determines the from, to, cc, and subject for a reply email.
 // It picks the first To or CC address whose domain matches an allowed host as the
 // sender, so the reply comes from our own address even when we were CC'd.
@@ -127,10 +170,11 @@ func ComposeReplyAddresses(headers *ParsedHeaders, allowedHosts []string) (from
 		return "", nil, nil, "", errNoOwnAddress
 	}
 
+	// Headers may carry display names, the recipients are bare addresses.
 	if headers.ReplyTo != "" {
-		to = []string{headers.ReplyTo}
+		to = splitAddresses(headers.ReplyTo)
 	} else {
-		to = []string{headers.From}
+		to = splitAddresses(headers.From)
 	}
 
 	for _, addr := range allAddresses {
@@ -148,6 +192,9 @@ func ComposeReplyAddresses(headers *ParsedHeaders, allowedHosts []string) (from
 	return from, to, cc, subject, nil
 }
 
+// parseChatIDs returns the chat IDs of a comma-separated list of chat targets.
+// Forum topic suffixes are dropped, so a chat listed with several topics
+// appears only once.
 func parseChatIDs(chatIDsStr string) ([]int64, error) {
 	var ids []int64
 	for part := range strings.SplitSeq(chatIDsStr, ",") {
@@ -155,11 +202,13 @@ func parseChatIDs(chatIDsStr string) ([]int64, error) {
 		if s == "" {
 			continue
 		}
-		id, err := strconv.ParseInt(s, 10, 64)
+		target, err := ParseChatTarget(s)
 		if err != nil {
-			return nil, fmt.Errorf("invalid chat ID %q: %w", s, err)
+			return nil, err
+		}
+		if !slices.Contains(ids, target.ChatID) {
+			ids = append(ids, target.ChatID)
 		}
-		ids = append(ids, id)
 	}
 	return ids, nil
 }
@@ -189,6 +238,16 @@ func splitAddresses(s string) []string {
 	return result
 }
 
+// bareAddress returns the address of "Name <address>", or s itself if it
+// can't be parsed.
+func bareAddress(s string) string {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return s
+	}
+	return addr.Address
+}
+
 // findOwnAddress returns the first address whose domain matches one of the
 // allowed hosts. If allowedHosts contains "." (any host), it returns the first
 // address unconditionally.
@@ -221,7 +280,14 @@ func SendReplyEmail(
 	cc []string,
 	subject string,
 	body string,
-) error {
+	thread ReplyThread,
+	attachments []*ReplyAttachment,
+) (messageID string, err error) {
+	messageID, err = newMessageID(from)
+	if err != nil {
+		return "", err
+	}
+
 	m := gomail.NewMessage()
 	m.SetHeader("From", from)
 	m.SetHeader("To", to...)
@@ -229,22 +295,70 @@ func SendReplyEmail(
 		m.SetHeader("Cc", cc...)
 	}
 	m.SetHeader("Subject", subject)
+	m.SetHeader("Message-ID", messageID)
+	if thread.InReplyTo != "" {
+		m.SetHeader("In-Reply-To", thread.InReplyTo)
+	}
+	if thread.References != "" {
+		m.SetHeader("References", thread.References)
+	}
 	m.SetBody("text/plain", body)
+	for _, attachment := range attachments {
+		content := attachment.Content
+		m.Attach(attachment.Filename,
+			gomail.SetHeader(map[string][]string{"Content-Type": {attachment.ContentType}}),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(content)
+				return err
+			}))
+	}
 
 	d := gomail.NewDialer(config.Host, config.Port, config.Username, config.Password)
-	return d.DialAndSend(m)
+	return messageID, d.DialAndSend(m)
 }
 
-// HandleTelegramReply processes a Telegram update that is a reply to a bot message,
-// extracts email headers from the original message, and sends a reply email.
-func HandleTelegramReply(update TelegramUpdate, smtpOutConfig *SMTPOutConfig, botUserID int64, allowedHosts []string) string {
-	msg := update.Message
+// newMessageID returns a unique Message-ID in the domain of the from address.
+func newMessageID(from string) (string, error) {
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if _, host, ok := strings.Cut(addr.Address, "@"); ok && host != "" {
+			domain = host
+		}
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate Message-ID: %w", err)
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain), nil
+}
+
+// isReplyToBot reports whether the message explicitly replies to a message of the bot.
+func isReplyToBot(msg *TelegramUpdateMessage, botUserID int64) bool {
 	if msg == nil || msg.ReplyToMessage == nil {
-		return ""
+		return false
 	}
+	if msg.ReplyToMessage.From == nil || msg.ReplyToMessage.From.ID != botUserID {
+		return false
+	}
+	// Inside a forum topic every message without an explicit reply points to
+	// the topic's service message, whose ID is the thread ID.
+	return !msg.IsTopicMessage || msg.ReplyToMessage.MessageID != msg.MessageThreadID
+}
 
+// HandleTelegramReply processes a Telegram update that is a reply to a bot message,
+// extracts email headers from the original message, and sends a reply email
+// with the given attachments, downloaded from the message by the caller.
+func HandleTelegramReply(
+	update TelegramUpdate,
+	smtpOutConfig *SMTPOutConfig,
+	store *MessageStore,
+	botUserID int64,
+	allowedHosts []string,
+	attachments []*ReplyAttachment,
+) string {
+	msg := update.Message
 	// Only handle replies to our own messages — silently ignore others
-	if msg.ReplyToMessage.From == nil || msg.ReplyToMessage.From.ID != botUserID {
+	if !isReplyToBot(msg, botUserID) {
 		return ""
 	}
 
@@ -252,7 +366,7 @@ func HandleTelegramReply(update TelegramUpdate, smtpOutConfig *SMTPOutConfig, bo
 		return "Reply-to-email is not configured. Set ST_SMTP_OUT_HOST to enable."
 	}
 
-	headers, err := ParseMessageHeaders(msg.ReplyToMessage.Text)
+	headers, err := originalEmailHeaders(store, msg)
 	if err != nil {
 		return "Could not parse the original email from the message."
 	}
@@ -261,9 +375,21 @@ func HandleTelegramReply(update TelegramUpdate, smtpOutConfig *SMTPOutConfig, bo
 	if err != nil {
 		return "Could not determine sender address from the original email."
 	}
-	if err := SendReplyEmail(smtpOutConfig, from, to, cc, subject, msg.Text); err != nil {
+	body := msg.Text
+	if body == "" {
+		body = msg.Caption
+	}
+	if body == "" && len(attachments) == 0 {
+		return "Nothing to send: the reply has no text and no attachments."
+	}
+	thread := NewReplyThread(headers.MessageID, headers.References)
+	messageID, err := SendReplyEmail(smtpOutConfig, from, to, cc, subject, body, thread, attachments)
+	if err != nil {
+		metricReplies.Inc("failed")
 		return fmt.Sprintf("Failed to send email: %s", err)
 	}
+	metricReplies.Inc("sent")
+	store.rememberReply(msg.Chat.ID, int64(msg.MessageID), &headers, messageID, thread.References)
 
 	allRecipients := slices.Concat(to, cc)
 	return fmt.Sprintf("Email sent from %s to %s", from, strings.Join(allRecipients, ", "))
@@ -283,7 +409,9 @@ func GetBotUserID(ctx context.Context, telegramConfig *TelegramConfig, client *h
 		if err != nil {
 			return 0, fmt.Errorf("failed to create getMe request: %w", err)
 		}
+		start := time.Now()
 		resp, err := client.Do(req)
+		observeTelegramRequest(req, start, resp, err)
 		if err != nil {
 			logger.Warningf("getMe attempt %d/%d failed: %s", attempt+1, maxRetries, SanitizeBotToken(err.Error(), telegramConfig.BotToken))
 			time.Sleep(backoff)
@@ -311,6 +439,7 @@ func GetBotUserID(ctx context.Context, telegramConfig *TelegramConfig, client *h
 		if !result.Ok || result.Result == nil {
 			return 0, errGetMeNotOk
 		}
+		health.botReady.Store(true)
 		return result.Result.ID, nil
 	}
 	return 0, fmt.Errorf("%w: %d attempts", errGetMeRetries, maxRetries)
@@ -329,7 +458,9 @@ func getUpdates(ctx context.Context, telegramConfig *TelegramConfig, client *htt
 	if err != nil {
 		return nil, err
 	}
+	start := time.Now()
 	resp, err := client.Do(req)
+	observeTelegramRequest(req, start, resp, err)
 	if err != nil {
 		return nil, err
 	}
@@ -353,27 +484,22 @@ func getUpdates(ctx context.Context, telegramConfig *TelegramConfig, client *htt
 	return result.Result, nil
 }
 
-func sendNotification(ctx context.Context, telegramConfig *TelegramConfig, client *http.Client, chatID int64, replyToMessageID int, text string) {
+// sendNotification replies to a message in the chat and returns the ID of the
+// sent message, or 0 if it couldn't be sent.
+func sendNotification(ctx context.Context, telegramConfig *TelegramConfig, client *http.Client, target ChatTarget, replyToMessageID int, text string) int64 {
 	apiURL := fmt.Sprintf(
 		"%sbot%s/sendMessage",
 		telegramConfig.APIPrefix,
 		telegramConfig.BotToken,
 	)
-	formData := url.Values{
-		"chat_id":             {fmt.Sprintf("%d", chatID)},
-		"text":                {text},
-		"reply_to_message_id": {fmt.Sprintf("%d", replyToMessageID)},
-	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, strings.NewReader(formData.Encode()))
-	if err != nil {
-		logger.Errorf("Failed to create notification request: %s", err)
-		return
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := client.Do(req)
+	formData := target.formValues()
+	formData.Set("text", text)
+	formData.Set("reply_to_message_id", fmt.Sprintf("%d", replyToMessageID))
+	resp, err := telegramSender.Do(ctx, client, target.ChatID,
+		newFormRequest(ctx, apiURL, "application/x-www-form-urlencoded", []byte(formData.Encode())))
 	if err != nil {
 		logger.Errorf("Failed to send notification: %s", SanitizeBotToken(err.Error(), telegramConfig.BotToken))
-		return
+		return 0
 	}
 	defer func() {
 		// Drain remaining body so the HTTP transport can reuse the connection.
@@ -385,13 +511,67 @@ func sendNotification(ctx context.Context, telegramConfig *TelegramConfig, clien
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
 		logger.Errorf("Notification failed: (%d) %s", resp.StatusCode, SanitizeBotToken(string(body), telegramConfig.BotToken))
+		return 0
+	}
+	result := &TelegramAPIMessageResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil || !result.Ok || result.Result == nil {
+		return 0
+	}
+	messageID, _ := result.Result.MessageID.Int64()
+	return messageID
+}
+
+// replyTarget returns the chat (and forum topic, if any) a message was posted in.
+func replyTarget(msg *TelegramUpdateMessage) ChatTarget {
+	target := ChatTarget{ChatID: msg.Chat.ID}
+	if msg.IsTopicMessage {
+		target.ThreadID = msg.MessageThreadID
+	}
+	return target
+}
+
+// updateHandler sends the replies found in Telegram updates, whether they
+// come from polling or from a webhook.
+type updateHandler struct {
+	telegramConfig *TelegramConfig
+	smtpOutConfig  *SMTPOutConfig
+	store          *MessageStore
+	client         *http.Client
+	botUserID      int64
+	allowedChatIDs []int64
+	allowedHosts   []string
+}
+
+func (h *updateHandler) processUpdate(ctx context.Context, update TelegramUpdate) {
+	if update.Message == nil {
+		return
+	}
+	// Replies are also accepted from any chat that mail can be routed to.
+	chatID := update.Message.Chat.ID
+	if !slices.Contains(h.allowedChatIDs, chatID) && !currentRules().isReplyChat(chatID) {
+		return // ignore updates from unauthorized chats
 	}
+	var attachments []*ReplyAttachment
+	var dropped []string
+	if isReplyToBot(update.Message, h.botUserID) && h.smtpOutConfig.IsConfigured() {
+		attachments, dropped = DownloadReplyAttachments(ctx, h.telegramConfig, h.client, update.Message, h.smtpOutConfig.AttachmentMaxSize)
+	}
+	notification := HandleTelegramReply(update, h.smtpOutConfig, h.store, h.botUserID, h.allowedHosts, attachments)
+	if notification == "" {
+		return
+	}
+	if len(dropped) > 0 {
+		notification += "\nNot attached: " + strings.Join(dropped, ", ")
+	}
+	confirmationID := sendNotification(ctx, h.telegramConfig, h.client, replyTarget(update.Message), update.Message.MessageID, notification)
+	h.store.linkReplyConfirmation(update.Message.Chat.ID, int64(update.Message.MessageID), confirmationID)
 }
 
 func PollTelegramUpdates(
 	ctx context.Context,
 	telegramConfig *TelegramConfig,
 	smtpOutConfig *SMTPOutConfig,
+	store *MessageStore,
 	allowedChatIDs []int64,
 	allowedHosts []string,
 ) {
@@ -403,6 +583,15 @@ func PollTelegramUpdates(
 		return
 	}
 	logger.Infof("Bot user ID: %d, starting Telegram polling", botUserID)
+	handler := &updateHandler{
+		telegramConfig: telegramConfig,
+		smtpOutConfig:  smtpOutConfig,
+		store:          store,
+		client:         client,
+		botUserID:      botUserID,
+		allowedChatIDs: allowedChatIDs,
+		allowedHosts:   allowedHosts,
+	}
 
 	// Flush stale updates on cold start
 	offset := 0
@@ -443,16 +632,7 @@ func PollTelegramUpdates(
 
 		for _, update := range updates {
 			offset = update.UpdateID + 1
-			if update.Message == nil {
-				continue
-			}
-			if !slices.Contains(allowedChatIDs, update.Message.Chat.ID) {
-				continue // ignore updates from unauthorized chats
-			}
-			notification := HandleTelegramReply(update, smtpOutConfig, botUserID, allowedHosts)
-			if notification != "" {
-				sendNotification(ctx, telegramConfig, client, update.Message.Chat.ID, update.Message.MessageID, notification)
-			}
+			handler.processUpdate(ctx, update)
 		}
 	}
 }
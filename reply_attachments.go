@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+var (
+	errGetFileNotOk       = errors.New("getFile returned not ok")
+	errAttachmentTooLarge = errors.New("file is too large")
+)
+
+// Media of a Telegram message, see https://core.telegram.org/bots/api#message
+
+type TelegramPhotoSize struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileSize     int64  `json:"file_size"`
+}
+
+type TelegramFile struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileName     string `json:"file_name"`
+	MimeType     string `json:"mime_type"`
+	FileSize     int64  `json:"file_size"`
+	FilePath     string `json:"file_path"` // only set by getFile
+}
+
+type TelegramGetFileResult struct {
+	Ok     bool          `json:"ok"`
+	Result *TelegramFile `json:"result"`
+}
+
+// ReplyAttachment is a file attached to a reply email.
+type ReplyAttachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// replyFiles lists the files of a message with the names to attach them as.
+func replyFiles(msg *TelegramUpdateMessage) []*TelegramFile {
+	var files []*TelegramFile
+	if len(msg.Photo) > 0 {
+		// Sizes are ordered from the smallest to the original one.
+		photo := msg.Photo[len(msg.Photo)-1]
+		files = append(files, &TelegramFile{
+			FileID:   photo.FileID,
+			FileName: "photo_" + photo.FileUniqueID + ".jpg",
+			MimeType: "image/jpeg",
+			FileSize: photo.FileSize,
+		})
+	}
+	add := func(f *TelegramFile, defaultName, defaultMimeType string) {
+		if f == nil {
+			return
+		}
+		file := *f
+		if file.FileName == "" {
+			file.FileName = defaultName
+		}
+		if file.MimeType == "" {
+			file.MimeType = defaultMimeType
+		}
+		files = append(files, &file)
+	}
+	add(msg.Document, "document", "application/octet-stream")
+	add(msg.Voice, "voice.ogg", "audio/ogg")
+	add(msg.Video, "video.mp4", "video/mp4")
+	return files
+}
+
+// DownloadReplyAttachments downloads the files of a message. Files larger than
+// maxSize, or which failed to download, are skipped and described in dropped.
+func DownloadReplyAttachments(
+	ctx context.Context,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+	msg *TelegramUpdateMessage,
+	maxSize int64,
+) (attachments []*ReplyAttachment, dropped []string) {
+	for _, file := range replyFiles(msg) {
+		if maxSize <= 0 {
+			dropped = append(dropped, file.FileName+" (attachments are disabled)")
+			continue
+		}
+		content, err := downloadTelegramFile(ctx, telegramConfig, client, file, maxSize)
+		if err != nil {
+			logger.Warningf("Dropping reply attachment %s: %s", file.FileName, SanitizeBotToken(err.Error(), telegramConfig.BotToken))
+			reason := "download failed"
+			if errors.Is(err, errAttachmentTooLarge) {
+				reason = "larger than " + units.HumanSize(float64(maxSize))
+			}
+			dropped = append(dropped, fmt.Sprintf("%s (%s)", file.FileName, reason))
+			continue
+		}
+		attachments = append(attachments, &ReplyAttachment{
+			Filename:    file.FileName,
+			ContentType: file.MimeType,
+			Content:     content,
+		})
+	}
+	return attachments, dropped
+}
+
+func downloadTelegramFile(
+	ctx context.Context,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+	file *TelegramFile,
+	maxSize int64,
+) ([]byte, error) {
+	if file.FileSize > maxSize {
+		return nil, errAttachmentTooLarge
+	}
+
+	// https://core.telegram.org/bots/api#getfile
+	apiURL := fmt.Sprintf("%sbot%s/getFile?%s", telegramConfig.APIPrefix, telegramConfig.BotToken,
+		url.Values{"file_id": {file.FileID}}.Encode())
+	body, err := telegramGet(ctx, client, apiURL, 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	result := &TelegramGetFileResult{}
+	if err := json.Unmarshal(body, result); err != nil {
+		return nil, fmt.Errorf("failed to parse getFile response: %w", err)
+	}
+	if !result.Ok || result.Result == nil || result.Result.FilePath == "" {
+		return nil, errGetFileNotOk
+	}
+	if result.Result.FileSize > maxSize {
+		return nil, errAttachmentTooLarge
+	}
+
+	var content []byte
+	if telegramConfig.LocalMode && filepath.IsAbs(result.Result.FilePath) {
+		// A local server gives the path of the file on its disk and doesn't
+		// serve it over HTTP.
+		content, err = readLocalServerFile(result.Result.FilePath, maxSize)
+	} else {
+		fileURL := fmt.Sprintf("%sfile/bot%s/%s", telegramConfig.APIPrefix, telegramConfig.BotToken, result.Result.FilePath)
+		content, err = telegramGet(ctx, client, fileURL, maxSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if file.FileName == "" {
+		file.FileName = path.Base(result.Result.FilePath)
+	}
+	return content, nil
+}
+
+// telegramGet fetches a Bot API URL, failing on bodies larger than maxSize.
+func telegramGet(ctx context.Context, client *http.Client, apiURL string, maxSize int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	observeTelegramRequest(req, start, resp, err)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			logger.Warningf("Failed to close response body: %v", closeErr)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: (%d)", errTelegramNon200, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, errAttachmentTooLarge
+	}
+	return body, nil
+}
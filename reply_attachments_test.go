@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTelegramFiles serves getFile and file downloads for the given paths.
+func fakeTelegramFiles(t *testing.T, files map[string]string) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/getFile") {
+			fileID := r.URL.Query().Get("file_id")
+			if _, ok := files[fileID]; !ok {
+				_, _ = w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: invalid file_id"}`))
+				return
+			}
+			_, _ = fmt.Fprintf(w, `{"ok":true,"result":{"file_id":%q,"file_size":%d,"file_path":"files/%s"}}`,
+				fileID, len(files[fileID]), fileID)
+			return
+		}
+		if fileID, ok := strings.CutPrefix(r.URL.Path, "/file/bot42:ZZZ/files/"); ok {
+			_, _ = w.Write([]byte(files[fileID]))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestDownloadReplyAttachments(t *testing.T) {
+	s := fakeTelegramFiles(t, map[string]string{
+		"photo-large": "jpeg data",
+		"doc":         "pdf data",
+		"voice":       strings.Repeat("x", 100),
+	})
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.APIPrefix = s.URL + "/"
+
+	msg := &TelegramUpdateMessage{
+		Photo: []TelegramPhotoSize{
+			{FileID: "photo-small", FileUniqueID: "s", FileSize: 3},
+			{FileID: "photo-large", FileUniqueID: "l", FileSize: 9},
+		},
+		Document: &TelegramFile{FileID: "doc", FileName: "report.pdf", MimeType: "application/pdf"},
+		Voice:    &TelegramFile{FileID: "voice"},
+		Video:    &TelegramFile{FileID: "missing"},
+	}
+	attachments, dropped := DownloadReplyAttachments(context.Background(), telegramConfig, s.Client(), msg, 50)
+
+	require.Len(t, attachments, 2)
+	require.Equal(t, &ReplyAttachment{Filename: "photo_l.jpg", ContentType: "image/jpeg", Content: []byte("jpeg data")}, attachments[0])
+	require.Equal(t, &ReplyAttachment{Filename: "report.pdf", ContentType: "application/pdf", Content: []byte("pdf data")}, attachments[1])
+	require.Equal(t, []string{"voice.ogg (larger than 50B)", "video.mp4 (download failed)"}, dropped)
+}
+
+func TestDownloadReplyAttachmentsLocalMode(t *testing.T) {
+	// A local server answers getFile with the path of the file on its disk.
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "report.pdf"), []byte("pdf data"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "voice.oga"), []byte(strings.Repeat("x", 100)), 0o600))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/getFile") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"ok":true,"result":{"file_id":"x","file_path":%q}}`,
+			filepath.Join(dir, r.URL.Query().Get("file_id")))
+	}))
+	defer s.Close()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.APIPrefix = s.URL + "/"
+	telegramConfig.LocalMode = true
+
+	msg := &TelegramUpdateMessage{
+		Document: &TelegramFile{FileID: "report.pdf", FileName: "report.pdf", MimeType: "application/pdf"},
+		Voice:    &TelegramFile{FileID: "voice.oga"},
+		Video:    &TelegramFile{FileID: "missing"},
+	}
+	attachments, dropped := DownloadReplyAttachments(context.Background(), telegramConfig, s.Client(), msg, 50)
+
+	require.Len(t, attachments, 1)
+	require.Equal(t, &ReplyAttachment{Filename: "report.pdf", ContentType: "application/pdf", Content: []byte("pdf data")}, attachments[0])
+	require.Equal(t, []string{"voice.ogg (larger than 50B)", "video.mp4 (download failed)"}, dropped)
+}
+
+func TestDownloadReplyAttachmentsDisabled(t *testing.T) {
+	msg := &TelegramUpdateMessage{Document: &TelegramFile{FileID: "doc", FileName: "report.pdf"}}
+	attachments, dropped := DownloadReplyAttachments(context.Background(), makeTelegramConfig(), http.DefaultClient, msg, 0)
+	require.Empty(t, attachments)
+	require.Equal(t, []string{"report.pdf (attachments are disabled)"}, dropped)
+}
+
+func TestHandleTelegramReplyWithAttachment(t *testing.T) {
+	received := make(chan testEmail, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	go runTestSMTPServer(t, ln, received)
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	config := &SMTPOutConfig{Host: host, Port: port}
+
+	update := makeBotReplyUpdate(999, "From: sender@test\nTo: me@test\nSubject: Hello\n\nOriginal body", "")
+	update.Message.Caption = "See the screenshot"
+	attachments := []*ReplyAttachment{{Filename: "photo_l.jpg", ContentType: "image/jpeg", Content: []byte("jpeg data")}}
+
+	notification := HandleTelegramReply(update, config, nil, 999, []string{"."}, attachments)
+	require.Contains(t, notification, "Email sent")
+
+	msg := <-received
+	require.Contains(t, msg.data, "See the screenshot")
+	require.Contains(t, msg.data, `Content-Disposition: attachment; filename="photo_l.jpg"`)
+	require.Contains(t, msg.data, "Content-Type: image/jpeg")
+	require.Contains(t, msg.data, "anBlZyBkYXRh") // base64 of "jpeg data"
+}
+
+func TestHandleTelegramReplyNothingToSend(t *testing.T) {
+	update := makeBotReplyUpdate(999, "From: sender@test\nTo: me@test\nSubject: Hello\n\nOriginal body", "")
+	notification := HandleTelegramReply(update, &SMTPOutConfig{Host: "localhost", Port: 25}, nil, 999, []string{"."}, nil)
+	require.Contains(t, notification, "Nothing to send")
+}
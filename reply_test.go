@@ -5,7 +5,9 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"net/smtp"
+	"net/url"
 	"strconv"
 	"strings"
 	"testing"
@@ -64,6 +66,7 @@ func TestParseChatIDs(t *testing.T) {
 		{name: "with spaces", input: " 123 , 456 ", want: []int64{123, 456}},
 		{name: "empty string", input: "", want: nil},
 		{name: "invalid returns error", input: "123,abc,456", wantErr: true},
+		{name: "forum topics", input: "-100123:4,-100123:5,456", want: []int64{-100123, 456}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -165,6 +168,14 @@ func TestComposeReplyAddresses(t *testing.T) {
 			wantCC:       []string{"other@example.com"},
 			wantSubject:  "Re: Hello",
 		},
+		{
+			name:        "From with display name",
+			headers:     ParsedHeaders{From: `"Doe, Jöhn" <john@example.com>`, To: "me@test", Subject: "Hello"},
+			wantFrom:    "me@test",
+			wantTo:      []string{"john@example.com"},
+			wantCC:      nil,
+			wantSubject: "Re: Hello",
+		},
 		{
 			name:         "no matching address returns error",
 			headers:      ParsedHeaders{From: "sender@example.com", To: "someone@example.com", Subject: "Hello"},
@@ -339,7 +350,7 @@ func TestSendReplyEmail(t *testing.T) {
 
 	config := &SMTPOutConfig{Host: host, Port: port}
 
-	err = SendReplyEmail(config, "me@test", []string{"sender@test"}, nil, "Re: Hello", "Thanks!")
+	_, err = SendReplyEmail(config, "me@test", []string{"sender@test"}, nil, "Re: Hello", "Thanks!", ReplyThread{}, nil)
 	require.NoError(t, err)
 
 	msg := <-received
@@ -349,6 +360,38 @@ func TestSendReplyEmail(t *testing.T) {
 	require.Contains(t, msg.data, "Thanks!")
 }
 
+func TestSendReplyEmailThreadingHeaders(t *testing.T) {
+	received := make(chan testEmail, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	go runTestSMTPServer(t, ln, received)
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	config := &SMTPOutConfig{Host: host, Port: port}
+
+	thread := NewReplyThread("<orig@example.com>", "<root@example.com>")
+	messageID, err := SendReplyEmail(config, "Me <me@mydomain.test>", []string{"sender@test"}, nil, "Re: Hello", "Thanks!", thread, nil)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(messageID, "@mydomain.test>"), messageID)
+
+	msg := <-received
+	require.Contains(t, msg.data, "Message-ID: "+messageID+"\n")
+	require.Contains(t, msg.data, "In-Reply-To: <orig@example.com>\n")
+	require.Contains(t, msg.data, "References: <root@example.com> <orig@example.com>\n")
+}
+
+func TestNewReplyThread(t *testing.T) {
+	require.Equal(t, ReplyThread{}, NewReplyThread("", ""))
+	require.Equal(t,
+		ReplyThread{InReplyTo: "<b@x>", References: "<b@x>"},
+		NewReplyThread("<b@x>", ""))
+	require.Equal(t,
+		ReplyThread{InReplyTo: "<c@x>", References: "<a@x> <b@x> <c@x>"},
+		NewReplyThread("<c@x>", "<a@x>\n <b@x>"))
+}
+
 func TestHandleTelegramReply_Success(t *testing.T) {
 	received := make(chan testEmail, 1)
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -364,7 +407,7 @@ func TestHandleTelegramReply_Success(t *testing.T) {
 	originalText := "From: sender@test\nTo: me@test\nSubject: Hello\n\nOriginal body"
 	update := makeBotReplyUpdate(999, originalText, "My reply")
 
-	notification := HandleTelegramReply(update, config, 999, []string{"."})
+	notification := HandleTelegramReply(update, config, nil, 999, []string{"."}, nil)
 	require.Contains(t, notification, "Email sent from me@test to sender@test")
 
 	msg := <-received
@@ -377,7 +420,7 @@ func TestHandleTelegramReply_NonBotMessage_Ignored(t *testing.T) {
 	update := makeBotReplyUpdate(888, "From: sender@test\nTo: me@test\nSubject: Hello\n\nBody", "Reply text")
 	config := &SMTPOutConfig{Host: "localhost", Port: 25}
 
-	notification := HandleTelegramReply(update, config, 999, []string{"."})
+	notification := HandleTelegramReply(update, config, nil, 999, []string{"."}, nil)
 	require.Empty(t, notification)
 }
 
@@ -385,7 +428,7 @@ func TestHandleTelegramReply_SMTPNotConfigured(t *testing.T) {
 	update := makeBotReplyUpdate(999, "From: sender@test\nTo: me@test\nSubject: Hello\n\nBody", "Reply text")
 	config := &SMTPOutConfig{Host: "", Port: 0}
 
-	notification := HandleTelegramReply(update, config, 999, []string{"."})
+	notification := HandleTelegramReply(update, config, nil, 999, []string{"."}, nil)
 	require.Contains(t, notification, "not configured")
 }
 
@@ -393,7 +436,7 @@ func TestHandleTelegramReply_ParseFailure(t *testing.T) {
 	update := makeBotReplyUpdate(999, "just some random text", "Reply text")
 	config := &SMTPOutConfig{Host: "localhost", Port: 25}
 
-	notification := HandleTelegramReply(update, config, 999, []string{"."})
+	notification := HandleTelegramReply(update, config, nil, 999, []string{"."}, nil)
 	require.Contains(t, notification, "Could not parse")
 }
 
@@ -401,7 +444,7 @@ func TestHandleTelegramReply_SMTPSendFailure(t *testing.T) {
 	update := makeBotReplyUpdate(999, "From: sender@test\nTo: me@test\nSubject: Hello\n\nBody", "Reply text")
 	config := &SMTPOutConfig{Host: "127.0.0.1", Port: 19999}
 
-	notification := HandleTelegramReply(update, config, 999, []string{"."})
+	notification := HandleTelegramReply(update, config, nil, 999, []string{"."}, nil)
 	require.Contains(t, notification, "Failed to send email")
 }
 
@@ -439,7 +482,7 @@ func TestEndToEndReplyFlow(t *testing.T) {
 	update := makeBotReplyUpdate(999, originalMessage, "This is my reply!")
 
 	// Step 4: Handle the reply
-	notification := HandleTelegramReply(update, smtpOutConfig, 999, []string{"."})
+	notification := HandleTelegramReply(update, smtpOutConfig, nil, 999, []string{"."}, nil)
 	require.Contains(t, notification, "Email sent")
 
 	// Step 5: Verify outbound email
@@ -500,3 +543,110 @@ func TestComposeReplyAddresses_RFC_QuotedComma(t *testing.T) {
 	require.Equal(t, []string{"sender@test"}, to)
 	require.Equal(t, []string{"other@example.com"}, cc)
 }
+
+func TestHandleTelegramReply_TopicServiceMessage_Ignored(t *testing.T) {
+	update := makeBotReplyUpdate(999, "From: sender@test\nTo: me@test\nSubject: Hello\n\nBody", "Reply text")
+	update.Message.IsTopicMessage = true
+	update.Message.MessageThreadID = update.Message.ReplyToMessage.MessageID
+	config := &SMTPOutConfig{Host: "localhost", Port: 25}
+
+	notification := HandleTelegramReply(update, config, nil, 999, []string{"."}, nil)
+	require.Empty(t, notification)
+}
+
+func TestReplyTarget(t *testing.T) {
+	msg := &TelegramUpdateMessage{Chat: TelegramChat{ID: -100123}, MessageThreadID: 7}
+	require.Equal(t, ChatTarget{ChatID: -100123}, replyTarget(msg))
+
+	msg.IsTopicMessage = true
+	require.Equal(t, ChatTarget{ChatID: -100123, ThreadID: 7}, replyTarget(msg))
+}
+
+func TestSendNotificationInTopic(t *testing.T) {
+	forms := make(chan url.Values, 1)
+	s := HTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			panic(err)
+		}
+		forms <- r.PostForm
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	telegramConfig := makeTelegramConfig()
+	sendNotification(context.Background(), telegramConfig, &http.Client{Transport: &http.Transport{}}, ChatTarget{ChatID: -100123, ThreadID: 7}, 50, "Email sent")
+
+	form := <-forms
+	require.Equal(t, "Email sent", form.Get("text"))
+	require.Equal(t, "-100123", form.Get("chat_id"))
+	require.Equal(t, "7", form.Get("message_thread_id"))
+	require.Equal(t, "50", form.Get("reply_to_message_id"))
+}
+
+func TestReplyToReplyContinuesThread(t *testing.T) {
+	store := tempMessageStore(t)
+	require.NoError(t, store.Put(42, 50, &StoredMessage{
+		MessageID:  "<orig@test>",
+		References: "<root@test>",
+		From:       "sender@test",
+		To:         "me@test",
+		Subject:    "Hello",
+	}))
+
+	received := make(chan testEmail, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	config := &SMTPOutConfig{Host: host, Port: port}
+
+	// Reply to the forwarded email.
+	go runTestSMTPServer(t, ln, received)
+	update := makeBotReplyUpdate(999, "", "First reply")
+	require.Contains(t, HandleTelegramReply(update, config, store, 999, []string{"."}, nil), "Email sent")
+	first := <-received
+	require.Contains(t, first.data, "In-Reply-To: <orig@test>\n")
+	require.Contains(t, first.data, "References: <root@test> <orig@test>\n")
+	firstID := headerValue(first.data, "Message-ID")
+	require.NotEmpty(t, firstID)
+
+	// The bot confirmed it with message 101, which the user replies to.
+	store.linkReplyConfirmation(42, int64(update.Message.MessageID), 101)
+	go runTestSMTPServer(t, ln, received)
+	update = makeBotReplyUpdate(999, "Email sent from me@test to sender@test", "Second reply")
+	update.Message.MessageID = 102
+	update.Message.ReplyToMessage.MessageID = 101
+	require.Contains(t, HandleTelegramReply(update, config, store, 999, []string{"."}, nil), "Email sent from me@test to sender@test")
+	second := <-received
+	require.Equal(t, []string{"sender@test"}, second.to)
+	require.Contains(t, second.data, "Subject: Re: Hello\n")
+	require.Contains(t, second.data, "In-Reply-To: "+firstID+"\n")
+	require.Equal(t, "<root@test> <orig@test> "+firstID, headerValue(second.data, "References"))
+}
+
+// headerValue returns an unfolded header of a received email.
+func headerValue(data, name string) string {
+	var value string
+	found := false
+	for line := range strings.SplitSeq(data, "\n") {
+		switch {
+		case found && strings.HasPrefix(line, " "):
+			value += line
+		case found:
+			return value
+		default:
+			value, found = strings.CutPrefix(line, name+": ")
+		}
+	}
+	return value
+}
+
+func TestSendNotificationReturnsMessageID(t *testing.T) {
+	s := HTTPServer(t, NewSuccessHandler())
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	id := sendNotification(context.Background(), makeTelegramConfig(), client, ChatTarget{ChatID: 42}, 7, "Email sent")
+	require.Equal(t, int64(123123), id)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+var (
+	errInvalidRoute = errors.New("invalid route")
+	errNoRoute      = errors.New("no route for recipient")
+)
+
+// Route maps envelope recipients to Telegram chats. A route matches either by
+// Recipient (an exact address or "*@domain") or by RecipientRegex, and by
+// AuthUser, the SMTP AUTH username, if set. A route with only AuthUser
+// matches any recipient of the user's emails.
+type Route struct {
+	Recipient      string         `yaml:"recipient"`
+	RecipientRegex string         `yaml:"recipient_regex"`
+	AuthUser       string         `yaml:"auth_user"`
+	ChatIDs        []string       `yaml:"chat_ids"`
+	regex          *regexp.Regexp // compiled RecipientRegex
+}
+
+// RoutingConfig is the compiled routing table loaded from the YAML config.
+type RoutingConfig struct {
+	Routes         []Route
+	DefaultChatIDs []string
+	RejectUnrouted bool
+}
+
+func compileRoutes(routes []Route) error {
+	for i := range routes {
+		route := &routes[i]
+		if route.Recipient != "" && route.RecipientRegex != "" {
+			return fmt.Errorf("route #%d: %w: only one of recipient or recipient_regex may be set", i+1, errInvalidRoute)
+		}
+		if route.Recipient == "" && route.RecipientRegex == "" && route.AuthUser == "" {
+			return fmt.Errorf("route #%d: %w: one of recipient, recipient_regex or auth_user must be set", i+1, errInvalidRoute)
+		}
+		if len(route.ChatIDs) == 0 {
+			return fmt.Errorf("route #%d: %w: chat_ids must not be empty", i+1, errInvalidRoute)
+		}
+		if err := validateChatIDs(route.ChatIDs); err != nil {
+			return fmt.Errorf("route #%d: %w", i+1, err)
+		}
+		if route.RecipientRegex != "" {
+			pattern := route.RecipientRegex
+			if !strings.HasPrefix(pattern, "(?i)") {
+				pattern = "(?i)" + pattern
+			}
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("route #%d: invalid recipient_regex '%s': %w", i+1, route.RecipientRegex, err)
+			}
+			route.regex = compiled
+		}
+	}
+	return nil
+}
+
+// validateChatIDs trims the chat targets in place and checks that they parse.
+func validateChatIDs(chatIDs []string) error {
+	for i, chatID := range chatIDs {
+		chatIDs[i] = strings.TrimSpace(chatID)
+		if _, err := ParseChatTarget(chatIDs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Route) matches(addr, authUser string) bool {
+	if r.AuthUser != "" && r.AuthUser != authUser {
+		return false
+	}
+	if r.regex != nil {
+		return r.regex.MatchString(addr)
+	}
+	if domain, ok := strings.CutPrefix(r.Recipient, "*@"); ok {
+		_, addrDomain, found := strings.Cut(addr, "@")
+		return found && strings.EqualFold(domain, addrDomain)
+	}
+	return r.Recipient == "" || strings.EqualFold(r.Recipient, addr)
+}
+
+// route returns the chat IDs of the first route matching the address and the
+// authenticated user, "" if the client didn't authenticate.
+func (c *RoutingConfig) route(addr, authUser string) ([]string, bool) {
+	for i := range c.Routes {
+		if c.Routes[i].matches(addr, authUser) {
+			return c.Routes[i].ChatIDs, true
+		}
+	}
+	return nil, false
+}
+
+// ResolveChatIDs returns the deduplicated list of chats an email addressed to
+// the given recipients by authUser should be delivered to. Recipients matching
+// no route go to the default chats, which fall back to the --telegram-chat-ids
+// list.
+func (c *RoutingConfig) ResolveChatIDs(rcptTo []mail.Address, authUser, fallbackChatIDs string) []string {
+	defaultChatIDs := c.DefaultChatIDs
+	if len(defaultChatIDs) == 0 {
+		defaultChatIDs = strings.Split(fallbackChatIDs, ",")
+	}
+
+	var chatIDs []string
+	add := func(ids []string) {
+		for _, id := range ids {
+			id = strings.TrimSpace(id)
+			if id != "" && !slices.Contains(chatIDs, id) {
+				chatIDs = append(chatIDs, id)
+			}
+		}
+	}
+	for i := range rcptTo {
+		if ids, ok := c.route(envelopeAddress(&rcptTo[i]), authUser); ok {
+			add(ids)
+		} else {
+			add(defaultChatIDs)
+		}
+	}
+	if len(chatIDs) == 0 {
+		add(defaultChatIDs)
+	}
+	return chatIDs
+}
+
+// AllChatIDs returns every chat ID mentioned in the routing table.
+func (c *RoutingConfig) AllChatIDs() []string {
+	var chatIDs []string
+	for _, id := range c.DefaultChatIDs {
+		if !slices.Contains(chatIDs, id) {
+			chatIDs = append(chatIDs, id)
+		}
+	}
+	for i := range c.Routes {
+		for _, id := range c.Routes[i].ChatIDs {
+			if !slices.Contains(chatIDs, id) {
+				chatIDs = append(chatIDs, id)
+			}
+		}
+	}
+	return chatIDs
+}
+
+func envelopeAddress(a *mail.Address) string {
+	if a.Host == "" {
+		return a.User
+	}
+	return a.User + "@" + a.Host
+}
+
+// checkRecipient refuses recipients matching no route when reject_unrouted
+// is enabled.
+func (c *RoutingConfig) checkRecipient(addr, authUser string) error {
+	if !c.RejectUnrouted {
+		return nil
+	}
+	if _, ok := c.route(addr, authUser); !ok {
+		return errNoRoute
+	}
+	return nil
+}
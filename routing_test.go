@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	tmpfile, err := os.CreateTemp("", "routing_test*.yaml")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.Remove(tmpfile.Name()) })
+	_, err = tmpfile.WriteString(content)
+	require.NoError(t, err)
+	require.NoError(t, tmpfile.Close())
+	return tmpfile.Name()
+}
+
+func rcpts(addrs ...string) []mail.Address {
+	result := make([]mail.Address, 0, len(addrs))
+	for _, addr := range addrs {
+		user, host, _ := strings.Cut(addr, "@")
+		result = append(result, mail.Address{User: user, Host: host})
+	}
+	return result
+}
+
+const testRoutesConfig = `routes:
+  - recipient: ops@example.com
+    chat_ids: [-1001]
+  - recipient: '*@billing.example.com'
+    chat_ids: ['-1002', '7']
+  - recipient_regex: '^alerts\+.*@example\.com$'
+    chat_ids: ['-1003']
+`
+
+func TestLoadRoutes(t *testing.T) {
+	_, err := loadConfig(writeTestConfig(t, testRoutesConfig+"default_chat_ids: [99]\nreject_unrouted: true\n"))
+	require.NoError(t, err)
+	require.Len(t, currentRules().Routing.Routes, 3)
+	require.Equal(t, []string{"-1001"}, currentRules().Routing.Routes[0].ChatIDs)
+	require.Equal(t, []string{"99"}, currentRules().Routing.DefaultChatIDs)
+	require.True(t, currentRules().Routing.RejectUnrouted)
+	require.Equal(t, []string{"99", "-1001", "-1002", "7", "-1003"}, currentRules().Routing.AllChatIDs())
+}
+
+func TestLoadRoutesInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "no matcher",
+			content: "routes:\n  - chat_ids: [1]\n",
+			wantErr: "one of recipient, recipient_regex or auth_user",
+		},
+		{
+			name:    "both matchers",
+			content: "routes:\n  - recipient: a@b\n    recipient_regex: a\n    chat_ids: [1]\n",
+			wantErr: "only one of recipient or recipient_regex",
+		},
+		{
+			name:    "no chats",
+			content: "routes:\n  - recipient: a@b\n",
+			wantErr: "chat_ids must not be empty",
+		},
+		{
+			name:    "bad chat id",
+			content: "routes:\n  - recipient: a@b\n    chat_ids: [abc]\n",
+			wantErr: "invalid chat ID",
+		},
+		{
+			name:    "bad regex",
+			content: "routes:\n  - recipient_regex: '[invalid('\n    chat_ids: [1]\n",
+			wantErr: "invalid recipient_regex",
+		},
+		{
+			name:    "bad default chat id",
+			content: "default_chat_ids: [abc]\n",
+			wantErr: "default_chat_ids",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, tt.content))
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestResolveChatIDs(t *testing.T) {
+	_, err := loadConfig(writeTestConfig(t, testRoutesConfig))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		rcpts []mail.Address
+		want  []string
+	}{
+		{name: "exact", rcpts: rcpts("ops@example.com"), want: []string{"-1001"}},
+		{name: "exact case insensitive", rcpts: rcpts("OPS@Example.com"), want: []string{"-1001"}},
+		{name: "domain wildcard", rcpts: rcpts("invoices@billing.example.com"), want: []string{"-1002", "7"}},
+		{name: "regex", rcpts: rcpts("alerts+db@example.com"), want: []string{"-1003"}},
+		{name: "unrouted falls back", rcpts: rcpts("nobody@example.com"), want: []string{"42", "142"}},
+		{
+			name:  "multiple recipients are merged and deduplicated",
+			rcpts: rcpts("ops@example.com", "a@billing.example.com", "b@billing.example.com", "nobody@example.com"),
+			want:  []string{"-1001", "-1002", "7", "42", "142"},
+		},
+		{name: "no recipients", rcpts: nil, want: []string{"42", "142"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, currentRules().Routing.ResolveChatIDs(tt.rcpts, "", "42,142"))
+		})
+	}
+}
+
+func TestResolveChatIDsDefaultChat(t *testing.T) {
+	_, err := loadConfig(writeTestConfig(t, testRoutesConfig+"default_chat_ids: [99]\n"))
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"99"}, currentRules().Routing.ResolveChatIDs(rcpts("nobody@example.com"), "", "42,142"))
+}
+
+func TestResolveChatIDsAuthUser(t *testing.T) {
+	_, err := loadConfig(writeTestConfig(t, `routes:
+  - auth_user: monitoring
+    recipient: ops@example.com
+    chat_ids: [-1005]
+  - auth_user: backup
+    chat_ids: [-1004]
+`+strings.TrimPrefix(testRoutesConfig, "routes:\n")))
+	require.NoError(t, err)
+
+	routing := &currentRules().Routing
+	require.Equal(t, []string{"-1004"}, routing.ResolveChatIDs(rcpts("ops@example.com"), "backup", "42"))
+	require.Equal(t, []string{"-1005"}, routing.ResolveChatIDs(rcpts("ops@example.com"), "monitoring", "42"))
+	require.Equal(t, []string{"42"}, routing.ResolveChatIDs(rcpts("nobody@example.com"), "monitoring", "42"))
+	require.Equal(t, []string{"-1001"}, routing.ResolveChatIDs(rcpts("ops@example.com"), "", "42"))
+}
+
+func TestRoutedEmailDelivery(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = writeTestConfig(t, testRoutesConfig)
+	telegramConfig := makeTelegramConfig()
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	err := smtp.SendMail(smtpConfig.Listen, nil, "from@test", []string{"x@billing.example.com"}, []byte(`hi`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"-1002", "7"}, h.RequestChatIDs)
+}
+
+func TestUnroutedRecipientRejectedAtRcpt(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = writeTestConfig(t, testRoutesConfig+"reject_unrouted: true\n")
+	telegramConfig := makeTelegramConfig()
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	c, err := smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	require.NoError(t, c.Mail("from@test"))
+
+	err = c.Rcpt("nobody@example.com")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "550")
+
+	require.NoError(t, c.Rcpt("ops@example.com"))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, c.Quit())
+
+	require.Equal(t, []string{"-1001"}, h.RequestChatIDs)
+}
+func TestRecipientCheckedWhileSaveWorkersBusy(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = writeTestConfig(t, testRoutesConfig+"reject_unrouted: true\n")
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	// Every save worker is held at Telegram
+	started, release := make(chan struct{}, 3), make(chan struct{})
+	var releaseOnce sync.Once
+	var mu sync.Mutex
+	h := NewSuccessHandler()
+	s := HTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	defer func() { _ = s.Shutdown(context.Background()) }()
+	defer releaseOnce.Do(func() { close(release) })
+
+	errs := make(chan error, 3)
+	for range 3 {
+		go func() {
+			errs <- smtp.SendMail(smtpConfig.Listen, nil, "from@test", []string{"ops@example.com"}, []byte("hi"))
+		}()
+		<-started
+	}
+
+	c, err := smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	require.NoError(t, c.Mail("from@test"))
+	start := time.Now()
+	require.NoError(t, c.Rcpt("ops@example.com"))
+	err = c.Rcpt("nobody@example.com")
+	require.ErrorContains(t, err, "550")
+	require.ErrorContains(t, err, "5.1.1 Error: "+errNoRoute.Error())
+	require.Less(t, time.Since(start), time.Second)
+
+	releaseOnce.Do(func() { close(release) })
+	for range 3 {
+		require.NoError(t, <-errs)
+	}
+}
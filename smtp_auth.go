@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// envelopeAuthUser is the envelope value holding the authenticated username.
+const envelopeAuthUser = "auth_user"
+
+var (
+	errInvalidSMTPUser       = errors.New("invalid smtp_auth user")
+	errInvalidPasswordHash   = errors.New("unsupported password hash, use bcrypt or argon2")
+	errSMTPAuthNeedsUsers    = errors.New("smtp_auth.required needs users")
+	errSMTPAuthRequired      = errors.New("authentication required")
+	errSMTPAuthFailed        = errors.New("authentication failed")
+	errSMTPAuthCancelled     = errors.New("authentication cancelled")
+	errSMTPAuthDecoding      = errors.New("cannot decode the response")
+	errSMTPAuthNeedsTLS      = errors.New("must issue a STARTTLS command first")
+	errSMTPAuthInTransaction = errors.New("AUTH not allowed in a mail transaction")
+)
+
+// SMTPAuthConfig is the smtp_auth section of the config file.
+type SMTPAuthConfig struct {
+	Required bool       `yaml:"required"`
+	Users    []SMTPUser `yaml:"users"`
+}
+
+type SMTPUser struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"` // bcrypt or argon2 in the PHC format
+}
+
+// SMTPAuth checks the credentials of SMTP AUTH.
+type SMTPAuth struct {
+	required bool
+	users    map[string]passwordHash
+}
+
+// NewSMTPAuth compiles the smtp_auth section, returning nil if it is empty.
+func NewSMTPAuth(config *SMTPAuthConfig) (*SMTPAuth, error) {
+	if len(config.Users) == 0 {
+		if config.Required {
+			return nil, errSMTPAuthNeedsUsers
+		}
+		return nil, nil
+	}
+	auth := &SMTPAuth{required: config.Required, users: make(map[string]passwordHash, len(config.Users))}
+	for i, user := range config.Users {
+		if user.Username == "" {
+			return nil, fmt.Errorf("smtp_auth.users #%d: %w: username must not be empty", i+1, errInvalidSMTPUser)
+		}
+		if _, ok := auth.users[user.Username]; ok {
+			return nil, fmt.Errorf("smtp_auth.users #%d: %w: duplicate username %q", i+1, errInvalidSMTPUser, user.Username)
+		}
+		hash, err := parsePasswordHash(user.PasswordHash)
+		if err != nil {
+			return nil, fmt.Errorf("smtp_auth.users #%d (%s): %w", i+1, user.Username, err)
+		}
+		auth.users[user.Username] = hash
+	}
+	return auth, nil
+}
+
+// Authenticate reports whether the password is the user's.
+func (a *SMTPAuth) Authenticate(username, password string) bool {
+	hash, ok := a.users[username]
+	return ok && hash.verify(password)
+}
+
+// authUser returns the user the email was submitted by, "" if the client
+// didn't authenticate.
+func authUser(envelope *mail.Envelope) string {
+	user, _ := envelope.Values[envelopeAuthUser].(string)
+	return user
+}
+
+type passwordHash interface {
+	verify(password string) bool
+}
+
+func parsePasswordHash(hash string) (passwordHash, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidPasswordHash, err)
+		}
+		return bcryptHash(hash), nil
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		return parseArgon2Hash(hash)
+	}
+	return nil, errInvalidPasswordHash
+}
+
+type bcryptHash []byte
+
+func (h bcryptHash) verify(password string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(password)) == nil
+}
+
+// argon2Hash is an argon2 hash in the PHC string format, as written by the
+// argon2 CLI: $argon2id$v=19$m=65536,t=3,p=4$salt$key.
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("%w: malformed argon2 hash", errInvalidPasswordHash)
+	}
+	h := &argon2Hash{variant: parts[1]}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("%w: unsupported argon2 version %q", errInvalidPasswordHash, parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("%w: malformed argon2 parameters %q", errInvalidPasswordHash, parts[3])
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("%w: malformed argon2 salt", errInvalidPasswordHash)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, fmt.Errorf("%w: malformed argon2 key", errInvalidPasswordHash)
+	}
+	return h, nil
+}
+
+func (h *argon2Hash) verify(password string) bool {
+	var key []byte
+	if h.variant == "argon2id" {
+		key = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// auth runs the AUTH PLAIN or LOGIN exchange. It returns false when the
+// connection can't go on.
+func (s *smtpSession) auth(args string) bool {
+	auth := currentRules().Auth
+	switch {
+	case auth == nil:
+		s.unrecognized()
+		return true
+	case s.authUser != "":
+		s.reply("503 5.5.1 Error: already authenticated")
+		return true
+	case s.inTransaction:
+		s.reply(fmt.Sprintf("503 5.5.1 Error: %s", errSMTPAuthInTransaction))
+		return true
+	case s.server.tlsConfig != nil && !s.tls:
+		s.reply(fmt.Sprintf("538 5.7.11 Error: %s", errSMTPAuthNeedsTLS))
+		return true
+	}
+
+	mechanism, initial, _ := strings.Cut(strings.TrimSpace(args), " ")
+	var username, password string
+	var err error
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		var response string
+		if response, err = s.authResponse(initial, ""); err == nil {
+			username, password, err = parseAuthPlain(response)
+		}
+	case "LOGIN":
+		if username, err = s.authResponse(initial, "Username:"); err == nil {
+			password, err = s.authResponse("", "Password:")
+		}
+	default:
+		s.reply("504 5.5.4 Error: unrecognized authentication mechanism")
+		return true
+	}
+
+	switch {
+	case errors.Is(err, errSMTPAuthCancelled):
+		s.reply(fmt.Sprintf("501 5.0.0 Error: %s", err))
+	case errors.Is(err, errSMTPAuthDecoding):
+		s.reply(fmt.Sprintf("501 5.5.2 Error: %s", err))
+	case err != nil:
+		logger.Warningf("[%s] Failed to read the AUTH response: %s", s.remoteIP, err)
+		return false
+	case !auth.Authenticate(username, password):
+		logger.Warningf("[%s] SMTP authentication failed for %q", s.remoteIP, username)
+		s.errors++
+		s.reply(fmt.Sprintf("535 5.7.8 Error: %s", errSMTPAuthFailed))
+	default:
+		logger.Infof("[%s] SMTP client authenticated as %q", s.remoteIP, username)
+		s.authUser = username
+		s.reset()
+		s.reply("235 2.7.0 Authentication successful")
+	}
+	return true
+}
+
+// authResponse returns the decoded initial response, or else asks the client
+// for it with the challenge.
+func (s *smtpSession) authResponse(initial, challenge string) (string, error) {
+	response := initial
+	if response == "" {
+		s.reply("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+		var err error
+		if response, err = s.readCommand(); err != nil {
+			return "", err
+		}
+	}
+	if response == "*" {
+		return "", errSMTPAuthCancelled
+	}
+	if response == "=" {
+		return "", nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", errSMTPAuthDecoding
+	}
+	return string(decoded), nil
+}
+
+// parseAuthPlain splits the PLAIN response "authzid\x00authcid\x00password".
+// Acting as another user is not supported.
+func parseAuthPlain(response string) (username, password string, err error) {
+	parts := strings.Split(response, "\x00")
+	if len(parts) != 3 || parts[0] != "" && parts[0] != parts[1] {
+		return "", "", errSMTPAuthDecoding
+	}
+	return parts[1], parts[2], nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/smtp"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testBcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func testArgon2Hash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestSMTPAuthPasswordHashes(t *testing.T) {
+	auth, err := NewSMTPAuth(&SMTPAuthConfig{Users: []SMTPUser{
+		{Username: "bcrypt", PasswordHash: testBcryptHash(t, "secret")},
+		{Username: "argon2", PasswordHash: testArgon2Hash("secret")},
+	}})
+	require.NoError(t, err)
+	require.True(t, auth.Authenticate("bcrypt", "secret"))
+	require.False(t, auth.Authenticate("bcrypt", "wrong"))
+	require.True(t, auth.Authenticate("argon2", "secret"))
+	require.False(t, auth.Authenticate("argon2", "wrong"))
+	require.False(t, auth.Authenticate("nobody", "secret"))
+
+	auth, err = NewSMTPAuth(&SMTPAuthConfig{})
+	require.NoError(t, err)
+	require.Nil(t, auth)
+}
+
+func TestSMTPAuthConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  SMTPAuthConfig
+		wantErr error
+	}{
+		{name: "required without users", config: SMTPAuthConfig{Required: true}, wantErr: errSMTPAuthNeedsUsers},
+		{name: "plain password", config: SMTPAuthConfig{Users: []SMTPUser{{Username: "a", PasswordHash: "secret"}}}, wantErr: errInvalidPasswordHash},
+		{name: "bad argon2", config: SMTPAuthConfig{Users: []SMTPUser{{Username: "a", PasswordHash: "$argon2id$v=19$m=64$x$y"}}}, wantErr: errInvalidPasswordHash},
+		{name: "no username", config: SMTPAuthConfig{Users: []SMTPUser{{PasswordHash: testArgon2Hash("a")}}}, wantErr: errInvalidSMTPUser},
+		{
+			name: "duplicate username",
+			config: SMTPAuthConfig{Users: []SMTPUser{
+				{Username: "a", PasswordHash: testArgon2Hash("a")},
+				{Username: "a", PasswordHash: testArgon2Hash("b")},
+			}},
+			wantErr: errInvalidSMTPUser,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSMTPAuth(&tt.config)
+			require.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func testAuthConfig(t *testing.T) string {
+	t.Helper()
+	return writeTestConfig(t, fmt.Sprintf(`smtp_auth:
+  required: true
+  users:
+    - username: monitoring
+      password_hash: '%s'
+routes:
+  - auth_user: monitoring
+    chat_ids: [-1004]
+reject_unrouted: true
+`, testArgon2Hash("secret")))
+}
+
+// loginAuth is the client side of AUTH LOGIN, which net/smtp lacks.
+type loginAuth struct{ username, password string }
+
+func (a *loginAuth) Start(*smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	switch {
+	case !more:
+		return nil, nil
+	case string(fromServer) == "Username:":
+		return []byte(a.username), nil
+	default:
+		return []byte(a.password), nil
+	}
+}
+
+func TestSMTPAuthRequired(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = testAuthConfig(t)
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+	defer activeRules.Store(nil)
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	c, err := smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	ok, mechanisms := c.Extension("AUTH")
+	require.True(t, ok)
+	require.Equal(t, "PLAIN LOGIN", mechanisms)
+	err = c.Mail("from@test")
+	var smtpErr *textproto.Error
+	require.ErrorAs(t, err, &smtpErr)
+	require.Equal(t, 530, smtpErr.Code)
+	require.Equal(t, "5.7.0 Error: "+errSMTPAuthRequired.Error(), smtpErr.Msg)
+
+	// net/smtp quits after a failed AUTH.
+	err = c.Auth(smtp.PlainAuth("", "monitoring", "wrong", testSMTPListenHost))
+	require.ErrorAs(t, err, &smtpErr)
+	require.Equal(t, 535, smtpErr.Code)
+
+	c, err = smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	require.NoError(t, c.Auth(smtp.PlainAuth("", "monitoring", "secret", testSMTPListenHost)))
+	require.NoError(t, sendTestMail(t, c))
+	require.Equal(t, []string{"-1004"}, h.RequestChatIDs)
+
+	c, err = smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	require.NoError(t, c.Auth(&loginAuth{"monitoring", "secret"}))
+	require.ErrorContains(t, c.Auth(&loginAuth{"monitoring", "secret"}), "already authenticated")
+}
+
+func TestSMTPAuthNeedsTLS(t *testing.T) {
+	smtpConfig := makeTLSSMTPConfig(t, SMTPTLSModeStartTLS)
+	smtpConfig.ConfigFile = testAuthConfig(t)
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+	defer activeRules.Store(nil)
+
+	c, err := smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	ok, _ := c.Extension("AUTH")
+	require.False(t, ok)
+	id, err := c.Text.Cmd("AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00monitoring\x00secret")))
+	require.NoError(t, err)
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(235)
+	c.Text.EndResponse(id)
+	require.ErrorContains(t, err, "538")
+
+	require.NoError(t, c.StartTLS(testClientTLSConfig))
+	ok, _ = c.Extension("AUTH")
+	require.True(t, ok)
+	require.NoError(t, c.Auth(smtp.PlainAuth("", "monitoring", "secret", testSMTPListenHost)))
+}
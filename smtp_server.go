@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/rfc5321"
+	"github.com/phires/go-guerrilla/response"
+)
+
+const (
+	smtpCommandTimeout          = 30 * time.Second
+	smtpDataTimeout             = 10 * time.Minute
+	smtpMaxClients              = 100
+	smtpMaxUnrecognizedCommands = 5
+	smtpLineMaxLength           = 1024
+	smtpDefaultMaxSize          = 10 << 20
+	smtpDataChunkSize           = 32 << 10
+)
+
+var (
+	errSMTPShutdown   = errors.New("smtp server is shutting down")
+	errSMTPLineLength = errors.New("line too long")
+)
+
+// SMTPServer receives emails on the SMTP listeners and hands them to the
+// guerrilla backend which forwards them to Telegram. go-guerrilla's own
+// server has no way to add SMTP commands or to refuse a command before RCPT,
+// so the session is ours and the backend only saves mail.
+type SMTPServer struct {
+	config      *SMTPConfig
+	hostname    string
+	maxSize     int64
+	hosts       allowedHosts
+	backend     backends.Backend
+	budget      *MemoryBudget // nil without a memory budget
+	tlsConfig   *tls.Config   // nil without TLS
+	certificate atomic.Pointer[tls.Certificate]
+	clients     chan struct{}
+	clientID    atomic.Uint64
+	wg          sync.WaitGroup
+
+	mu           sync.Mutex
+	listeners    []net.Listener
+	sessions     map[*smtpSession]struct{}
+	shuttingDown bool
+}
+
+func NewSMTPServer(smtpConfig *SMTPConfig, backend backends.Backend) (*SMTPServer, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	srv := &SMTPServer{
+		config:   smtpConfig,
+		hostname: hostname,
+		maxSize:  smtpConfig.MaxEnvelopeSize,
+		hosts:    newAllowedHosts(getAllowedHosts(smtpConfig)),
+		backend:  backend,
+		clients:  make(chan struct{}, smtpMaxClients),
+		sessions: make(map[*smtpSession]struct{}),
+	}
+	if srv.maxSize <= 0 {
+		srv.maxSize = smtpDefaultMaxSize
+	}
+	if smtpConfig.MemoryBudget > 0 {
+		srv.budget = NewMemoryBudget(smtpConfig.MemoryBudget)
+	}
+	if smtpConfig.TLS.Enabled() {
+		cert, err := tls.LoadX509KeyPair(smtpConfig.TLS.CertFile, smtpConfig.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load smtp tls certificate: %w", err)
+		}
+		srv.setCertificate(&cert)
+		srv.tlsConfig = smtpConfig.TLS.serverTLSConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return srv.certificate.Load(), nil
+		})
+	}
+	return srv, nil
+}
+
+// setCertificate replaces the certificate served to new TLS clients.
+func (srv *SMTPServer) setCertificate(cert *tls.Certificate) {
+	srv.certificate.Store(cert)
+}
+
+// Listen opens the listener at addr, with TLS from the first byte if
+// implicitTLS is set, and serves it until Shutdown.
+func (srv *SMTPServer) Listen(addr string, implicitTLS bool) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %w", addr, err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shuttingDown {
+		_ = listener.Close()
+		return errSMTPShutdown
+	}
+	srv.listeners = append(srv.listeners, listener)
+	srv.wg.Add(1)
+	go srv.serve(listener, implicitTLS)
+	logger.Infof("Listening on TCP %s", addr)
+	return nil
+}
+
+func (srv *SMTPServer) serve(listener net.Listener, implicitTLS bool) {
+	defer srv.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Warningf("Failed to accept an SMTP client: %s", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		select {
+		case srv.clients <- struct{}{}:
+		default:
+			logger.Warningf("Refusing SMTP client %s: too many clients", conn.RemoteAddr())
+			_, _ = io.WriteString(conn, "421 4.7.0 Too many connections, try again later\r\n")
+			_ = conn.Close()
+			continue
+		}
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			defer func() { <-srv.clients }()
+			srv.handle(conn, implicitTLS)
+		}()
+	}
+}
+
+// Shutdown stops accepting clients, lets the ones in a transaction finish
+// it and then shuts the backend down.
+func (srv *SMTPServer) Shutdown() {
+	srv.mu.Lock()
+	srv.shuttingDown = true
+	for _, listener := range srv.listeners {
+		_ = listener.Close()
+	}
+	// Wake up the sessions waiting for a command, the others notice the
+	// shutdown when they are done with the current one.
+	for session := range srv.sessions {
+		if session.idle {
+			_ = session.conn.SetReadDeadline(time.Now())
+		}
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+	if err := srv.backend.Shutdown(); err != nil {
+		logger.Warningf("Backend failed to shut down: %s", err)
+	}
+}
+
+func (srv *SMTPServer) handle(conn net.Conn, implicitTLS bool) {
+	s := &smtpSession{
+		server:   srv,
+		conn:     conn,
+		id:       srv.clientID.Add(1),
+		remoteIP: remoteIP(conn),
+		reader:   bufio.NewReaderSize(conn, smtpLineMaxLength),
+		writer:   bufio.NewWriter(conn),
+	}
+	srv.mu.Lock()
+	srv.sessions[s] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.sessions, s)
+		srv.mu.Unlock()
+		_ = s.conn.Close()
+	}()
+
+	logger.Debugf("Handle SMTP client [%s], id: %d", s.remoteIP, s.id)
+	if implicitTLS {
+		if err := s.startTLS(); err != nil {
+			logger.Warningf("[%s] Failed TLS handshake: %s", s.remoteIP, err)
+			return
+		}
+	}
+	s.reset()
+	s.serve()
+}
+
+// allowsHost reports whether mail for the recipient domain host, or the
+// address literal ip, is accepted.
+func (srv *SMTPServer) allowsHost(host string, ip net.IP) bool {
+	if ip != nil {
+		host = "[" + ip.String() + "]"
+	}
+	return srv.hosts.allows(host)
+}
+
+// allowedHosts is the list of recipient domains, where "." alone allows any
+// domain and "*" is a wildcard.
+type allowedHosts struct {
+	any       bool
+	table     map[string]bool
+	wildcards []string
+}
+
+func newAllowedHosts(hosts []string) allowedHosts {
+	h := allowedHosts{table: make(map[string]bool, len(hosts))}
+	if len(hosts) == 1 && hosts[0] == "." {
+		h.any = true
+	}
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		switch {
+		case strings.Contains(host, "*"):
+			h.wildcards = append(h.wildcards, host)
+		case len(host) > 2 && host[0] == '[' && host[len(host)-1] == ']':
+			if ip := net.ParseIP(host[1 : len(host)-1]); ip != nil {
+				h.table["["+ip.String()+"]"] = true
+			}
+		default:
+			h.table[host] = true
+		}
+	}
+	return h
+}
+
+func (h *allowedHosts) allows(host string) bool {
+	host = strings.ToLower(host)
+	if h.any || h.table[host] {
+		return true
+	}
+	for _, w := range h.wildcards {
+		if matched, err := filepath.Match(w, host); matched && err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClient returns the greeting refusing a client outside the allowed
+// networks, or "" to serve it.
+func (srv *SMTPServer) checkClient(remoteIP string) string {
+	if access := currentRules().ClientAccess; access != nil && !access.Allowed(remoteIP) {
+		logger.Warningf("Refusing SMTP client %s: %s", remoteIP, errClientDenied)
+		metricEmailsRejected.Inc("client_access")
+		return fmt.Sprintf("554 5.7.1 %s Error: %s", srv.hostname, errClientDenied)
+	}
+	return ""
+}
+
+// checkSender returns the reply refusing a new email of the client over its
+// per-minute rate limit, or "" to accept it.
+func (srv *SMTPServer) checkSender(remoteIP string) string {
+	access := currentRules().ClientAccess
+	if access == nil || access.limiter == nil {
+		return ""
+	}
+	rejected, err := access.limiter.TakeMessage(remoteIP, time.Now())
+	if err != nil {
+		logger.Warningf("Deferring email from %s: %s (%d rejected so far)", remoteIP, err, rejected)
+		metricEmailsRejected.Inc("rate_limit")
+		return fmt.Sprintf("450 4.7.1 Error: %s", err)
+	}
+	return ""
+}
+
+// checkRecipient returns the reply refusing the last recipient of the
+// envelope, or "" to accept it. The checks only look at the config, so they
+// are done in the session rather than queued to the backend.
+func (srv *SMTPServer) checkRecipient(envelope *mail.Envelope) string {
+	rcpt := envelopeAddress(&envelope.RcptTo[len(envelope.RcptTo)-1])
+	if err := currentRules().Routing.checkRecipient(rcpt, authUser(envelope)); err != nil {
+		logger.Infof("Rejecting recipient %s: %s", rcpt, err)
+		return fmt.Sprintf("550 5.1.1 Error: %s", err)
+	}
+	return ""
+}
+
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return conn.RemoteAddr().Network()
+}
+
+// smtpSession is the SMTP conversation with a client.
+type smtpSession struct {
+	server   *SMTPServer
+	conn     net.Conn
+	id       uint64
+	remoteIP string
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	parser   rfc5321.Parser
+	idle     bool // waiting for a command, guarded by server.mu
+
+	helo     string
+	esmtp    bool
+	tls      bool
+	authUser string // SMTP AUTH username, "" until the client authenticates
+
+	envelope      *mail.Envelope
+	inTransaction bool
+	declaredSize  int64 // SIZE parameter of MAIL, 0 if not given
+	errors        int
+}
+
+// reset starts a new transaction.
+func (s *smtpSession) reset() {
+	envelope := mail.NewEnvelope(s.remoteIP, s.server.clientID.Add(1))
+	envelope.Helo = s.helo
+	envelope.ESMTP = s.esmtp
+	envelope.TLS = s.tls
+	if s.authUser != "" {
+		envelope.Values[envelopeAuthUser] = s.authUser
+	}
+	s.envelope = envelope
+	s.inTransaction = false
+	s.declaredSize = 0
+}
+
+func (s *smtpSession) reply(lines ...string) {
+	for _, line := range lines {
+		_, _ = s.writer.WriteString(line)
+		_, _ = s.writer.WriteString("\r\n")
+	}
+	if err := s.writer.Flush(); err != nil {
+		logger.Debugf("[%s] Failed to write the reply: %s", s.remoteIP, err)
+	}
+}
+
+// readCommand reads a command line, unless the server is shutting down.
+func (s *smtpSession) readCommand() (string, error) {
+	srv := s.server
+	srv.mu.Lock()
+	if srv.shuttingDown {
+		srv.mu.Unlock()
+		return "", errSMTPShutdown
+	}
+	_ = s.conn.SetDeadline(time.Now().Add(smtpCommandTimeout))
+	s.idle = true
+	srv.mu.Unlock()
+
+	line, err := s.reader.ReadSlice('\n')
+
+	srv.mu.Lock()
+	s.idle = false
+	shuttingDown := srv.shuttingDown
+	srv.mu.Unlock()
+	switch {
+	case errors.Is(err, bufio.ErrBufferFull):
+		return "", errSMTPLineLength
+	case err != nil && shuttingDown:
+		return "", errSMTPShutdown
+	case err != nil:
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (s *smtpSession) serve() {
+	r := response.Canned
+	if greeting := s.server.checkClient(s.remoteIP); greeting != "" {
+		s.reply(greeting)
+		return
+	}
+	s.reply(fmt.Sprintf("220 %s ESMTP smtp_to_telegram ready", s.server.hostname))
+	for {
+		line, err := s.readCommand()
+		switch {
+		case errors.Is(err, errSMTPShutdown):
+			s.reply(r.ErrorShutdown.String())
+			return
+		case errors.Is(err, errSMTPLineLength):
+			s.reply(r.FailLineTooLong.String())
+			return
+		case errors.Is(err, io.EOF):
+			logger.Debugf("[%s] Client closed the connection", s.remoteIP)
+			return
+		case err != nil:
+			logger.Warningf("[%s] Failed to read a command: %s", s.remoteIP, err)
+			return
+		}
+		logger.Debugf("[%s] Client sent: %s", s.remoteIP, line)
+
+		verb, _, _ := strings.Cut(line, " ")
+		args := line[len(verb):]
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			s.hello(args, false)
+		case "EHLO":
+			s.hello(args, true)
+		case "MAIL":
+			s.mail(args)
+		case "RCPT":
+			s.rcpt(args)
+		case "DATA":
+			if !s.data() {
+				return
+			}
+		case "RSET":
+			s.reset()
+			s.reply(r.SuccessResetCmd.String())
+		case "NOOP":
+			// go-guerrilla's canned NOOP reply has the code 200, which
+			// RFC 5321 doesn't allow.
+			s.reply("250 2.0.0 OK")
+		case "VRFY":
+			s.reply(r.SuccessVerifyCmd.String())
+		case "AUTH":
+			if !s.auth(args) {
+				return
+			}
+		case "HELP":
+			s.reply("214 2.0.0 OK")
+		case "QUIT":
+			s.reply(r.SuccessQuitCmd.String())
+			return
+		case "STARTTLS":
+			if s.server.tlsConfig == nil || s.tls {
+				s.unrecognized()
+				break
+			}
+			s.reply(r.SuccessStartTLSCmd.String())
+			if err := s.startTLS(); err != nil {
+				logger.Warningf("[%s] Failed TLS handshake: %s", s.remoteIP, err)
+				return
+			}
+			// The client starts over after the handshake.
+			s.helo, s.esmtp, s.authUser = "", false, ""
+			s.reset()
+		default:
+			s.unrecognized()
+		}
+		if s.errors >= smtpMaxUnrecognizedCommands {
+			s.reply(r.FailMaxUnrecognizedCmd.String())
+			return
+		}
+	}
+}
+
+func (s *smtpSession) unrecognized() {
+	s.errors++
+	if s.errors < smtpMaxUnrecognizedCommands {
+		s.reply(response.Canned.FailUnrecognizedCmd.String())
+	}
+}
+
+// hello answers HELO, or EHLO with the extensions if esmtp is set.
+func (s *smtpSession) hello(args string, esmtp bool) {
+	var helo string
+	var err error
+	if esmtp {
+		helo, _, err = s.parser.Ehlo([]byte(args))
+	} else {
+		helo, err = s.parser.Helo([]byte(args))
+	}
+	if err != nil {
+		s.reply(response.Canned.FailSyntaxError.String())
+		return
+	}
+	s.helo, s.esmtp = helo, esmtp
+	s.reset()
+	if !esmtp {
+		s.reply(fmt.Sprintf("250 %s Hello", s.server.hostname))
+		return
+	}
+
+	lines := []string{
+		s.server.hostname + " Hello",
+		fmt.Sprintf("SIZE %d", s.server.maxSize),
+		"PIPELINING",
+	}
+	if s.server.tlsConfig != nil && !s.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	if currentRules().Auth != nil && (s.server.tlsConfig == nil || s.tls) {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+	lines = append(lines, "ENHANCEDSTATUSCODES", "HELP")
+	for i := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		lines[i] = "250" + sep + lines[i]
+	}
+	s.reply(lines...)
+}
+
+func (s *smtpSession) mail(args string) {
+	r := response.Canned
+	if !strings.HasPrefix(strings.ToUpper(args), " FROM:") {
+		s.reply(r.FailSyntaxError.String())
+		return
+	}
+	if s.inTransaction {
+		s.reply(r.FailNestedMailCmd.String())
+		return
+	}
+	if s.server.config.TLS.Mode == SMTPTLSModeStartTLSRequired && !s.tls {
+		s.reply(fmt.Sprintf("530 5.7.0 Error: %s", errTLSRequired))
+		return
+	}
+	if auth := currentRules().Auth; auth != nil && auth.required && s.authUser == "" {
+		s.reply(fmt.Sprintf("530 5.7.0 Error: %s", errSMTPAuthRequired))
+		return
+	}
+	from, err := s.parsePath(args[len(" FROM:"):], s.parser.MailFrom)
+	if err != nil {
+		s.reply(err.Error())
+		return
+	}
+	size := declaredSize(s.parser.PathParams)
+	if size > s.server.maxSize {
+		s.reply(fmt.Sprintf("552 5.3.4 Error: message size exceeds fixed maximum message size (%d)", s.server.maxSize))
+		return
+	}
+	if reply := s.server.checkSender(s.remoteIP); reply != "" {
+		s.reply(reply)
+		return
+	}
+	s.envelope.MailFrom = from
+	s.declaredSize = size
+	s.inTransaction = true
+	s.reply(r.SuccessMailCmd.String())
+}
+
+func (s *smtpSession) rcpt(args string) {
+	r := response.Canned
+	if !strings.HasPrefix(strings.ToUpper(args), " TO:") {
+		s.reply(r.FailSyntaxError.String())
+		return
+	}
+	if !s.inTransaction {
+		s.reply("503 5.5.1 Error: need MAIL command")
+		return
+	}
+	if len(s.envelope.RcptTo) >= rfc5321.LimitRecipients {
+		s.reply(r.ErrorTooManyRecipients.String())
+		return
+	}
+	to, err := s.parsePath(args[len(" TO:"):], s.parser.RcptTo)
+	if err != nil {
+		s.reply(err.Error())
+		return
+	}
+	if to.Host == "" && to.IsPostmaster() {
+		to.Host = s.server.hostname
+	}
+	if !s.server.allowsHost(to.Host, to.IP) {
+		s.reply(r.ErrorRelayDenied.String() + " " + to.Host)
+		return
+	}
+	s.envelope.PushRcpt(to)
+	if reply := s.server.checkRecipient(s.envelope); reply != "" {
+		s.envelope.PopRcpt()
+		s.reply(reply)
+		return
+	}
+	s.reply(r.SuccessRcptCmd.String())
+}
+
+// data receives the email and hands it to the backend. It returns false when
+// the connection can't go on.
+func (s *smtpSession) data() bool {
+	r := response.Canned
+	if len(s.envelope.RcptTo) == 0 {
+		s.reply(r.FailNoRecipientsDataCmd.String())
+		return true
+	}
+	// The email holds its part of the memory budget from now until it is
+	// forwarded, starting with the size the client declared.
+	reservation := &memoryReservation{budget: s.server.budget}
+	defer reservation.release()
+	if !reservation.growTo(max(s.declaredSize, smtpDataChunkSize)) {
+		s.deferEmail()
+		return true
+	}
+	s.reply(r.SuccessDataCmd.String())
+
+	maxSize := s.server.maxSize
+	_ = s.conn.SetDeadline(time.Now().Add(smtpDataTimeout))
+	body := textproto.NewReader(s.reader).DotReader()
+	n, err := s.readData(io.LimitReader(body, maxSize+1), reservation)
+	exhausted := errors.Is(err, errMemoryBudgetExhausted)
+	if err != nil && !exhausted {
+		logger.Warningf("[%s] Failed to read DATA: %s", s.remoteIP, err)
+		s.reply(r.FailReadErrorDataCmd.String() + " " + err.Error())
+		return false
+	}
+	if exhausted || n > maxSize {
+		// Read the rest of the email without keeping it, so that the reply
+		// isn't lost when the connection is closed on unread data.
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			logger.Warningf("[%s] Failed to read DATA: %s", s.remoteIP, err)
+			return false
+		}
+		if exhausted {
+			s.deferEmail()
+			return true
+		}
+		logger.Warningf("[%s] DATA larger than %d bytes", s.remoteIP, maxSize)
+		s.reply(fmt.Sprintf("%s maximum DATA size exceeded (%d)", r.FailMessageSizeExceeded, maxSize))
+		s.reset()
+		return true
+	}
+
+	result := s.server.backend.Process(s.envelope)
+	s.reply(result.String())
+	s.reset()
+	return true
+}
+
+// readData reads the email into the envelope, growing the reservation
+// before the buffer grows.
+func (s *smtpSession) readData(body io.Reader, reservation *memoryReservation) (int64, error) {
+	data := &s.envelope.Data
+	data.Grow(int(min(s.declaredSize, s.server.maxSize)))
+	if !reservation.growTo(int64(data.Cap())) {
+		return 0, errMemoryBudgetExhausted
+	}
+	chunk := make([]byte, smtpDataChunkSize)
+	var total int64
+	for {
+		n, err := body.Read(chunk)
+		if data.Len()+n > data.Cap() {
+			// The buffer at least doubles when it grows.
+			if !reservation.growTo(int64(max(2*data.Cap(), data.Len()+n))) {
+				return total, errMemoryBudgetExhausted
+			}
+			data.Grow(n)
+			if !reservation.growTo(int64(data.Cap())) {
+				return total, errMemoryBudgetExhausted
+			}
+		}
+		data.Write(chunk[:n])
+		total += int64(n)
+		if errors.Is(err, io.EOF) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// deferEmail answers with a temporary failure to an email which doesn't fit
+// in the memory budget and starts a new transaction.
+func (s *smtpSession) deferEmail() {
+	logger.Warningf("Deferring email from %s: %s", s.remoteIP, errMemoryBudgetExhausted)
+	metricEmailsRejected.Inc("memory_budget")
+	s.reply(fmt.Sprintf("452 4.3.1 Error: %s", errMemoryBudgetExhausted))
+	s.reset()
+}
+
+// declaredSize returns the SIZE parameter of MAIL, 0 if it is missing or
+// invalid.
+func declaredSize(params [][]string) int64 {
+	for _, param := range params {
+		if len(param) == 2 && strings.EqualFold(param[0], "SIZE") {
+			if size, err := strconv.ParseInt(param[1], 10, 64); err == nil && size > 0 {
+				return size
+			}
+		}
+	}
+	return 0
+}
+
+func (s *smtpSession) parsePath(in string, parse func([]byte) error) (mail.Address, error) {
+	r := response.Canned
+	if len(in) > rfc5321.LimitPath {
+		return mail.Address{}, errors.New(r.FailPathTooLong.String())
+	}
+	if err := parse([]byte(in)); err != nil {
+		return mail.Address{}, errors.New(r.FailInvalidAddress.String())
+	}
+	p := &s.parser
+	switch {
+	case p.NullPath:
+		// a bounce
+		return mail.Address{}, nil
+	case len(p.LocalPart) > rfc5321.LimitLocalPart:
+		return mail.Address{}, errors.New(r.FailLocalPartTooLong.String())
+	case len(p.Domain) > rfc5321.LimitDomain:
+		return mail.Address{}, errors.New(r.FailDomainTooLong.String())
+	}
+	return mail.Address{
+		User:       p.LocalPart,
+		Host:       p.Domain,
+		ADL:        p.ADL,
+		PathParams: p.PathParams,
+		Quoted:     p.LocalPartQuotes,
+		IP:         p.IP,
+	}, nil
+}
+
+func (s *smtpSession) startTLS() error {
+	conn := tls.Server(s.conn, s.server.tlsConfig)
+	_ = conn.SetDeadline(time.Now().Add(smtpCommandTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	s.server.mu.Lock()
+	s.conn = conn
+	s.server.mu.Unlock()
+	// Commands pipelined after STARTTLS were sent in cleartext, resetting the
+	// reader drops them.
+	s.reader.Reset(conn)
+	s.writer.Reset(conn)
+	s.tls = true
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// dialSMTP connects to addr without an SMTP client, so that the test controls
+// exactly what is written, and reads the greeting.
+func dialSMTP(t *testing.T, addr string) (net.Conn, *textproto.Conn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	tc := textproto.NewConn(conn)
+	_, _, err = tc.ReadResponse(220)
+	require.NoError(t, err)
+	return conn, tc
+}
+
+// expectReply reads a reply and checks its code and the start of its text.
+func expectReply(t *testing.T, tc *textproto.Conn, code int, prefix string) {
+	t.Helper()
+	gotCode, msg, err := tc.ReadResponse(0)
+	require.NoError(t, err)
+	require.Equal(t, code, gotCode, msg)
+	require.True(t, strings.HasPrefix(msg, prefix), msg)
+}
+
+func TestAllowedHosts(t *testing.T) {
+	hosts := newAllowedHosts([]string{"example.com", "*.example.org", "[127.0.0.1]"})
+	require.True(t, hosts.allows("Example.COM"))
+	require.True(t, hosts.allows("mail.example.org"))
+	require.True(t, hosts.allows("[127.0.0.1]"))
+	require.False(t, hosts.allows("example.org"))
+	require.False(t, hosts.allows("example.net"))
+
+	anyHost := newAllowedHosts([]string{"."})
+	require.True(t, anyHost.allows("example.net"))
+}
+
+func TestDeclaredSize(t *testing.T) {
+	require.Equal(t, int64(1000), declaredSize([][]string{{"BODY", "8BITMIME"}, {"size", "1000"}}))
+	require.Zero(t, declaredSize([][]string{{"SIZE", "lots"}}))
+	require.Zero(t, declaredSize(nil))
+}
+
+func TestSMTPSession(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.AllowedHosts = "test"
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	c, err := smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	ok, size := c.Extension("SIZE")
+	require.True(t, ok)
+	require.Equal(t, "10485760", size)
+	ok, _ = c.Extension("PIPELINING")
+	require.True(t, ok)
+
+	require.ErrorContains(t, c.Rcpt("to@test"), "503")
+	require.NoError(t, c.Mail("from@test"))
+	require.ErrorContains(t, c.Mail("from@test"), "nested MAIL command")
+	require.ErrorContains(t, c.Rcpt("to@example.com"), "Relay access denied")
+	require.NoError(t, c.Rcpt("to@test"))
+	require.NoError(t, c.Reset())
+	require.NoError(t, c.Quit())
+}
+
+func TestSMTPPipelining(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	conn, tc := dialSMTP(t, smtpConfig.Listen)
+	_, err := io.WriteString(conn, "EHLO client\r\nMAIL FROM:<from@test>\r\nRCPT TO:<to@test>\r\nDATA\r\n")
+	require.NoError(t, err)
+	expectReply(t, tc, 250, "")
+	expectReply(t, tc, 250, "2.1.0")
+	expectReply(t, tc, 250, "2.1.5")
+	expectReply(t, tc, 354, "")
+
+	_, err = io.WriteString(conn, "Subject: Test subj\r\n\r\nText body\r\n.\r\nQUIT\r\n")
+	require.NoError(t, err)
+	expectReply(t, tc, 250, "2.0.0")
+	expectReply(t, tc, 221, "")
+	require.Len(t, h.RequestMessages, 2)
+}
+
+func TestSMTPDeclaredSizeTooLarge(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.MaxEnvelopeSize = 1024
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	_, tc := dialSMTP(t, smtpConfig.Listen)
+	require.NoError(t, tc.PrintfLine("EHLO client"))
+	expectReply(t, tc, 250, "")
+	require.NoError(t, tc.PrintfLine("MAIL FROM:<from@test> SIZE=1025"))
+	expectReply(t, tc, 552, "5.3.4")
+	require.NoError(t, tc.PrintfLine("MAIL FROM:<from@test> SIZE=1024"))
+	expectReply(t, tc, 250, "2.1.0")
+}
+
+func TestSMTPDataTooLarge(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.MaxEnvelopeSize = 1024
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	c, err := smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+	require.NoError(t, c.Mail("from@test"))
+	require.NoError(t, c.Rcpt("to@test"))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: Test subj\r\n\r\n" + strings.Repeat("Text body\r\n", 200)))
+	require.NoError(t, err)
+	err = w.Close()
+	var tpErr *textproto.Error
+	require.ErrorAs(t, err, &tpErr)
+	require.Equal(t, 552, tpErr.Code)
+	require.Contains(t, tpErr.Msg, "maximum DATA size exceeded")
+	require.Empty(t, h.RequestMessages)
+
+	// The session goes on with a new transaction.
+	require.NoError(t, sendTestMail(t, c))
+	require.Len(t, h.RequestMessages, 2)
+}
+
+func TestSMTPLineTooLong(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	conn, tc := dialSMTP(t, smtpConfig.Listen)
+	require.NoError(t, tc.PrintfLine("HELO %s", strings.Repeat("a", smtpLineMaxLength)))
+	expectReply(t, tc, 554, "5.5.1 Line too long")
+	_, err := conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
+
+func TestSMTPPathLimits(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	_, tc := dialSMTP(t, smtpConfig.Listen)
+	require.NoError(t, tc.PrintfLine("HELO client"))
+	expectReply(t, tc, 250, "")
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "path", path: strings.Repeat("a", 64) + "@" + strings.Repeat("b", 200) + ".test", want: "Path too long"},
+		{name: "local part", path: strings.Repeat("a", 129) + "@test", want: "Local part too long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tc.PrintfLine("MAIL FROM:<%s>", tt.path))
+			code, msg, err := tc.ReadResponse(0)
+			require.NoError(t, err)
+			require.Equal(t, 550, code)
+			require.Contains(t, msg, tt.want)
+		})
+	}
+
+	// The null path of bounces is accepted.
+	require.NoError(t, tc.PrintfLine("MAIL FROM:<>"))
+	expectReply(t, tc, 250, "2.1.0")
+}
+
+func TestSMTPStartTLSDropsPipelinedCommands(t *testing.T) {
+	smtpConfig := makeTLSSMTPConfig(t, SMTPTLSModeStartTLS)
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	conn, tc := dialSMTP(t, smtpConfig.Listen)
+	require.NoError(t, tc.PrintfLine("EHLO client"))
+	expectReply(t, tc, 250, "")
+	// RSET is injected in cleartext after STARTTLS, it must not be answered
+	// inside the TLS session.
+	_, err := io.WriteString(conn, "STARTTLS\r\nRSET\r\n")
+	require.NoError(t, err)
+	expectReply(t, tc, 220, "")
+
+	tlsConn := tls.Client(conn, testClientTLSConfig)
+	require.NoError(t, tlsConn.Handshake())
+	tc = textproto.NewConn(tlsConn)
+	require.NoError(t, tc.PrintfLine("NOOP"))
+	expectReply(t, tc, 250, "2.0.0")
+}
+
+func TestSMTPServerShutdownClosesIdleClients(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+
+	_, tc := dialSMTP(t, smtpConfig.Listen)
+	d.Shutdown()
+	expectReply(t, tc, 421, "")
+}
+
+func TestSMTPUnrecognizedCommands(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	conn, tc := dialSMTP(t, smtpConfig.Listen)
+	require.NoError(t, tc.PrintfLine("DATA"))
+	expectReply(t, tc, 503, "")
+	// STARTTLS isn't offered without a certificate.
+	for _, cmd := range []string{"STARTTLS", "XYZZY", "AUTH PLAIN", "TURN"} {
+		require.NoError(t, tc.PrintfLine("%s", cmd))
+		expectReply(t, tc, 554, "")
+	}
+	require.NoError(t, tc.PrintfLine("XYZZY"))
+	expectReply(t, tc, 554, "")
+	_, err := conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/phires/go-guerrilla"
+)
+
+const (
+	SMTPTLSModeOff              = "off"
+	SMTPTLSModeStartTLS         = "starttls"
+	SMTPTLSModeStartTLSRequired = "starttls-required"
+	SMTPTLSModeImplicit         = "implicit"
+
+	tlsCertificateCheckInterval = 30 * time.Second
+)
+
+var (
+	errInvalidTLSMode       = errors.New("invalid smtp tls mode")
+	errInvalidTLSVersion    = errors.New("invalid smtp tls min version")
+	errTLSCertificateNeeded = errors.New("smtp tls requires --smtp-tls-cert and --smtp-tls-key")
+	errTLSRequired          = errors.New("must issue a STARTTLS command first")
+)
+
+// SMTPTLSConfig configures TLS on the inbound SMTP listener.
+type SMTPTLSConfig struct {
+	Mode       string `yaml:"mode"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	MinVersion string `yaml:"min_version"`
+	Listen     string `yaml:"listen"` // implicit TLS listener
+}
+
+func (c *SMTPTLSConfig) Enabled() bool {
+	return c.Mode != "" && c.Mode != SMTPTLSModeOff
+}
+
+func (c *SMTPTLSConfig) Validate() error {
+	switch c.Mode {
+	case "", SMTPTLSModeOff:
+		return nil
+	case SMTPTLSModeStartTLS, SMTPTLSModeStartTLSRequired, SMTPTLSModeImplicit:
+	default:
+		return fmt.Errorf("%w: %q", errInvalidTLSMode, c.Mode)
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errTLSCertificateNeeded
+	}
+	if _, ok := guerrilla.TLSProtocols[c.MinVersion]; c.MinVersion != "" && !ok {
+		return fmt.Errorf("%w: %q", errInvalidTLSVersion, c.MinVersion)
+	}
+	if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+		return fmt.Errorf("failed to load smtp tls certificate: %w", err)
+	}
+	return nil
+}
+
+// serverTLSConfig returns the TLS settings of the listeners, which serve the
+// certificate returned by getCertificate.
+func (c *SMTPTLSConfig) serverTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	tlsConfig := &tls.Config{GetCertificate: getCertificate} //nolint:gosec // MinVersion defaults to TLS 1.2 for servers
+	if version, ok := guerrilla.TLSProtocols[c.MinVersion]; ok {
+		tlsConfig.MinVersion = version
+	}
+	return tlsConfig
+}
+
+// WatchTLSCertificates reloads the certificate of the SMTP listeners when the
+// certificate or key file changes, until ctx is done.
+func WatchTLSCertificates(ctx context.Context, srv *SMTPServer, smtpConfig *SMTPConfig, interval time.Duration) {
+	if !smtpConfig.TLS.Enabled() {
+		return
+	}
+	w := &certificateWatcher{certFile: smtpConfig.TLS.CertFile, keyFile: smtpConfig.TLS.KeyFile}
+	w.changed() // remember the current modification times
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !w.changed() {
+			continue
+		}
+		// The files may be replaced one at a time, don't reload a mismatched pair.
+		cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+		if err != nil {
+			logger.Warningf("Not reloading the SMTP TLS certificate: %s", err)
+			w.reset()
+			continue
+		}
+		srv.setCertificate(&cert)
+		logger.Infof("Reloaded the SMTP TLS certificate from %s", w.certFile)
+	}
+}
+
+type certificateWatcher struct {
+	certFile, keyFile   string
+	certMtime, keyMtime time.Time
+}
+
+// changed reports whether either file was modified since the last call.
+func (w *certificateWatcher) changed() bool {
+	certMtime, keyMtime := fileMtime(w.certFile), fileMtime(w.keyFile)
+	changed := !certMtime.Equal(w.certMtime) || !keyMtime.Equal(w.keyMtime)
+	w.certMtime, w.keyMtime = certMtime, keyMtime
+	return changed
+}
+
+// reset makes the next call to changed report a change, to retry a reload.
+func (w *certificateWatcher) reset() {
+	w.certMtime, w.keyMtime = time.Time{}, time.Time{}
+}
+
+func fileMtime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
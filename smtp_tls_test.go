@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1.
+func writeTestCertificate(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "testhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"testhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
+
+func makeTLSSMTPConfig(t *testing.T, mode string) *SMTPConfig {
+	t.Helper()
+	dir := t.TempDir()
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.TLS = SMTPTLSConfig{
+		Mode:       mode,
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		MinVersion: "tls1.2",
+		Listen:     fmt.Sprintf("%s:%d", testSMTPListenHost, testSMTPListenPort+1),
+	}
+	writeTestCertificate(t, smtpConfig.TLS.CertFile, smtpConfig.TLS.KeyFile, 1)
+	require.NoError(t, smtpConfig.TLS.Validate())
+	return smtpConfig
+}
+
+var testClientTLSConfig = &tls.Config{InsecureSkipVerify: true, ServerName: "testhost"} //nolint:gosec // self-signed test certificate
+
+func sendTestMail(t *testing.T, c *smtp.Client) error {
+	t.Helper()
+	if err := c.Mail("from@test"); err != nil {
+		return err
+	}
+	if err := c.Rcpt("to@test"); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: Test subj\r\n\r\nText body\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return c.Quit()
+}
+
+func TestSMTPStartTLSRequired(t *testing.T) {
+	smtpConfig := makeTLSSMTPConfig(t, SMTPTLSModeStartTLSRequired)
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	c, err := smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	ok, _ := c.Extension("STARTTLS")
+	require.True(t, ok)
+	// The client is told at MAIL that it must issue STARTTLS.
+	err = c.Mail("from@test")
+	var smtpErr *textproto.Error
+	require.ErrorAs(t, err, &smtpErr)
+	require.Equal(t, 530, smtpErr.Code)
+	require.Equal(t, "5.7.0 Error: "+errTLSRequired.Error(), smtpErr.Msg)
+	_ = c.Close()
+	require.Empty(t, h.RequestMessages)
+
+	c, err = smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	require.NoError(t, c.StartTLS(testClientTLSConfig))
+	require.NoError(t, sendTestMail(t, c))
+	require.NotEmpty(t, h.RequestMessages)
+}
+
+func TestSMTPImplicitTLS(t *testing.T) {
+	smtpConfig := makeTLSSMTPConfig(t, SMTPTLSModeImplicit)
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	conn, err := tls.Dial("tcp", smtpConfig.TLS.Listen, testClientTLSConfig)
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), conn.ConnectionState().Version)
+	c, err := smtp.NewClient(conn, "testhost")
+	require.NoError(t, err)
+	ok, _ := c.Extension("STARTTLS")
+	require.False(t, ok)
+	require.NoError(t, sendTestMail(t, c))
+	require.NotEmpty(t, h.RequestMessages)
+
+	// The plain listener keeps working, with STARTTLS offered.
+	c, err = smtp.Dial(smtpConfig.Listen)
+	require.NoError(t, err)
+	ok, _ = c.Extension("STARTTLS")
+	require.True(t, ok)
+	_ = c.Close()
+}
+
+func TestWatchTLSCertificatesReloads(t *testing.T) {
+	smtpConfig := makeTLSSMTPConfig(t, SMTPTLSModeImplicit)
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchTLSCertificates(ctx, d, smtpConfig, 10*time.Millisecond)
+
+	servedSerial := func() int64 {
+		conn, err := tls.Dial("tcp", smtpConfig.TLS.Listen, testClientTLSConfig)
+		if err != nil {
+			return 0
+		}
+		defer func() { _ = conn.Close() }()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	require.Equal(t, int64(1), servedSerial())
+
+	writeTestCertificate(t, smtpConfig.TLS.CertFile, smtpConfig.TLS.KeyFile, 2)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(smtpConfig.TLS.CertFile, future, future))
+	require.NoError(t, os.Chtimes(smtpConfig.TLS.KeyFile, future, future))
+	require.Eventually(t, func() bool { return servedSerial() == 2 }, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestSMTPTLSConfigValidate(t *testing.T) {
+	require.NoError(t, (&SMTPTLSConfig{Mode: SMTPTLSModeOff}).Validate())
+	require.ErrorIs(t, (&SMTPTLSConfig{Mode: "always"}).Validate(), errInvalidTLSMode)
+	require.ErrorIs(t, (&SMTPTLSConfig{Mode: SMTPTLSModeStartTLS}).Validate(), errTLSCertificateNeeded)
+	require.ErrorIs(t, (&SMTPTLSConfig{Mode: SMTPTLSModeStartTLS, CertFile: "c", KeyFile: "k", MinVersion: "ssl3"}).Validate(), errInvalidTLSVersion)
+}
@@ -9,40 +9,41 @@ import (
 	"io"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/docker/go-units"
 	"github.com/jhillyerd/enmime/v2"
-	"github.com/phires/go-guerrilla"
 	"github.com/phires/go-guerrilla/backends"
 	"github.com/phires/go-guerrilla/log"
 	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/response"
 	"github.com/urfave/cli/v3"
 	"go.yaml.in/yaml/v3"
 )
 
 var (
-	Version     = "UNKNOWN_RELEASE"
-	logger      log.Logger
-	filterRules []FilterRule
+	Version = "UNKNOWN_RELEASE"
+	logger  log.Logger
 
 	// Sentinel errors
-	errInvalidMatchType          = errors.New("invalid match type")
-	errInvalidField              = errors.New("invalid field")
-	errRejectedByFilter          = errors.New("email rejected by filter rule")
 	errReadingJSON               = errors.New("error reading json body of sendMessage")
 	errParsingJSON               = errors.New("error parsing json body of sendMessage")
 	errResponseNotOK             = errors.New("telegram API response not ok")
 	errUnknownFileType           = errors.New("unknown file type")
+	errInvalidThreadID           = errors.New("invalid message thread ID")
+	errInvalidMessageFormat      = errors.New("invalid message format")
+	errRequiredFlag              = errors.New("required flag not set")
 	errEmailParsing              = errors.New("error occurred during email parsing")
 	errMessageTooLarge           = errors.New("message length is larger than forwarded-attachment-max-size")
 	errUnexpectedTruncation      = errors.New("unexpected length of truncated message")
@@ -52,50 +53,98 @@ var (
 	errTemplateNoLongerSupported = errors.New("ST_TELEGRAM_MESSAGE_TEMPLATE is no longer supported. The message format is now fixed to support the reply-to-email feature") // TODO: remove in 3.0.0 or later
 )
 
-type FilterCondition struct {
-	Field   string         `yaml:"field"`
-	Pattern string         `yaml:"pattern"`
-	regex   *regexp.Regexp // compiled pattern
-}
-
-type FilterRule struct {
-	Name       string            `yaml:"name"`
-	Match      string            `yaml:"match"` // "all" or "any"
-	Conditions []FilterCondition `yaml:"conditions"`
-}
-
 type AppConfig struct {
-	FilterRules []FilterRule `yaml:"filter_rules"`
-	SMTPOut     struct {
+	FilterRules    []FilterRule `yaml:"filter_rules"`
+	Routes         []Route      `yaml:"routes"`
+	DefaultChatIDs []string     `yaml:"default_chat_ids"`
+	RejectUnrouted bool         `yaml:"reject_unrouted"`
+	SMTPOut        struct {
 		Host     string `yaml:"host"`
 		Port     int    `yaml:"port"`
 		Username string `yaml:"username"`
 		Password string `yaml:"password"`
 	} `yaml:"smtp_out"`
+	SMTPTLS      SMTPTLSConfig      `yaml:"smtp_tls"`
+	SMTPAuth     SMTPAuthConfig     `yaml:"smtp_auth"`
+	ClientAccess ClientAccessConfig `yaml:"client_access"`
 }
 
 const (
-	BodyTruncated = "\n\n[truncated]"
+	// BodyTruncated ends a truncated body, BodyTruncatedDetails also tells
+	// how many characters and lines were left out.
+	BodyTruncated        = "\n\n[truncated]"
+	BodyTruncatedDetails = "\n\n[truncated: %s]"
+
+	MessageFormatText = "text"
+	MessageFormatHTML = "html"
 )
 
 type SMTPConfig struct {
 	Listen          string
 	PrimaryHost     string
 	MaxEnvelopeSize int64
+	MemoryBudget    int64
 	AllowedHosts    string
 	ConfigFile      string
+	TLS             SMTPTLSConfig
 }
 
 type TelegramConfig struct {
-	ChatIDs                          string
-	BotToken                         string
-	APIPrefix                        string
-	APITimeoutSeconds                float64
-	ForwardedAttachmentMaxSize       int
-	ForwardedAttachmentMaxPhotoSize  int
-	ForwardedAttachmentRespectErrors bool
-	MessageLengthToSendAsFile        uint
-	ForceReply                       bool
+	ChatIDs                             string
+	BotToken                            string
+	APIPrefix                           string
+	APITimeoutSeconds                   float64
+	ForwardedAttachmentMaxSize          int
+	ForwardedAttachmentMaxPhotoSize     int
+	ForwardedAttachmentMaxAnimationSize int
+	ForwardedAttachmentMaxVideoSize     int
+	ForwardedAttachmentMaxAudioSize     int
+	ForwardedAttachmentMaxVoiceSize     int
+	ForwardedAttachmentRespectErrors    bool
+	MessageLengthToSendAsFile           uint
+	MessageFormat                       string
+	ForceReply                          bool
+	LocalMode                           bool
+	LocalFileDir                        string
+}
+
+// ChatTarget is a Telegram chat, optionally narrowed down to a forum topic.
+// It is written as "chatID" or "chatID:threadID".
+type ChatTarget struct {
+	ChatID   int64
+	ThreadID int
+}
+
+func ParseChatTarget(s string) (ChatTarget, error) {
+	chatIDStr, threadIDStr, hasThread := strings.Cut(strings.TrimSpace(s), ":")
+	chatID, err := strconv.ParseInt(chatIDStr, 10, 64)
+	if err != nil {
+		return ChatTarget{}, fmt.Errorf("invalid chat ID %q: %w", s, err)
+	}
+	target := ChatTarget{ChatID: chatID}
+	if hasThread {
+		target.ThreadID, err = strconv.Atoi(threadIDStr)
+		if err != nil || target.ThreadID <= 0 {
+			return ChatTarget{}, fmt.Errorf("%w: %q", errInvalidThreadID, s)
+		}
+	}
+	return target, nil
+}
+
+func (t ChatTarget) String() string {
+	if t.ThreadID != 0 {
+		return fmt.Sprintf("%d:%d", t.ChatID, t.ThreadID)
+	}
+	return strconv.FormatInt(t.ChatID, 10)
+}
+
+// formValues returns the chat_id and message_thread_id request parameters.
+func (t ChatTarget) formValues() url.Values {
+	values := url.Values{"chat_id": {strconv.FormatInt(t.ChatID, 10)}}
+	if t.ThreadID != 0 {
+		values.Set("message_thread_id", strconv.Itoa(t.ThreadID))
+	}
+	return values
 }
 
 type TelegramAPIMessageResult struct {
@@ -105,24 +154,75 @@ type TelegramAPIMessageResult struct {
 
 type TelegramAPIMessage struct {
 	// https://core.telegram.org/bots/api#message
-	MessageID json.Number `json:"message_id"`
+	MessageID json.Number         `json:"message_id"`
+	Document  *TelegramFile       `json:"document"`
+	Photo     []TelegramPhotoSize `json:"photo"`
+	Animation *TelegramFile       `json:"animation"`
+	Video     *TelegramFile       `json:"video"`
+	Audio     *TelegramFile       `json:"audio"`
+	Voice     *TelegramFile       `json:"voice"`
+}
+
+// fileID returns the file_id of a sent document or photo.
+func (m *TelegramAPIMessage) fileID() string {
+	if len(m.Photo) > 0 {
+		// Sizes are ordered from the smallest to the original one.
+		return m.Photo[len(m.Photo)-1].FileID
+	}
+	for _, file := range []*TelegramFile{m.Animation, m.Video, m.Audio, m.Voice, m.Document} {
+		if file != nil {
+			return file.FileID
+		}
+	}
+	return ""
+}
+
+// SentMessage is a Telegram message an email was forwarded as.
+type SentMessage struct {
+	Chat      ChatTarget
+	MessageID json.Number
+	// AttachmentsPending is set when the message was sent but not all of its
+	// attachments.
+	AttachmentsPending bool
+}
+
+func (m SentMessage) String() string {
+	return fmt.Sprintf("%s in %s", m.MessageID, m.Chat)
+}
+
+// describeSentMessages lists the Telegram messages for the SMTP response.
+func describeSentMessages(sent []SentMessage) string {
+	messages := make([]string, 0, len(sent))
+	for _, m := range sent {
+		messages = append(messages, m.String())
+	}
+	return "Telegram messages " + strings.Join(messages, ", ")
 }
 
 type FormattedEmail struct {
-	From        string
-	To          string
-	CC          string
-	ReplyTo     string
-	Subject     string
-	Text        string
-	HTML        string
-	Attachments []*FormattedAttachment
+	From         string // From header, the envelope sender if missing
+	EnvelopeFrom string // MAIL FROM of the SMTP transaction
+	To           string
+	CC           string
+	ReplyTo      string
+	Subject      string
+	Text         string
+	HTML         string
+	ParseMode    string // Telegram parse_mode of Text, empty for plain text
+	MessageID    string // Message-ID header of the email
+	References   string // References header of the email
+	Attachments  []*FormattedAttachment
+	Silent       bool // sent with disable_notification
+	// For filter rules
+	Headers         textproto.MIMEHeader // decoded headers of the email
+	AttachmentInfos []AttachmentInfo     // every attachment, also the discarded ones
 }
 
-const (
-	AttachmentTypeDocument = iota
-	AttachmentTypePhoto
-)
+// AttachmentInfo describes an attachment of an email.
+type AttachmentInfo struct {
+	Filename    string
+	ContentType string
+}
 
 type FormattedAttachment struct {
 	Filename string
@@ -145,11 +245,23 @@ func main() {
 		Usage: "A small program which listens for SMTP and sends " +
 			"all incoming Email messages to Telegram.",
 		Version: Version,
+		Commands: []*cli.Command{
+			checkConfigCommand(),
+			testFilterCommand(),
+			sendTestCommand(),
+		},
 		Action: func(ctx context.Context, cmd *cli.Command) error {
+			if err := requireTelegramFlags(cmd); err != nil {
+				return err
+			}
 			smtpMaxEnvelopeSize, err := units.FromHumanSize(cmd.String("smtp-max-envelope-size"))
 			if err != nil {
 				return err
 			}
+			smtpMemoryBudget, err := units.FromHumanSize(cmd.String("smtp-memory-budget"))
+			if err != nil {
+				return err
+			}
 			if cmd.String("blacklist-file") != "" {
 				return errBlacklistFileDeprecate
 			}
@@ -167,29 +279,24 @@ func main() {
 				Listen:          cmd.String("smtp-listen"),
 				PrimaryHost:     smtpPrimaryHost,
 				MaxEnvelopeSize: smtpMaxEnvelopeSize,
+				MemoryBudget:    smtpMemoryBudget,
 				AllowedHosts:    cmd.String("smtp-allowed-hosts"),
 				ConfigFile:      cmd.String("config-file"),
 			}
-			forwardedAttachmentMaxSize, err := units.FromHumanSize(cmd.String("forwarded-attachment-max-size"))
+			telegramConfig, err := newTelegramConfig(cmd)
 			if err != nil {
 				return err
 			}
-			forwardedAttachmentMaxPhotoSize, err := units.FromHumanSize(cmd.String("forwarded-attachment-max-photo-size"))
-			if err != nil {
+			if err := telegramConfig.checkEnvelopeSize(smtpConfig, cmd.IsSet("smtp-max-envelope-size")); err != nil {
 				return err
 			}
-			telegramConfig := &TelegramConfig{
-				ChatIDs:                          cmd.String("telegram-chat-ids"),
-				BotToken:                         cmd.String("telegram-bot-token"),
-				APIPrefix:                        cmd.String("telegram-api-prefix"),
-				APITimeoutSeconds:                cmd.Float64("telegram-api-timeout-seconds"),
-				ForwardedAttachmentMaxSize:       int(forwardedAttachmentMaxSize),
-				ForwardedAttachmentMaxPhotoSize:  int(forwardedAttachmentMaxPhotoSize),
-				ForwardedAttachmentRespectErrors: cmd.Bool("forwarded-attachment-respect-errors"),
-				MessageLengthToSendAsFile:        cmd.Uint("message-length-to-send-as-file"),
+			updateMode := cmd.String("telegram-update-mode")
+			if updateMode != UpdateModePolling && updateMode != UpdateModeWebhook {
+				return fmt.Errorf("%w: %q, expected %q or %q", errInvalidUpdateMode,
+					updateMode, UpdateModePolling, UpdateModeWebhook)
 			}
 
-			yamlSMTPOut, err := loadConfig(smtpConfig.ConfigFile)
+			appConfig, err := loadConfig(smtpConfig.ConfigFile)
 			if err != nil {
 				return fmt.Errorf("failed to load config: %w", err)
 			}
@@ -200,24 +307,98 @@ func main() {
 				Username: cmd.String("smtp-out-username"),
 				Password: cmd.String("smtp-out-password"),
 			}
-			if yamlSMTPOut != nil {
+			replyAttachmentMaxSize, err := units.FromHumanSize(cmd.String("reply-attachment-max-size"))
+			if err != nil {
+				return err
+			}
+			smtpOutConfig.AttachmentMaxSize = replyAttachmentMaxSize
+			if appConfig != nil {
 				if smtpOutConfig.Host == "" {
-					smtpOutConfig.Host = yamlSMTPOut.Host
+					smtpOutConfig.Host = appConfig.SMTPOut.Host
 				}
-				if !cmd.IsSet("smtp-out-port") && yamlSMTPOut.Port != 0 {
-					smtpOutConfig.Port = yamlSMTPOut.Port
+				if !cmd.IsSet("smtp-out-port") && appConfig.SMTPOut.Port != 0 {
+					smtpOutConfig.Port = appConfig.SMTPOut.Port
 				}
 				if smtpOutConfig.Username == "" {
-					smtpOutConfig.Username = yamlSMTPOut.Username
+					smtpOutConfig.Username = appConfig.SMTPOut.Username
 				}
 				if smtpOutConfig.Password == "" {
-					smtpOutConfig.Password = yamlSMTPOut.Password
+					smtpOutConfig.Password = appConfig.SMTPOut.Password
 				}
 			}
-			d, err := SMTPStart(smtpConfig, telegramConfig)
+
+			smtpConfig.TLS = SMTPTLSConfig{
+				Mode:       cmd.String("smtp-tls-mode"),
+				CertFile:   cmd.String("smtp-tls-cert"),
+				KeyFile:    cmd.String("smtp-tls-key"),
+				MinVersion: cmd.String("smtp-tls-min-version"),
+				Listen:     cmd.String("smtp-tls-listen"),
+			}
+			if appConfig != nil {
+				yamlTLS := appConfig.SMTPTLS
+				if !cmd.IsSet("smtp-tls-mode") && yamlTLS.Mode != "" {
+					smtpConfig.TLS.Mode = yamlTLS.Mode
+				}
+				if smtpConfig.TLS.CertFile == "" {
+					smtpConfig.TLS.CertFile = yamlTLS.CertFile
+				}
+				if smtpConfig.TLS.KeyFile == "" {
+					smtpConfig.TLS.KeyFile = yamlTLS.KeyFile
+				}
+				if !cmd.IsSet("smtp-tls-min-version") && yamlTLS.MinVersion != "" {
+					smtpConfig.TLS.MinVersion = yamlTLS.MinVersion
+				}
+				if !cmd.IsSet("smtp-tls-listen") && yamlTLS.Listen != "" {
+					smtpConfig.TLS.Listen = yamlTLS.Listen
+				}
+			}
+			if err := smtpConfig.TLS.Validate(); err != nil {
+				return err
+			}
+			if smtpOutConfig.IsConfigured() {
+				// Replies are sent as emails. The Telegram config is final
+				// before the SMTP server and the spool start reading it.
+				telegramConfig.ForceReply = true
+			}
+
+			var store *MessageStore
+			if storePath := cmd.String("message-store"); storePath != "" {
+				store, err = OpenMessageStore(storePath, cmd.Duration("message-store-retention"))
+				if err != nil {
+					return err
+				}
+				defer func() {
+					if err := store.Close(); err != nil {
+						logger.Warningf("Failed to close message store: %v", err)
+					}
+				}()
+			}
+			var spool *Spool
+			if spoolDir := cmd.String("spool-dir"); spoolDir != "" {
+				spool, err = NewSpool(spoolDir, cmd.Duration("spool-max-age"), telegramConfig, store)
+				if err != nil {
+					return err
+				}
+			}
+
+			srv, err := SMTPStart(smtpConfig, telegramConfig, spool, store)
 			if err != nil {
 				return fmt.Errorf("start error: %w", err)
 			}
+			go WatchTLSCertificates(ctx, srv, smtpConfig, tlsCertificateCheckInterval)
+			if smtpConfig.ConfigFile != "" {
+				hup := make(chan os.Signal, 1)
+				signal.Notify(hup, syscall.SIGHUP)
+				defer signal.Stop(hup)
+				var interval time.Duration
+				if cmd.Bool("config-watch") {
+					interval = configCheckInterval
+				}
+				go WatchConfig(ctx, smtpConfig.ConfigFile, interval, hup)
+			}
+			if spool != nil {
+				spool.Start()
+			}
 
 			allowedChatIDs, err := parseChatIDs(telegramConfig.ChatIDs)
 			if err != nil {
@@ -226,18 +407,50 @@ func main() {
 
 			allowedHosts := getAllowedHosts(smtpConfig)
 
-			var cancelPolling context.CancelFunc
+			var httpServer *http.Server
+			if httpListen := cmd.String("http-listen"); httpListen != "" {
+				httpServer, err = StartHTTPServer(httpListen)
+				if err != nil {
+					return err
+				}
+				if !smtpOutConfig.IsConfigured() {
+					// Without polling nothing else verifies the bot token for /readyz.
+					go func() {
+						client := &http.Client{Timeout: 40 * time.Second}
+						if _, err := GetBotUserID(ctx, telegramConfig, client); err != nil {
+							logger.Errorf("Failed to get bot identity: %s", SanitizeBotToken(err.Error(), telegramConfig.BotToken))
+						}
+					}()
+				}
+			}
+
+			var stopUpdates func()
 			if smtpOutConfig.IsConfigured() && slices.Contains(allowedHosts, ".") {
 				logger.Warning("smtp-out is configured with default allowed hosts (\".\"), which accepts any domain as sender. Set --smtp-allowed-hosts to restrict sender domains.")
 			}
 			if smtpOutConfig.IsConfigured() {
-				telegramConfig.ForceReply = true
-				pollCtx, cancel := context.WithCancel(context.Background())
-				cancelPolling = cancel
-				go PollTelegramUpdates(pollCtx, telegramConfig, smtpOutConfig, allowedChatIDs, allowedHosts)
+				if updateMode == UpdateModeWebhook {
+					webhook, err := StartTelegramWebhook(ctx, telegramConfig, smtpOutConfig, store, &WebhookConfig{
+						URL:    cmd.String("telegram-webhook-url"),
+						Listen: cmd.String("telegram-webhook-listen"),
+						Secret: cmd.String("telegram-webhook-secret"),
+					}, allowedChatIDs, allowedHosts)
+					if err != nil {
+						return err
+					}
+					stopUpdates = func() {
+						stopCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+						defer cancel()
+						webhook.Shutdown(stopCtx)
+					}
+				} else {
+					pollCtx, cancel := context.WithCancel(context.Background())
+					stopUpdates = cancel
+					go PollTelegramUpdates(pollCtx, telegramConfig, smtpOutConfig, store, allowedChatIDs, allowedHosts)
+				}
 			}
 
-			return awaitShutdown(ctx, &d, cancelPolling)
+			return awaitShutdown(ctx, srv, stopUpdates, spool, httpServer)
 		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
@@ -258,11 +471,49 @@ func main() {
 				Sources: cli.EnvVars("ST_SMTP_ALLOWED_HOSTS"),
 			},
 			&cli.StringFlag{
-				Name:    "smtp-max-envelope-size",
-				Usage:   "Max size of an incoming Email. Examples: 5k, 10m.",
+				Name: "smtp-max-envelope-size",
+				Usage: "Max size of an incoming Email. Examples: 5k, 10m. " +
+					"With --telegram-local-mode the default is raised to fit the " +
+					"attachment limits.",
 				Value:   "50m",
 				Sources: cli.EnvVars("ST_SMTP_MAX_ENVELOPE_SIZE"),
 			},
+			&cli.StringFlag{
+				Name: "smtp-memory-budget",
+				Usage: "Max total size of the emails being received and forwarded at once, " +
+					"further emails get a temporary 452 error. An email takes a few " +
+					"times its size in memory. 0 -- no limit. Examples: 100m, 1g.",
+				Value:   "0",
+				Sources: cli.EnvVars("ST_SMTP_MEMORY_BUDGET"),
+			},
+			&cli.StringFlag{
+				Name:    "smtp-tls-mode",
+				Usage:   "SMTP: TLS mode: off, starttls, starttls-required or implicit (STARTTLS plus implicit TLS on --smtp-tls-listen)",
+				Value:   SMTPTLSModeOff,
+				Sources: cli.EnvVars("ST_SMTP_TLS_MODE"),
+			},
+			&cli.StringFlag{
+				Name:    "smtp-tls-cert",
+				Usage:   "SMTP: path to the TLS certificate chain in PEM format. Reloaded when it changes",
+				Sources: cli.EnvVars("ST_SMTP_TLS_CERT"),
+			},
+			&cli.StringFlag{
+				Name:    "smtp-tls-key",
+				Usage:   "SMTP: path to the TLS private key in PEM format. Reloaded when it changes",
+				Sources: cli.EnvVars("ST_SMTP_TLS_KEY"),
+			},
+			&cli.StringFlag{
+				Name:    "smtp-tls-min-version",
+				Usage:   "SMTP: minimum TLS version: tls1.0, tls1.1, tls1.2 or tls1.3",
+				Value:   "tls1.2",
+				Sources: cli.EnvVars("ST_SMTP_TLS_MIN_VERSION"),
+			},
+			&cli.StringFlag{
+				Name:    "smtp-tls-listen",
+				Usage:   "SMTP: TCP address to listen to with implicit TLS in the implicit mode",
+				Value:   "127.0.0.1:4650",
+				Sources: cli.EnvVars("ST_SMTP_TLS_LISTEN"),
+			},
 			&cli.StringFlag{
 				Name:    "blacklist-file",
 				Usage:   "DEPRECATED: Use --config-file instead",
@@ -274,24 +525,41 @@ func main() {
 				Usage:   "Path to YAML configuration file",
 				Sources: cli.EnvVars("ST_CONFIG_FILE"),
 			},
+			&cli.BoolFlag{
+				Name: "config-watch",
+				Usage: "Reload the config file when it changes. It is always reloaded on SIGHUP. " +
+					"Only filter rules, routes, client access and SMTP users are reloaded",
+				Sources: cli.EnvVars("ST_CONFIG_WATCH"),
+			},
 			&cli.StringFlag{
-				Name:     "telegram-chat-ids",
-				Usage:    "Telegram: comma-separated list of chat ids",
-				Sources:  cli.EnvVars("ST_TELEGRAM_CHAT_IDS"),
-				Required: true,
+				Name:    "telegram-chat-ids",
+				Usage:   "Telegram: comma-separated list of chat ids. Use chatID:threadID to post into a forum topic",
+				Sources: cli.EnvVars("ST_TELEGRAM_CHAT_IDS"),
 			},
 			&cli.StringFlag{
-				Name:     "telegram-bot-token",
-				Usage:    "Telegram: bot token",
-				Sources:  cli.EnvVars("ST_TELEGRAM_BOT_TOKEN"),
-				Required: true,
+				Name:    "telegram-bot-token",
+				Usage:   "Telegram: bot token",
+				Sources: cli.EnvVars("ST_TELEGRAM_BOT_TOKEN"),
 			},
 			&cli.StringFlag{
 				Name:    "telegram-api-prefix",
 				Usage:   "Telegram: API url prefix",
-				Value:   "https://api.telegram.org/",
+				Value:   telegramCloudAPIPrefix,
 				Sources: cli.EnvVars("ST_TELEGRAM_API_PREFIX"),
 			},
+			&cli.BoolFlag{
+				Name: "telegram-local-mode",
+				Usage: "Telegram: telegram-api-prefix is a local Bot API server " +
+					"started with --local, which accepts attachments up to 2000m",
+				Sources: cli.EnvVars("ST_TELEGRAM_LOCAL_MODE"),
+			},
+			&cli.StringFlag{
+				Name: "telegram-local-file-dir",
+				Usage: "Telegram: directory shared with the local Bot API server. " +
+					"Attachments are written there and sent by their file:// path " +
+					"instead of being uploaded",
+				Sources: cli.EnvVars("ST_TELEGRAM_LOCAL_FILE_DIR"),
+			},
 			&cli.Float64Flag{
 				Name:    "telegram-api-timeout-seconds",
 				Usage:   "HTTP timeout used for requests to the Telegram API",
@@ -302,7 +570,8 @@ func main() {
 				Name: "forwarded-attachment-max-size",
 				Usage: "Max size of an attachment to be forwarded to telegram. " +
 					"0 -- disable forwarding. Examples: 5k, 10m. " +
-					"Telegram API has a 50m limit on their side.",
+					"Telegram API has a 50m limit on their side (2000m in " +
+					"--telegram-local-mode), larger values are lowered to it.",
 				Value:   "10m",
 				Sources: cli.EnvVars("ST_FORWARDED_ATTACHMENT_MAX_SIZE"),
 			},
@@ -310,10 +579,43 @@ func main() {
 				Name: "forwarded-attachment-max-photo-size",
 				Usage: "Max size of a photo attachment to be forwarded to telegram. " +
 					"0 -- disable forwarding. Examples: 5k, 10m. " +
-					"Telegram API has a 10m limit on their side.",
+					"Telegram API has a 10m limit on their side, larger values " +
+					"are lowered to it.",
 				Value:   "10m",
 				Sources: cli.EnvVars("ST_FORWARDED_ATTACHMENT_MAX_PHOTO_SIZE"),
 			},
+			&cli.StringFlag{
+				Name: "forwarded-attachment-max-animation-size",
+				Usage: "Max size of a GIF or silent MP4 attachment to be forwarded " +
+					"to telegram as an animation. Larger ones are sent as documents. " +
+					"0 -- disable. Examples: 5k, 10m.",
+				Value:   "10m",
+				Sources: cli.EnvVars("ST_FORWARDED_ATTACHMENT_MAX_ANIMATION_SIZE"),
+			},
+			&cli.StringFlag{
+				Name: "forwarded-attachment-max-video-size",
+				Usage: "Max size of an MP4 attachment to be forwarded to telegram " +
+					"as a video. Larger ones are sent as documents. " +
+					"0 -- disable. Examples: 5k, 10m.",
+				Value:   "10m",
+				Sources: cli.EnvVars("ST_FORWARDED_ATTACHMENT_MAX_VIDEO_SIZE"),
+			},
+			&cli.StringFlag{
+				Name: "forwarded-attachment-max-audio-size",
+				Usage: "Max size of an MP3 or M4A attachment to be forwarded to " +
+					"telegram as audio. Larger ones are sent as documents. " +
+					"0 -- disable. Examples: 5k, 10m.",
+				Value:   "10m",
+				Sources: cli.EnvVars("ST_FORWARDED_ATTACHMENT_MAX_AUDIO_SIZE"),
+			},
+			&cli.StringFlag{
+				Name: "forwarded-attachment-max-voice-size",
+				Usage: "Max size of an OGG or Opus attachment to be forwarded to " +
+					"telegram as a voice message. Larger ones are sent as documents. " +
+					"0 -- disable. Examples: 5k, 10m.",
+				Value:   "10m",
+				Sources: cli.EnvVars("ST_FORWARDED_ATTACHMENT_MAX_VOICE_SIZE"),
+			},
 			&cli.BoolFlag{
 				Name: "forwarded-attachment-respect-errors",
 				Usage: "Reject the whole email if some attachments " +
@@ -330,6 +632,43 @@ func main() {
 				Value:   4095,
 				Sources: cli.EnvVars("ST_MESSAGE_LENGTH_TO_SEND_AS_FILE"),
 			},
+			&cli.StringFlag{
+				Name: "message-format",
+				Usage: "Telegram message format: text or html. In html mode the HTML body " +
+					"of an email is sent with bold text, links and other formatting preserved",
+				Value:   MessageFormatText,
+				Sources: cli.EnvVars("ST_MESSAGE_FORMAT"),
+			},
+			&cli.StringFlag{
+				Name:    "http-listen",
+				Usage:   "TCP address to serve /metrics, /healthz and /readyz on (disabled when empty)",
+				Sources: cli.EnvVars("ST_HTTP_LISTEN"),
+			},
+			&cli.StringFlag{
+				Name: "message-store",
+				Usage: "Path to a database file remembering which email each forwarded " +
+					"message came from, so replies don't depend on the message text",
+				Sources: cli.EnvVars("ST_MESSAGE_STORE"),
+			},
+			&cli.DurationFlag{
+				Name:    "message-store-retention",
+				Usage:   "How long to remember forwarded messages (0 keeps them forever)",
+				Value:   90 * 24 * time.Hour,
+				Sources: cli.EnvVars("ST_MESSAGE_STORE_RETENTION"),
+			},
+			&cli.StringFlag{
+				Name: "spool-dir",
+				Usage: "Directory to keep emails which could not be delivered to Telegram. " +
+					"When set, such emails are accepted and retried in the background " +
+					"instead of being rejected.",
+				Sources: cli.EnvVars("ST_SPOOL_DIR"),
+			},
+			&cli.DurationFlag{
+				Name:    "spool-max-age",
+				Usage:   "How long to retry a spooled email before moving it to the dead-letter folder",
+				Value:   24 * time.Hour,
+				Sources: cli.EnvVars("ST_SPOOL_MAX_AGE"),
+			},
 			&cli.StringFlag{
 				Name:    "smtp-out-host",
 				Usage:   "Outbound SMTP server host for reply-to-email feature",
@@ -351,6 +690,36 @@ func main() {
 				Usage:   "Outbound SMTP server password",
 				Sources: cli.EnvVars("ST_SMTP_OUT_PASSWORD"),
 			},
+			&cli.StringFlag{
+				Name: "reply-attachment-max-size",
+				Usage: "Max size of a file from a Telegram reply to be attached to the email. " +
+					"0 -- disable attachments. Examples: 5k, 10m. " +
+					"Telegram API can't download files larger than 20m.",
+				Value:   "20m",
+				Sources: cli.EnvVars("ST_REPLY_ATTACHMENT_MAX_SIZE"),
+			},
+			&cli.StringFlag{
+				Name:    "telegram-update-mode",
+				Usage:   "How replies are received from Telegram: \"polling\" (getUpdates) or \"webhook\" (setWebhook)",
+				Value:   UpdateModePolling,
+				Sources: cli.EnvVars("ST_TELEGRAM_UPDATE_MODE"),
+			},
+			&cli.StringFlag{
+				Name:    "telegram-webhook-url",
+				Usage:   "Public HTTPS URL Telegram sends updates to in webhook mode",
+				Sources: cli.EnvVars("ST_TELEGRAM_WEBHOOK_URL"),
+			},
+			&cli.StringFlag{
+				Name:    "telegram-webhook-listen",
+				Usage:   "TCP address serving the webhook; put it behind a TLS-terminating proxy",
+				Value:   "127.0.0.1:8443",
+				Sources: cli.EnvVars("ST_TELEGRAM_WEBHOOK_LISTEN"),
+			},
+			&cli.StringFlag{
+				Name:    "telegram-webhook-secret",
+				Usage:   "Secret token expected in X-Telegram-Bot-Api-Secret-Token. Random if not set",
+				Sources: cli.EnvVars("ST_TELEGRAM_WEBHOOK_SECRET"),
+			},
 		},
 	}
 	err := cmd.Run(context.Background(), os.Args)
@@ -360,194 +729,210 @@ func main() {
 	}
 }
 
-func getAllowedHosts(smtpConfig *SMTPConfig) []string {
-	allowedHosts := strings.Split(smtpConfig.AllowedHosts, ",")
-
-	if len(allowedHosts) == 1 && allowedHosts[0] == "" {
-		allowedHosts[0] = "."
+// requireTelegramFlags checks the flags needed to send to Telegram. They aren't
+// marked as required, which would apply to every subcommand too.
+func requireTelegramFlags(cmd *cli.Command) error {
+	for _, name := range []string{"telegram-chat-ids", "telegram-bot-token"} {
+		if cmd.String(name) == "" {
+			return fmt.Errorf("%w: %q", errRequiredFlag, name)
+		}
 	}
-
-	return allowedHosts
+	return nil
 }
 
-func loadConfig(filename string) (*SMTPOutConfig, error) {
-	filterRules = nil
-
-	if filename == "" {
-		return nil, nil
-	}
-
-	data, err := os.ReadFile(filename) //nolint:gosec // User-specified config file path is intentional
+// newTelegramConfig returns the Telegram settings of the command line flags.
+func newTelegramConfig(cmd *cli.Command) (*TelegramConfig, error) {
+	forwardedAttachmentMaxSize, err := units.FromHumanSize(cmd.String("forwarded-attachment-max-size"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, err
 	}
-
-	var config AppConfig
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config YAML: %w", err)
+	forwardedAttachmentMaxPhotoSize, err := units.FromHumanSize(cmd.String("forwarded-attachment-max-photo-size"))
+	if err != nil {
+		return nil, err
 	}
-
-	// Compile regex patterns
-	for i := range config.FilterRules {
-		rule := &config.FilterRules[i]
-		// Default match to "all" if not specified
-		if rule.Match == "" {
-			rule.Match = "all"
-		}
-		if rule.Match != "all" && rule.Match != "any" {
-			return nil, fmt.Errorf("rule '%s': %w '%s' (must be 'all' or 'any')", rule.Name, errInvalidMatchType, rule.Match)
-		}
-		for j := range rule.Conditions {
-			cond := &rule.Conditions[j]
-			if !isValidFilterField(cond.Field) {
-				return nil, fmt.Errorf("rule '%s': %w '%s' (must be one of: from, to, subject, body, html, body_or_html)", rule.Name, errInvalidField, cond.Field)
-			}
-			// Make pattern case-insensitive
-			pattern := cond.Pattern
-			if !strings.HasPrefix(pattern, "(?i)") {
-				pattern = "(?i)" + pattern
-			}
-			compiled, err := regexp.Compile(pattern)
-			if err != nil {
-				return nil, fmt.Errorf("rule '%s': invalid regex pattern '%s': %w", rule.Name, cond.Pattern, err)
-			}
-			cond.regex = compiled
+	var mediaSizes [4]int64
+	for i, name := range []string{"animation", "video", "audio", "voice"} {
+		mediaSizes[i], err = units.FromHumanSize(cmd.String("forwarded-attachment-max-" + name + "-size"))
+		if err != nil {
+			return nil, err
 		}
 	}
-
-	filterRules = config.FilterRules
-
-	if logger != nil {
-		logger.Infof("Loaded %d filter rules from %s", len(filterRules), filename)
+	telegramConfig := &TelegramConfig{
+		ChatIDs:                             cmd.String("telegram-chat-ids"),
+		BotToken:                            cmd.String("telegram-bot-token"),
+		APIPrefix:                           cmd.String("telegram-api-prefix"),
+		APITimeoutSeconds:                   cmd.Float64("telegram-api-timeout-seconds"),
+		ForwardedAttachmentMaxSize:          int(forwardedAttachmentMaxSize),
+		ForwardedAttachmentMaxPhotoSize:     int(forwardedAttachmentMaxPhotoSize),
+		ForwardedAttachmentMaxAnimationSize: int(mediaSizes[0]),
+		ForwardedAttachmentMaxVideoSize:     int(mediaSizes[1]),
+		ForwardedAttachmentMaxAudioSize:     int(mediaSizes[2]),
+		ForwardedAttachmentMaxVoiceSize:     int(mediaSizes[3]),
+		ForwardedAttachmentRespectErrors:    cmd.Bool("forwarded-attachment-respect-errors"),
+		MessageLengthToSendAsFile:           cmd.Uint("message-length-to-send-as-file"),
+		MessageFormat:                       cmd.String("message-format"),
+		LocalMode:                           cmd.Bool("telegram-local-mode"),
+		LocalFileDir:                        cmd.String("telegram-local-file-dir"),
 	}
-
-	yamlSMTPOut := &SMTPOutConfig{
-		Host:     config.SMTPOut.Host,
-		Port:     config.SMTPOut.Port,
-		Username: config.SMTPOut.Username,
-		Password: config.SMTPOut.Password,
+	if err := telegramConfig.validateLocalMode(); err != nil {
+		return nil, err
 	}
-
-	return yamlSMTPOut, nil
+	if telegramConfig.MessageFormat != MessageFormatText && telegramConfig.MessageFormat != MessageFormatHTML {
+		return nil, fmt.Errorf("%w: %q, expected %q or %q", errInvalidMessageFormat,
+			telegramConfig.MessageFormat, MessageFormatText, MessageFormatHTML)
+	}
+	return telegramConfig, nil
 }
 
-func isValidFilterField(field string) bool {
-	switch field {
-	case "from", "to", "subject", "body", "html", "body_or_html":
-		return true
-	default:
-		return false
+func getAllowedHosts(smtpConfig *SMTPConfig) []string {
+	allowedHosts := strings.Split(smtpConfig.AllowedHosts, ",")
+
+	if len(allowedHosts) == 1 && allowedHosts[0] == "" {
+		allowedHosts[0] = "."
 	}
+
+	return allowedHosts
 }
 
-func checkFilterRules(from, to, subject, body, html string) (rejected bool, ruleName string) {
-	if filterRules == nil {
-		return false, ""
+// loadConfig reads the config file and activates its rules.
+func loadConfig(filename string) (*AppConfig, error) {
+	activeRules.Store(nil)
+	config, rules, err := readConfig(filename)
+	if err != nil || config == nil {
+		return nil, err
 	}
+	activeRules.Store(rules)
 
-	for _, rule := range filterRules {
-		if evaluateRule(&rule, from, to, subject, body, html) {
-			return true, rule.Name
-		}
+	if logger != nil {
+		logger.Infof("Loaded %d filter rules and %d routes from %s", len(rules.FilterRules), len(rules.Routing.Routes), filename)
 	}
 
-	return false, ""
+	return config, nil
 }
 
-func evaluateRule(rule *FilterRule, from, to, subject, body, html string) bool {
-	if len(rule.Conditions) == 0 {
-		return false
+// readConfig reads and validates the config file without activating it.
+func readConfig(filename string) (*AppConfig, *Rules, error) {
+	if filename == "" {
+		return nil, nil, nil
 	}
 
-	if rule.Match == "any" {
-		// OR logic: at least one condition must match
-		for _, cond := range rule.Conditions {
-			if evaluateCondition(&cond, from, to, subject, body, html) {
-				return true
-			}
-		}
-		return false
+	data, err := os.ReadFile(filename) //nolint:gosec // User-specified config file path is intentional
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	// Default: "all" - AND logic: all conditions must match
-	for _, cond := range rule.Conditions {
-		if !evaluateCondition(&cond, from, to, subject, body, html) {
-			return false
-		}
+	var config AppConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config YAML: %w", err)
 	}
-	return true
-}
 
-func evaluateCondition(cond *FilterCondition, from, to, subject, body, html string) bool {
-	var value string
-	switch cond.Field {
-	case "from":
-		value = from
-	case "to":
-		value = to
-	case "subject":
-		value = subject
-	case "body":
-		value = body
-	case "html":
-		value = html
-	case "body_or_html":
-		// Match if pattern found in either body OR html
-		return cond.regex.MatchString(body) || cond.regex.MatchString(html)
-	default:
-		return false
+	if err := compileFilterRules(config.FilterRules); err != nil {
+		return nil, nil, err
+	}
+	if err := compileRoutes(config.Routes); err != nil {
+		return nil, nil, err
+	}
+	if err := validateChatIDs(config.DefaultChatIDs); err != nil {
+		return nil, nil, fmt.Errorf("default_chat_ids: %w", err)
+	}
+	auth, err := NewSMTPAuth(&config.SMTPAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+	access, err := NewClientAccess(&config.ClientAccess)
+	if err != nil {
+		return nil, nil, err
+	}
+	rules, err := newRules(&config, access, auth)
+	if err != nil {
+		return nil, nil, err
 	}
-	return cond.regex.MatchString(value)
+	return &config, rules, nil
 }
 
 func SMTPStart(
 	smtpConfig *SMTPConfig,
 	telegramConfig *TelegramConfig,
-) (guerrilla.Daemon, error) {
-
-	cfg := &guerrilla.AppConfig{LogFile: log.OutputStdout.String()}
-
-	cfg.AllowedHosts = getAllowedHosts(smtpConfig)
-
-	sc := guerrilla.ServerConfig{
-		IsEnabled:       true,
-		ListenInterface: smtpConfig.Listen,
-		MaxSize:         smtpConfig.MaxEnvelopeSize,
+	spool *Spool,
+	store *MessageStore,
+) (*SMTPServer, error) {
+	var err error
+	logger, err = log.GetLogger(log.OutputStdout.String(), log.InfoLevel.String())
+	if err != nil {
+		return nil, err
 	}
-	cfg.Servers = append(cfg.Servers, sc)
 
-	bcfg := backends.BackendConfig{
+	// https://github.com/phires/go-guerrilla/wiki/Backends,-configuring-and-extending
+	backends.Svc.AddProcessor("TelegramBot", TelegramBotProcessorFactory(telegramConfig, spool, store))
+	backends.Svc.AddProcessor("ClientAccess", ClientAccessProcessorFactory())
+	backend, err := backends.New(backends.BackendConfig{
 		"save_workers_size":  3,
-		"save_process":       "HeadersParser|Header|Hasher|TelegramBot",
+		"save_process":       "ClientAccess|HeadersParser|Header|Hasher|TelegramBot",
 		"log_received_mails": true,
 		"primary_mail_host":  smtpConfig.PrimaryHost,
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := backend.Start(); err != nil {
+		return nil, err
 	}
-	cfg.BackendConfig = bcfg
-
-	daemon := guerrilla.Daemon{Config: cfg}
-	daemon.AddProcessor("TelegramBot", TelegramBotProcessorFactory(telegramConfig))
-
-	logger = daemon.Log()
 
-	err := daemon.Start()
-	return daemon, err
+	srv, err := NewSMTPServer(smtpConfig, backend)
+	if err == nil {
+		err = srv.Listen(smtpConfig.Listen, false)
+	}
+	if err == nil && smtpConfig.TLS.Mode == SMTPTLSModeImplicit {
+		err = srv.Listen(smtpConfig.TLS.Listen, true)
+	}
+	if err != nil {
+		if srv != nil {
+			srv.Shutdown()
+		} else {
+			_ = backend.Shutdown()
+		}
+		return nil, err
+	}
+	health.smtpListening.Store(true)
+	return srv, nil
 }
 
 func TelegramBotProcessorFactory(
 	telegramConfig *TelegramConfig,
+	spool *Spool,
+	store *MessageStore,
 ) func() backends.Decorator {
 	return func() backends.Decorator {
-		// https://github.com/phires/go-guerrilla/wiki/Backends,-configuring-and-extending
-
 		return func(p backends.Processor) backends.Processor {
 			return backends.ProcessWith(
 				func(envelope *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
 					if task == backends.TaskSaveMail {
-						err := SendEmailToTelegram(envelope, telegramConfig)
+						metricEmailsReceived.Inc()
+						metricEmailSize.Observe(float64(envelope.Data.Len()))
+						sent, err := SendEmailToTelegram(envelope, telegramConfig, store, nil)
+						// Telegram being unavailable is a temporary condition: keep
+						// the email for a retry rather than bouncing it.
+						if err != nil && spool != nil && errors.Is(err, errSanitizedTelegramFail) {
+							if spoolErr := spool.Enqueue(envelope, sent, err); spoolErr != nil {
+								logger.Errorf("Failed to spool email: %s", spoolErr)
+							} else {
+								err = nil
+							}
+						}
 						if err != nil {
+							if !errors.Is(err, errRejectedByFilter) {
+								metricEmailsFailed.Inc()
+							}
 							return backends.NewResult(fmt.Sprintf("554 Error: %s", err)), err
 						}
-						return p.Process(envelope, task)
+						result, err := p.Process(envelope, task)
+						if err != nil || result != backends.BackendResultOK || len(sent) == 0 ||
+							!reportsSentMessages(envelope) {
+							return result, err
+						}
+						// Report the Telegram messages to the client, e.g. send-test.
+						return backends.NewResult(response.Canned.SuccessMessageQueued, response.SP,
+							envelope.QueuedId, "; ", describeSentMessages(sent)), nil
 					}
 					return p.Process(envelope, task)
 				},
@@ -556,50 +941,148 @@ func TelegramBotProcessorFactory(
 	}
 }
 
+// reportsSentMessages reports whether the client of the envelope is told the
+// Telegram messages, and so the chat IDs, its email became: only local and
+// authenticated clients are.
+func reportsSentMessages(envelope *mail.Envelope) bool {
+	if authUser(envelope) != "" {
+		return true
+	}
+	ip := net.ParseIP(envelope.RemoteIP)
+	return ip != nil && ip.IsLoopback()
+}
+
+// SendEmailToTelegram forwards an email to the chats it is routed to, but the
+// ones it was already delivered to, and returns the Telegram messages it was
+// sent as, none if a filter rule discarded it. On failure, it also returns the
+// messages sent so far, with AttachmentsPending set for the chat whose
+// attachments failed. A chat delivered with AttachmentsPending only gets the
+// attachments, in reply to the message sent earlier.
 func SendEmailToTelegram(
 	envelope *mail.Envelope,
 	telegramConfig *TelegramConfig,
-) error {
-	message, err := FormatEmail(envelope, telegramConfig)
+	store *MessageStore,
+	delivered []SentMessage,
+) ([]SentMessage, error) {
+	message, err := FormatEmail(envelope, telegramConfig, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if rejected, ruleName := checkFilterRules(message.From, message.To, message.Subject, message.Text, message.HTML); rejected {
-		logger.Infof("Rejecting email: matched filter rule '%s'", ruleName)
-		return fmt.Errorf("%w: %s", errRejectedByFilter, ruleName)
+	decision := checkFilterRules(newFilterInput(message, envelope))
+	switch decision.Action {
+	case FilterActionReject:
+		logger.Infof("Rejecting email: matched filter rule '%s'", decision.RuleName)
+		metricEmailsRejected.Inc("filter_rule", decision.RuleName)
+		return nil, fmt.Errorf("%w: %s", errRejectedByFilter, decision.RuleName)
+	case FilterActionDiscard:
+		logger.Infof("Discarding email: matched filter rule '%s'", decision.RuleName)
+		metricEmailsDiscarded.Inc(decision.RuleName)
+		return nil, nil
+	}
+	if len(decision.Matched) > 0 {
+		logger.Infof("Forwarding email: matched filter rules %s", strings.Join(decision.Matched, ", "))
+	}
+	if len(decision.Tags) > 0 {
+		// The tags count towards the length of the message, format it again.
+		message, err = FormatEmail(envelope, telegramConfig, decision.Tags)
+		if err != nil {
+			return nil, err
+		}
+	}
+	message.Silent = decision.Silent
+	chatIDs := currentRules().Routing.ResolveChatIDs(envelope.RcptTo, authUser(envelope), telegramConfig.ChatIDs)
+	if decision.ChatIDs != nil {
+		chatIDs = decision.ChatIDs
 	}
 
 	client := http.Client{
 		Timeout: time.Duration(telegramConfig.APITimeoutSeconds * float64(time.Second)),
 	}
 
-	ctx := context.Background()
-	for chatID := range strings.SplitSeq(telegramConfig.ChatIDs, ",") {
-		sentMessage, err := SendMessageToChat(ctx, message, chatID, telegramConfig, &client)
+	ctx, cancel := context.WithTimeout(context.Background(), telegramEmailTimeout)
+	defer cancel()
+	var sent []SentMessage
+	// Attachments are uploaded to the first chat only, the others get them by
+	// the file_id Telegram assigned.
+	fileIDs := make(map[*FormattedAttachment]string)
+	if telegramConfig.LocalFileDir != "" {
+		defer writeLocalFiles(telegramConfig.LocalFileDir, message.Attachments, fileIDs)()
+	}
+	for _, chatID := range chatIDs {
+		target, err := ParseChatTarget(chatID)
 		if err != nil {
-			// If unable to send at least one message -- reject the whole email.
-			return fmt.Errorf("%w: %s", errSanitizedTelegramFail, SanitizeBotToken(err.Error(), telegramConfig.BotToken))
+			return sent, err
 		}
-
-		for _, attachment := range message.Attachments {
-			err = SendAttachmentToChat(ctx, attachment, chatID, telegramConfig, &client, sentMessage)
+		var sentMessage *TelegramAPIMessage
+		i := slices.IndexFunc(delivered, func(m SentMessage) bool { return m.Chat == target })
+		switch {
+		case i >= 0 && !delivered[i].AttachmentsPending:
+			continue
+		case i >= 0:
+			sentMessage = &TelegramAPIMessage{MessageID: delivered[i].MessageID}
+		default:
+			sentMessage, err = SendMessageToChat(ctx, message, target, telegramConfig, &client)
 			if err != nil {
-				sanitizedErr := fmt.Errorf("%w: %s", errSanitizedTelegramFail, SanitizeBotToken(err.Error(), telegramConfig.BotToken))
-				if telegramConfig.ForwardedAttachmentRespectErrors {
-					return sanitizedErr
-				}
-				logger.Errorf("Ignoring attachment sending error: %s", sanitizedErr)
+				// If unable to send at least one message -- reject the whole email.
+				return sent, fmt.Errorf("%w: %s", errSanitizedTelegramFail, SanitizeBotToken(err.Error(), telegramConfig.BotToken))
 			}
+			store.rememberMessage(target.ChatID, sentMessage, message)
+		}
+
+		if err := sendAttachments(ctx, message.Attachments, fileIDs, target, telegramConfig, &client, sentMessage); err != nil {
+			// A retry must not send the message to this chat again.
+			return append(sent, SentMessage{Chat: target, MessageID: sentMessage.MessageID, AttachmentsPending: true}), err
 		}
+		sent = append(sent, SentMessage{Chat: target, MessageID: sentMessage.MessageID})
 	}
-	return nil
+	metricEmailsForwarded.Inc()
+	return sent, nil
+}
+
+// sendAttachment sends an attachment by the file_id of an earlier upload, if
+// any, and uploads it if Telegram rejects the file_id. It returns the file_id
+// of the sent attachment.
+func sendAttachment(
+	ctx context.Context,
+	attachment *FormattedAttachment,
+	fileID string,
+	target ChatTarget,
+	telegramConfig *TelegramConfig,
+	client *http.Client,
+	sentMessage *TelegramAPIMessage,
+) (string, error) {
+	if fileID != "" {
+		sentAttachment, err := SendAttachmentToChat(ctx, attachment, fileID, target, telegramConfig, client, sentMessage)
+		if err == nil {
+			// The file_id of a file:// path is only known now.
+			if sentFileID := sentAttachment.fileID(); sentFileID != "" {
+				return sentFileID, nil
+			}
+			return fileID, nil
+		}
+		logger.Warningf("Failed to send attachment %s by file_id, uploading it: %s",
+			attachment.Filename, SanitizeBotToken(err.Error(), telegramConfig.BotToken))
+	}
+	sentAttachment, err := SendAttachmentToChat(ctx, attachment, "", target, telegramConfig, client, sentMessage)
+	if err != nil && attachment.FileType != AttachmentTypeDocument && attachment.FileType != AttachmentTypePhoto &&
+		len(attachment.Content) <= telegramConfig.ForwardedAttachmentMaxSize {
+		logger.Warningf("Failed to send attachment %s as media, sending it as a document: %s",
+			attachment.Filename, SanitizeBotToken(err.Error(), telegramConfig.BotToken))
+		// The other chats get it as a document right away.
+		attachment.FileType = AttachmentTypeDocument
+		sentAttachment, err = SendAttachmentToChat(ctx, attachment, "", target, telegramConfig, client, sentMessage)
+	}
+	if err != nil {
+		return "", err
+	}
+	return sentAttachment.fileID(), nil
 }
 
 func SendMessageToChat(
 	ctx context.Context,
 	message *FormattedEmail,
-	chatID string,
+	target ChatTarget,
 	telegramConfig *TelegramConfig,
 	client *http.Client,
 ) (*TelegramAPIMessage, error) {
@@ -613,19 +1096,40 @@ func SendMessageToChat(
 		telegramConfig.APIPrefix,
 		telegramConfig.BotToken,
 	)
-	formData := url.Values{"chat_id": {chatID}, "text": {message.Text}}
+	formData := target.formValues()
+	formData.Set("text", message.Text)
+	if message.Silent {
+		formData.Set("disable_notification", "true")
+	}
+	if message.ParseMode != "" {
+		formData.Set("parse_mode", message.ParseMode)
+	}
 	if telegramConfig.ForceReply {
 		formData.Set("reply_markup", `{"force_reply":true,"selective":true}`)
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, strings.NewReader(formData.Encode()))
+	resp, err := telegramSender.Do(ctx, client, target.ChatID,
+		newFormRequest(ctx, apiURL, "application/x-www-form-urlencoded", []byte(formData.Encode())))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := client.Do(req)
+	j, err := readTelegramResponse(resp)
 	if err != nil {
 		return nil, err
 	}
+	result := &TelegramAPIMessageResult{}
+	err = json.Unmarshal(j, result)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errParsingJSON, err)
+	}
+	if !result.Ok {
+		return nil, fmt.Errorf("%w: %s", errResponseNotOK, j)
+	}
+	return result.Result, nil
+}
+
+// readTelegramResponse returns the body of a Telegram API response, which must
+// have the status 200.
+func readTelegramResponse(resp *http.Response) ([]byte, error) {
 	defer func() {
 		if closeErr := resp.Body.Close(); closeErr != nil {
 			logger.Warningf("Failed to close response body: %v", closeErr)
@@ -648,23 +1152,17 @@ func SendMessageToChat(
 	if err != nil {
 		return nil, fmt.Errorf("%w: %w", errReadingJSON, err)
 	}
-	result := &TelegramAPIMessageResult{}
-	err = json.Unmarshal(j, result)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %w", errParsingJSON, err)
-	}
-	if !result.Ok {
-		return nil, fmt.Errorf("%w: %s", errResponseNotOK, j)
-	}
-	return result.Result, nil
+	return j, nil
 }
 
+// buildAttachmentForm returns the method and the form writer to send an
+// attachment, by fileID if it isn't empty or else with its content.
 func buildAttachmentForm(
-	w *multipart.Writer,
 	attachment *FormattedAttachment,
-	chatID string,
+	fileID string,
+	target ChatTarget,
 	sentMessage *TelegramAPIMessage,
-) (string, error) {
+) (string, func(w *multipart.Writer) error, error) {
 	// https://core.telegram.org/bots/api#sending-files
 	var method, fileFieldName string
 	switch attachment.FileType {
@@ -676,50 +1174,75 @@ func buildAttachmentForm(
 		// https://core.telegram.org/bots/api#sendphoto
 		method = "sendPhoto"
 		fileFieldName = "photo"
+	case AttachmentTypeAnimation:
+		// https://core.telegram.org/bots/api#sendanimation
+		method = "sendAnimation"
+		fileFieldName = "animation"
+	case AttachmentTypeVideo:
+		// https://core.telegram.org/bots/api#sendvideo
+		method = "sendVideo"
+		fileFieldName = "video"
+	case AttachmentTypeAudio:
+		// https://core.telegram.org/bots/api#sendaudio
+		method = "sendAudio"
+		fileFieldName = "audio"
+	case AttachmentTypeVoice:
+		// https://core.telegram.org/bots/api#sendvoice
+		method = "sendVoice"
+		fileFieldName = "voice"
 	default:
-		return "", fmt.Errorf("%w: %d", errUnknownFileType, attachment.FileType)
+		return "", nil, fmt.Errorf("%w: %d", errUnknownFileType, attachment.FileType)
 	}
 
-	if err := w.WriteField("chat_id", chatID); err != nil {
-		return "", fmt.Errorf("failed to write chat_id: %w", err)
-	}
-	if err := w.WriteField("reply_to_message_id", sentMessage.MessageID.String()); err != nil {
-		return "", fmt.Errorf("failed to write reply_to_message_id: %w", err)
-	}
-	if err := w.WriteField("caption", attachment.Caption); err != nil {
-		return "", fmt.Errorf("failed to write caption: %w", err)
-	}
+	targetValues := target.formValues()
+	replyToMessageID := sentMessage.MessageID.String()
+	caption, filename, content := attachment.Caption, attachment.Filename, attachment.Content
+	writeForm := func(w *multipart.Writer) error {
+		for key, values := range targetValues {
+			if err := w.WriteField(key, values[0]); err != nil {
+				return fmt.Errorf("failed to write %s: %w", key, err)
+			}
+		}
+		if err := w.WriteField("reply_to_message_id", replyToMessageID); err != nil {
+			return fmt.Errorf("failed to write reply_to_message_id: %w", err)
+		}
+		if err := w.WriteField("caption", caption); err != nil {
+			return fmt.Errorf("failed to write caption: %w", err)
+		}
 
-	// TODO maybe reuse files sent to multiple chats via file_id?
-	fileWriter, err := w.CreateFormFile(fileFieldName, attachment.Filename)
-	if err != nil {
-		return "", fmt.Errorf("failed to create form file: %w", err)
-	}
-	if _, err := fileWriter.Write(attachment.Content); err != nil {
-		return "", fmt.Errorf("failed to write file content: %w", err)
+		if fileID != "" {
+			if err := w.WriteField(fileFieldName, fileID); err != nil {
+				return fmt.Errorf("failed to write %s: %w", fileFieldName, err)
+			}
+			return nil
+		}
+		fileWriter, err := w.CreateFormFile(fileFieldName, filename)
+		if err != nil {
+			return fmt.Errorf("failed to create form file: %w", err)
+		}
+		if _, err := fileWriter.Write(content); err != nil {
+			return fmt.Errorf("failed to write file content: %w", err)
+		}
+		return nil
 	}
 
-	return method, nil
+	return method, writeForm, nil
 }
 
+// SendAttachmentToChat sends an attachment in reply to the message, uploading
+// it unless a fileID is given.
 func SendAttachmentToChat(
 	ctx context.Context,
 	attachment *FormattedAttachment,
-	chatID string,
+	fileID string,
+	target ChatTarget,
 	telegramConfig *TelegramConfig,
 	client *http.Client,
 	sentMessage *TelegramAPIMessage,
-) error {
-	buf := new(bytes.Buffer)
-	w := multipart.NewWriter(buf)
-
-	method, err := buildAttachmentForm(w, attachment, chatID, sentMessage)
+) (*TelegramAPIMessage, error) {
+	method, writeForm, err := buildAttachmentForm(attachment, fileID, target, sentMessage)
 	if err != nil {
-		return err
-	}
-
-	if err = w.Close(); err != nil {
-		return fmt.Errorf("failed to close multipart writer: %w", err)
+		return nil, err
 	}
 
 	apiURL := fmt.Sprintf(
@@ -728,36 +1251,27 @@ func SendAttachmentToChat(
 		telegramConfig.BotToken,
 		method,
 	)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, buf)
+	resp, err := telegramSender.Do(ctx, client, target.ChatID, newMultipartRequest(ctx, apiURL, writeForm))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	resp, err := client.Do(req)
+	j, err := readTelegramResponse(resp)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func() {
-		if closeErr := resp.Body.Close(); closeErr != nil {
-			logger.Warningf("Failed to close response body: %v", closeErr)
-		}
-	}()
-	if resp.StatusCode != 200 {
-		body, readErr := io.ReadAll(resp.Body)
-		if readErr != nil {
-			logger.Warningf("Failed to read error response body: %v", readErr)
-		}
-		return fmt.Errorf(
-			"%w: (%d) %s",
-			errTelegramNon200,
-			resp.StatusCode,
-			EscapeMultiLine(body),
-		)
+	result := &TelegramAPIMessageResult{}
+	if err := json.Unmarshal(j, result); err != nil {
+		return nil, fmt.Errorf("%w: %w", errParsingJSON, err)
 	}
-	return nil
+	if !result.Ok || result.Result == nil {
+		return nil, fmt.Errorf("%w: %s", errResponseNotOK, j)
+	}
+	return result.Result, nil
 }
 
-func FormatEmail(envelope *mail.Envelope, telegramConfig *TelegramConfig) (*FormattedEmail, error) {
+// FormatEmail parses an email into the Telegram message. Tags of filter
+// rules are shown on the first line.
+func FormatEmail(envelope *mail.Envelope, telegramConfig *TelegramConfig, tags []string) (*FormattedEmail, error) {
 	reader := envelope.NewReader()
 	env, err := enmime.ReadEnvelope(reader)
 	if err != nil {
@@ -767,6 +1281,7 @@ func FormatEmail(envelope *mail.Envelope, telegramConfig *TelegramConfig) (*Form
 
 	var attachmentsDetails []string
 	var attachments []*FormattedAttachment
+	var attachmentInfos []AttachmentInfo
 
 	doParts := func(emoji string, parts []*enmime.Part) {
 		for _, part := range parts {
@@ -779,22 +1294,22 @@ func FormatEmail(envelope *mail.Envelope, telegramConfig *TelegramConfig) (*Form
 			}
 			action := "discarded"
 			contentType := GuessContentType(part.ContentType, part.FileName)
-			if FileIsImage(contentType) && len(part.Content) <= telegramConfig.ForwardedAttachmentMaxPhotoSize {
-				action = "sending..."
-				attachments = append(attachments, &FormattedAttachment{
-					Filename: part.FileName,
-					Caption:  part.FileName,
-					Content:  part.Content,
-					FileType: AttachmentTypePhoto,
-				})
-			} else if len(part.Content) <= telegramConfig.ForwardedAttachmentMaxSize {
+			attachmentInfos = append(attachmentInfos, AttachmentInfo{Filename: part.FileName, ContentType: contentType})
+			// Media over its own limit may still be sent as a document.
+			fileType := AttachmentTypeOf(contentType, part.Content)
+			if len(part.Content) > telegramConfig.maxAttachmentSize(fileType) {
+				fileType = AttachmentTypeDocument
+			}
+			if len(part.Content) <= telegramConfig.maxAttachmentSize(fileType) {
 				action = "sending..."
 				attachments = append(attachments, &FormattedAttachment{
 					Filename: part.FileName,
 					Caption:  part.FileName,
 					Content:  part.Content,
-					FileType: AttachmentTypeDocument,
+					FileType: fileType,
 				})
+			} else {
+				metricAttachments.Inc("discarded")
 			}
 			line := fmt.Sprintf(
 				"- %s %s (%s) %s, %s",
@@ -810,10 +1325,12 @@ func FormatEmail(envelope *mail.Envelope, telegramConfig *TelegramConfig) (*Form
 	doParts("🔗", env.Inlines)
 	doParts("📎", env.Attachments)
 	for _, part := range env.OtherParts {
+		contentType := GuessContentType(part.ContentType, part.FileName)
+		attachmentInfos = append(attachmentInfos, AttachmentInfo{Filename: part.FileName, ContentType: contentType})
 		line := fmt.Sprintf(
 			"- ❔ %s (%s) %s, discarded",
 			part.FileName,
-			GuessContentType(part.ContentType, part.FileName),
+			contentType,
 			units.HumanSize(float64(len(part.Content))),
 		)
 		attachmentsDetails = append(attachmentsDetails, line)
@@ -825,6 +1342,16 @@ func FormatEmail(envelope *mail.Envelope, telegramConfig *TelegramConfig) (*Form
 	if text == "" {
 		text = envelope.Data.String()
 	}
+	htmlMode := telegramConfig.MessageFormat == MessageFormatHTML
+	parseMode := ""
+	if htmlMode {
+		parseMode = "HTML"
+		if env.HTML != "" {
+			text = ConvertHTMLToTelegram(env.HTML)
+		} else {
+			text = escapeHTML(text)
+		}
+	}
 
 	formattedAttachmentsDetails := ""
 	if len(attachmentsDetails) > 0 {
@@ -834,33 +1361,51 @@ func FormatEmail(envelope *mail.Envelope, telegramConfig *TelegramConfig) (*Form
 		)
 	}
 
-	from := envelope.MailFrom.String()
+	envelopeFrom := envelope.MailFrom.String()
+	from, returnPath := headerFrom(env, envelopeFrom)
 	to := JoinEmailAddresses(envelope.RcptTo)
 	subject := env.GetHeader("subject")
 	cc := env.GetHeader("Cc")
 	replyTo := env.GetHeader("Reply-To")
+	messageID := env.GetHeader("Message-ID")
+	references := env.GetHeader("References")
 	html := env.HTML
+	headers := make(textproto.MIMEHeader)
+	for _, key := range env.GetHeaderKeys() {
+		headers[textproto.CanonicalMIMEHeaderKey(key)] = env.GetHeaderValues(key)
+	}
 
 	fullMessageText, truncatedMessageText := FormatMessage(
-		from,
-		to,
-		subject,
-		text,
-		cc,
-		replyTo,
-		formattedAttachmentsDetails,
+		MessageContent{
+			From:               from,
+			To:                 to,
+			Subject:            subject,
+			Text:               text,
+			CC:                 cc,
+			ReplyTo:            replyTo,
+			ReturnPath:         returnPath,
+			Tags:               strings.Join(tags, ", "),
+			AttachmentsDetails: formattedAttachmentsDetails,
+		},
 		telegramConfig.MessageLengthToSendAsFile,
+		htmlMode,
 	)
 	if truncatedMessageText == "" { // no need to truncate
 		return &FormattedEmail{
-			From:        from,
-			To:          to,
-			CC:          cc,
-			ReplyTo:     replyTo,
-			Subject:     subject,
-			Text:        fullMessageText,
-			HTML:        html,
-			Attachments: attachments,
+			From:            from,
+			EnvelopeFrom:    envelopeFrom,
+			To:              to,
+			CC:              cc,
+			ReplyTo:         replyTo,
+			Subject:         subject,
+			Text:            fullMessageText,
+			HTML:            html,
+			ParseMode:       parseMode,
+			MessageID:       messageID,
+			References:      references,
+			Attachments:     attachments,
+			Headers:         headers,
+			AttachmentInfos: attachmentInfos,
 		}, nil
 	}
 
@@ -878,36 +1423,104 @@ func FormatEmail(envelope *mail.Envelope, telegramConfig *TelegramConfig) (*Form
 		Content:  []byte(fullMessageText),
 		FileType: AttachmentTypeDocument,
 	}
+	if htmlMode {
+		at.Filename = "full_message.html"
+		at.Content = []byte(`<html><body style="white-space: pre-wrap">` + fullMessageText + "</body></html>")
+	}
 	allAttachments := slices.Concat([]*FormattedAttachment{at}, attachments)
 	return &FormattedEmail{
-		From:        from,
-		To:          to,
-		CC:          cc,
-		ReplyTo:     replyTo,
-		Subject:     subject,
-		Text:        truncatedMessageText,
-		HTML:        html,
-		Attachments: allAttachments,
+		From:            from,
+		EnvelopeFrom:    envelopeFrom,
+		To:              to,
+		CC:              cc,
+		ReplyTo:         replyTo,
+		Subject:         subject,
+		Text:            truncatedMessageText,
+		HTML:            html,
+		ParseMode:       parseMode,
+		MessageID:       messageID,
+		References:      references,
+		Attachments:     allAttachments,
+		Headers:         headers,
+		AttachmentInfos: attachmentInfos,
 	}, nil
 }
 
+// headerFrom returns the From header with its decoded display name, falling
+// back to the envelope sender. The envelope sender is returned as returnPath
+// when it differs from the header address.
+func headerFrom(env *enmime.Envelope, envelopeFrom string) (from, returnPath string) {
+	addresses, err := env.AddressList("From")
+	if err != nil || len(addresses) == 0 {
+		return envelopeFrom, ""
+	}
+	address := addresses[0]
+	from = address.Address
+	if name := strings.TrimSpace(address.Name); name != "" {
+		if strings.ContainsAny(name, `()<>[]:;@\,."`) {
+			name = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+		}
+		from = fmt.Sprintf("%s <%s>", name, address.Address)
+	}
+	if envelopeFrom != "" && !strings.EqualFold(envelopeFrom, address.Address) {
+		returnPath = envelopeFrom
+	}
+	return from, returnPath
+}
+
+// MessageContent is what the Telegram message of an email shows.
+type MessageContent struct {
+	From               string
+	To                 string
+	Subject            string
+	Text               string
+	CC                 string
+	ReplyTo            string
+	ReturnPath         string // envelope sender, if it differs from From
+	Tags               string // of the matched filter rules, comma separated
+	AttachmentsDetails string
+}
+
+// FormatMessage returns the text of the Telegram message, and a truncated
+// one if it is longer than messageLengthToSendAsFile.
 func FormatMessage(
-	from, to, subject, text string,
-	cc, replyTo string,
-	formattedAttachmentsDetails string,
+	m MessageContent,
 	messageLengthToSendAsFile uint,
+	htmlMode bool,
 ) (fullMessageText, truncatedMessageText string) {
+	// In HTML mode text is already converted, the rest is plain and escaped
+	// here. Truncation then has to keep the markup valid.
+	truncate := func(s string, limit uint) string {
+		return string([]rune(s)[:limit])
+	}
+	if htmlMode {
+		m.From, m.To, m.Subject = escapeHTML(m.From), escapeHTML(m.To), escapeHTML(m.Subject)
+		m.CC, m.ReplyTo, m.ReturnPath = escapeHTML(m.CC), escapeHTML(m.ReplyTo), escapeHTML(m.ReturnPath)
+		m.Tags = escapeHTML(m.Tags)
+		m.AttachmentsDetails = escapeHTML(m.AttachmentsDetails)
+		truncate = truncateHTML
+	}
+
+	tagLine := ""
+	if m.Tags != "" {
+		tagLine = fmt.Sprintf("🏷 %s\n", m.Tags)
+	}
+
 	buildHeader := func() string {
 		var hdr strings.Builder
-		fmt.Fprintf(&hdr, "From: %s\n", from)
-		fmt.Fprintf(&hdr, "To: %s\n", to)
-		if strings.TrimSpace(cc) != "" {
-			fmt.Fprintf(&hdr, "CC: %s\n", cc)
+		hdr.WriteString(tagLine)
+		fmt.Fprintf(&hdr, "From: %s\n", m.From)
+		if m.ReturnPath != "" {
+			fmt.Fprintf(&hdr, "Return-Path: %s\n", m.ReturnPath)
+		}
+		fmt.Fprintf(&hdr, "To: %s\n", m.To)
+		if strings.TrimSpace(m.CC) != "" {
+			fmt.Fprintf(&hdr, "CC: %s\n", m.CC)
 		}
-		if strings.TrimSpace(replyTo) != "" {
-			fmt.Fprintf(&hdr, "Reply-To: %s\n", replyTo)
+		if strings.TrimSpace(m.ReplyTo) != "" {
+			fmt.Fprintf(&hdr, "Reply-To: %s\n", m.ReplyTo)
 		}
-		fmt.Fprintf(&hdr, "Subject: %s", subject)
+		fmt.Fprintf(&hdr, "Subject: %s", m.Subject)
 		return hdr.String()
 	}
 
@@ -917,14 +1530,14 @@ func FormatMessage(
 		sb.WriteString(header)
 		sb.WriteString("\n\n")
 		sb.WriteString(body)
-		if formattedAttachmentsDetails != "" {
+		if m.AttachmentsDetails != "" {
 			sb.WriteString("\n\n")
-			sb.WriteString(formattedAttachmentsDetails)
+			sb.WriteString(m.AttachmentsDetails)
 		}
 		return strings.TrimSpace(sb.String())
 	}
 
-	trimmedText := strings.TrimSpace(text)
+	trimmedText := strings.TrimSpace(m.Text)
 	fullMessageText = buildMessage(trimmedText)
 
 	fullMessageRunes := []rune(fullMessageText)
@@ -933,33 +1546,33 @@ func FormatMessage(
 		return fullMessageText, ""
 	}
 
-	emptyMessageText := buildMessage(strings.TrimSpace(fmt.Sprintf(".%s", BodyTruncated)))
+	emptyMessageText := buildMessage(strings.TrimSpace("." + BodyTruncated))
 	emptyMessageRunes := []rune(emptyMessageText)
 	if uint(len(emptyMessageRunes)) >= messageLengthToSendAsFile {
 		// Headers alone exceed the limit. Build a minimal-header message
 		// so HandleTelegramReply can still parse From/To/Subject for replies.
 		var sb strings.Builder
-		fmt.Fprintf(&sb, "From: %s\n", from)
-		firstTo := to
-		if before, _, ok := strings.Cut(to, ","); ok {
+		sb.WriteString(tagLine)
+		fmt.Fprintf(&sb, "From: %s\n", m.From)
+		firstTo := m.To
+		if before, _, ok := strings.Cut(m.To, ","); ok {
 			firstTo = strings.TrimSpace(before)
 		}
 		fmt.Fprintf(&sb, "To: %s\n", firstTo)
-		fmt.Fprintf(&sb, "Subject: %s\n\n[truncated]", subject)
+		fmt.Fprintf(&sb, "Subject: %s\n\n[truncated]", m.Subject)
 		minimalMsg := sb.String()
 		if minimalRunes := []rune(minimalMsg); uint(len(minimalRunes)) > messageLengthToSendAsFile {
-			minimalMsg = string(minimalRunes[:messageLengthToSendAsFile])
+			minimalMsg = truncate(minimalMsg, messageLengthToSendAsFile)
 		}
 		return fullMessageText, minimalMsg
 	}
 
-	maxBodyLength := messageLengthToSendAsFile - uint(len(emptyMessageRunes))
-	// TODO cut by paragraphs + respect formatting
-	truncatedBody := strings.TrimSpace(fmt.Sprintf("%s%s",
-		string([]rune(trimmedText)[:maxBodyLength]), BodyTruncated))
-	truncatedMessageText = buildMessage(truncatedBody)
+	// Room for the body and its marker
+	maxBodyLength := messageLengthToSendAsFile - uint(len(emptyMessageRunes)) + uint(len([]rune(BodyTruncated)))
+	kept, marker := truncateWithMarker(trimmedText, maxBodyLength, htmlMode)
+	truncatedMessageText = buildMessage(strings.TrimSpace(kept + marker))
 	if uint(len([]rune(truncatedMessageText))) > messageLengthToSendAsFile {
-		panic(fmt.Errorf("%w: maxBodyLength=%d, text=%s", errUnexpectedTruncation, maxBodyLength, truncatedMessageText))
+		panic(fmt.Errorf("%w: maxBodyLength=%d, m.Text=%s", errUnexpectedTruncation, maxBodyLength, truncatedMessageText))
 	}
 	return fullMessageText, truncatedMessageText
 }
@@ -978,7 +1591,7 @@ func GuessContentType(contentType, filename string) string {
 func FileIsImage(contentType string) bool {
 	switch contentType {
 	case
-		// "image/gif",  // sent as a static image
+		// "image/gif",  // sent as an animation
 		// "image/x-ms-bmp",  // rendered as document
 		"image/jpeg",
 		"image/png":
@@ -1009,16 +1622,23 @@ func SanitizeBotToken(s, botToken string) string {
 	return strings.ReplaceAll(s, botToken, "***")
 }
 
-func awaitShutdown(ctx context.Context, d *guerrilla.Daemon, cancelPolling context.CancelFunc) error {
+func awaitShutdown(
+	ctx context.Context,
+	srv *SMTPServer,
+	stopUpdates func(),
+	spool *Spool,
+	httpServer *http.Server,
+) error {
 	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
 	defer stop()
 
 	<-ctx.Done()
 	logger.Info("Shutdown signal caught")
+	health.smtpListening.Store(false)
 
-	// Stop polling first
-	if cancelPolling != nil {
-		cancelPolling()
+	// Stop receiving replies first
+	if stopUpdates != nil {
+		stopUpdates()
 	}
 
 	// Graceful shutdown of SMTP with timeout
@@ -1027,7 +1647,16 @@ func awaitShutdown(ctx context.Context, d *guerrilla.Daemon, cancelPolling conte
 
 	done := make(chan struct{})
 	go func() {
-		d.Shutdown()
+		srv.Shutdown()
+		// No new emails can arrive now, give the spooled ones a last chance.
+		if spool != nil {
+			spool.Shutdown(shutdownCtx)
+		}
+		if httpServer != nil {
+			if err := httpServer.Shutdown(shutdownCtx); err != nil {
+				logger.Warningf("HTTP server shutdown error: %v", err)
+			}
+		}
 		close(done)
 	}()
 
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,11 +11,13 @@ import (
 	"net/http"
 	"net/smtp"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/phires/go-guerrilla"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/gomail.v2"
 )
@@ -26,6 +29,12 @@ var (
 	errTestUnexpectedValue = errors.New("unexpected value")
 )
 
+func TestMain(m *testing.M) {
+	// Don't pace the tests' requests to the fake Telegram API.
+	telegramSender = NewTelegramSender(0, 0)
+	os.Exit(m.Run())
+}
+
 func makeSMTPConfig() *SMTPConfig {
 	return &SMTPConfig{
 		Listen:      fmt.Sprintf("%s:%d", testSMTPListenHost, testSMTPListenPort),
@@ -45,13 +54,13 @@ func makeTelegramConfig() *TelegramConfig {
 	}
 }
 
-func startSMTP(t *testing.T, smtpConfig *SMTPConfig, telegramConfig *TelegramConfig) guerrilla.Daemon {
+func startSMTP(t *testing.T, smtpConfig *SMTPConfig, telegramConfig *TelegramConfig) *SMTPServer {
 	t.Helper()
 	_, err := loadConfig(smtpConfig.ConfigFile)
 	if err != nil {
 		t.Fatalf("load config error: %s", err)
 	}
-	d, err := SMTPStart(smtpConfig, telegramConfig)
+	d, err := SMTPStart(smtpConfig, telegramConfig, nil, nil)
 	if err != nil {
 		t.Fatalf("start error: %s", err)
 	}
@@ -252,6 +261,7 @@ func TestAttachmentsSending(t *testing.T) {
 	// attachment image
 	m.Attach("attachment.jpg", goMailBody([]byte("JPG")))
 
+	// Photos are sent as an album, before the document
 	expFiles := []*FormattedAttachment{
 		{
 			Filename: "inline.jpg",
@@ -259,18 +269,18 @@ func TestAttachmentsSending(t *testing.T) {
 			Content:  []byte("JPG"),
 			FileType: AttachmentTypePhoto,
 		},
-		{
-			Filename: "hey.txt",
-			Caption:  "hey.txt",
-			Content:  []byte("hi"),
-			FileType: AttachmentTypeDocument,
-		},
 		{
 			Filename: "attachment.jpg",
 			Caption:  "attachment.jpg",
 			Content:  []byte("JPG"),
 			FileType: AttachmentTypePhoto,
 		},
+		{
+			Filename: "hey.txt",
+			Caption:  "hey.txt",
+			Content:  []byte("hi"),
+			FileType: AttachmentTypeDocument,
+		},
 	}
 
 	di := gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "")
@@ -278,6 +288,7 @@ func TestAttachmentsSending(t *testing.T) {
 	require.NoError(t, err)
 
 	require.Len(t, h.RequestMessages, len(strings.Split(telegramConfig.ChatIDs, ",")))
+	require.Equal(t, []int{2, 2}, h.RequestMediaGroups)
 	require.Len(t, h.RequestDocuments, len(expFiles)*len(strings.Split(telegramConfig.ChatIDs, ",")))
 	exp :=
 		"From: from@test\n" +
@@ -296,6 +307,55 @@ func TestAttachmentsSending(t *testing.T) {
 	}
 }
 
+func TestAttachmentsReusedByFileID(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.ForwardedAttachmentMaxSize = 1024
+	telegramConfig.ForwardedAttachmentMaxPhotoSize = 1024
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	send := func() {
+		t.Helper()
+		m := gomail.NewMessage()
+		m.SetHeader("From", "from@test")
+		m.SetHeader("To", "to@test")
+		m.SetHeader("Subject", "Test subj")
+		m.SetBody("text/plain", "Text body")
+		m.Attach("hey.txt", goMailBody([]byte("hi")))
+		m.Attach("attachment.jpg", goMailBody([]byte("JPG")))
+		require.NoError(t, gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "").DialAndSend(m))
+	}
+	expFiles := []*FormattedAttachment{
+		{Filename: "hey.txt", Caption: "hey.txt", Content: []byte("hi"), FileType: AttachmentTypeDocument},
+		{Filename: "attachment.jpg", Caption: "attachment.jpg", Content: []byte("JPG"), FileType: AttachmentTypePhoto},
+	}
+
+	// Uploaded to the first chat only, the largest photo size is reused
+	send()
+	require.Equal(t, []string{"", "", "file-1", "file-2"}, h.RequestFileIDs)
+	require.Equal(t, []string{"42", "142"}, h.RequestChatIDs)
+	require.Len(t, h.RequestDocuments, 4)
+	for i, doc := range h.RequestDocuments {
+		require.Equal(t, expFiles[i%len(expFiles)], doc)
+	}
+
+	// Rejected file IDs fall back to an upload
+	h.RequestFileIDs = nil
+	h.RequestDocuments = nil
+	h.RejectFileIDs = true
+	send()
+	require.Equal(t, []string{"", "", "", ""}, h.RequestFileIDs)
+	require.Len(t, h.RequestDocuments, 4)
+	for i, doc := range h.RequestDocuments {
+		require.Equal(t, expFiles[i%len(expFiles)], doc)
+	}
+}
+
 func TestLargeMessageAggressivelyTruncated(t *testing.T) {
 	smtpConfig := makeSMTPConfig()
 	telegramConfig := makeTelegramConfig()
@@ -391,9 +451,9 @@ func TestLargeMessageProperlyTruncated(t *testing.T) {
 			"To: to@test\n" +
 			"Subject: Test subj\n" +
 			"\n" +
-			"Hello_Hello_Hello_Hello_Hello_Hello_He\n" +
+			"Hello_Hello_Hello_Hell\n" +
 			"\n" +
-			"[truncated]"
+			"[truncated: 338 characters]"
 	require.Equal(t, exp, h.RequestMessages[0])
 	for i, expDoc := range expFiles {
 		require.Equal(t, expDoc, h.RequestDocuments[i])
@@ -457,9 +517,9 @@ func TestLargeMessageWithAttachmentsProperlyTruncated(t *testing.T) {
 			"To: to@test\n" +
 			"Subject: Test subj\n" +
 			"\n" +
-			"Hel loHel loHel loHel loHel\n" +
+			"Hel loHel\n" +
 			"\n" +
-			"[truncated]\n" +
+			"[truncated: 350 characters]\n" +
 			"\n" +
 			"Attachments:\n" +
 			"- 📎 attachment.jpg (image/jpeg) 3B, sending..."
@@ -648,7 +708,8 @@ QW5uYS1W6XJvbmlxdWUK
 
 	require.Len(t, h.RequestMessages, len(strings.Split(telegramConfig.ChatIDs, ",")))
 	exp :=
-		"From: from@test\n" +
+		"From: qBittorrent_notification@example.com\n" +
+			"Return-Path: from@test\n" +
 			"To: to@test\n" +
 			"Subject: Anna-Véronique\n" +
 			"\n" +
@@ -656,6 +717,40 @@ QW5uYS1W6XJvbmlxdWUK
 	require.Equal(t, exp, h.RequestMessages[0])
 }
 
+func TestHeaderFromWithDisplayName(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	m := `From: =?UTF-8?Q?J=C3=B6hn_Doe?= <John@example.com>
+Subject: Newsletter
+To: to@test
+
+Hello
+`
+	err := smtp.SendMail(smtpConfig.Listen, nil, "bounce-123@mailer.example", []string{"to@test"}, []byte(m))
+	require.NoError(t, err)
+	require.Equal(t,
+		"From: Jöhn Doe <John@example.com>\n"+
+			"Return-Path: bounce-123@mailer.example\n"+
+			"To: to@test\n"+
+			"Subject: Newsletter\n"+
+			"\n"+
+			"Hello",
+		h.RequestMessages[0])
+
+	// No Return-Path when the envelope sender is the header address.
+	h.RequestMessages = nil
+	err = smtp.SendMail(smtpConfig.Listen, nil, "john@example.com", []string{"to@test"}, []byte(m))
+	require.NoError(t, err)
+	require.NotContains(t, h.RequestMessages[0], "Return-Path:")
+}
+
 func TestCCAndReplyToInForwardedMessage(t *testing.T) {
 	smtpConfig := makeSMTPConfig()
 	telegramConfig := makeTelegramConfig()
@@ -735,20 +830,59 @@ func HTTPServer(t *testing.T, handler http.Handler) *http.Server {
 			t.Log(err)
 		}
 	}()
+	t.Cleanup(http.DefaultClient.CloseIdleConnections)
 	return h
 }
 
+var (
+	// attachmentFields are the file fields of the methods sending attachments.
+	attachmentFields = map[string]string{
+		"sendDocument":  "document",
+		"sendPhoto":     "photo",
+		"sendAnimation": "animation",
+		"sendVideo":     "video",
+		"sendAudio":     "audio",
+		"sendVoice":     "voice",
+	}
+	attachmentFileTypes = map[string]int{
+		"document":  AttachmentTypeDocument,
+		"photo":     AttachmentTypePhoto,
+		"animation": AttachmentTypeAnimation,
+		"video":     AttachmentTypeVideo,
+		"audio":     AttachmentTypeAudio,
+		"voice":     AttachmentTypeVoice,
+	}
+)
+
 type SuccessHandler struct {
 	RequestMessages     []string
+	RequestChatIDs      []string
+	RequestThreadIDs    []string
+	RequestParseModes   []string
 	RequestDocuments    []*FormattedAttachment
 	RequestReplyMarkups []string
+	RequestSilent       []string // disable_notification of sendMessage
+	RequestFileIDs      []string // of attachments sent by file_id, empty for uploads
+	RequestMediaGroups  []int    // number of attachments of sendMediaGroup
+	RejectFileIDs       bool
+	RejectMethods       []string // e.g. sendMediaGroup
+	RejectAttachments   bool
+
+	files map[string]*FormattedAttachment // uploads by file_id
 }
 
 func NewSuccessHandler() *SuccessHandler {
 	return &SuccessHandler{
 		RequestMessages:     []string{},
+		RequestChatIDs:      []string{},
+		RequestThreadIDs:    []string{},
+		RequestParseModes:   []string{},
 		RequestDocuments:    []*FormattedAttachment{},
 		RequestReplyMarkups: []string{},
+		RequestSilent:       []string{},
+		RequestFileIDs:      []string{},
+		RequestMediaGroups:  []int{},
+		files:               map[string]*FormattedAttachment{},
 	}
 }
 
@@ -761,49 +895,87 @@ func (s *SuccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			panic(err)
 		}
 		s.RequestMessages = append(s.RequestMessages, r.PostForm.Get("text"))
+		s.RequestChatIDs = append(s.RequestChatIDs, r.PostForm.Get("chat_id"))
+		s.RequestThreadIDs = append(s.RequestThreadIDs, r.PostForm.Get("message_thread_id"))
+		s.RequestParseModes = append(s.RequestParseModes, r.PostForm.Get("parse_mode"))
 		s.RequestReplyMarkups = append(s.RequestReplyMarkups, r.PostForm.Get("reply_markup"))
+		s.RequestSilent = append(s.RequestSilent, r.PostForm.Get("disable_notification"))
 		return
 	}
-	isSendDocument := strings.Contains(r.URL.Path, "sendDocument")
-	isSendPhoto := strings.Contains(r.URL.Path, "sendPhoto")
-	if isSendDocument || isSendPhoto {
-		if _, err := w.Write([]byte(`{}`)); err != nil {
-			panic(fmt.Errorf("failed to write response: %w", err))
-		}
+	method := path.Base(r.URL.Path)
+	field, isSendFile := attachmentFields[method]
+	isSendMediaGroup := method == "sendMediaGroup"
+	if isSendFile || isSendMediaGroup {
 		if r.FormValue("reply_to_message_id") != "123123" {
 			panic(fmt.Errorf("%w: unexpected reply_to_message_id: %s", errTestUnexpectedValue, r.FormValue("reply_to_message_id")))
 		}
 		if err := r.ParseMultipartForm(1024 * 1024); err != nil {
 			panic(err)
 		}
-		key := "document"
-		fileType := AttachmentTypeDocument
-		if isSendPhoto {
-			key = "photo"
-			fileType = AttachmentTypePhoto
+		// Single attachments are described like the items of an album.
+		var items []TelegramInputMedia
+		if isSendMediaGroup {
+			if err := json.Unmarshal([]byte(r.FormValue("media")), &items); err != nil {
+				panic(err)
+			}
+		} else {
+			items = []TelegramInputMedia{{Type: field, Media: r.FormValue(field), Caption: r.FormValue("caption")}}
 		}
-		file, header, err := r.FormFile(key)
-		if err != nil {
-			panic(err)
+		for i := range items {
+			if items[i].Media == "" {
+				items[i].Media = "attach://" + items[i].Type
+			}
+			_, upload := strings.CutPrefix(items[i].Media, "attach://")
+			_, local := strings.CutPrefix(items[i].Media, "file://")
+			if s.RejectAttachments || slices.Contains(s.RejectMethods, method) ||
+				(!upload && !local && (s.RejectFileIDs || s.files[items[i].Media] == nil)) {
+				w.WriteHeader(400)
+				if _, err := w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: wrong file identifier"}`)); err != nil {
+					panic(fmt.Errorf("failed to write response: %w", err))
+				}
+				return
+			}
 		}
-		defer func() {
-			if err := file.Close(); err != nil {
-				panic(fmt.Errorf("failed to close file: %w", err))
+
+		var results []string
+		for _, item := range items {
+			fileType := attachmentFileTypes[item.Type]
+			fileID := item.Media
+			requestFileID := fileID
+			if field, ok := strings.CutPrefix(item.Media, "attach://"); ok {
+				fileID = s.upload(r, field, fileType)
+				requestFileID = ""
+			}
+			if path, ok := strings.CutPrefix(item.Media, "file://"); ok {
+				fileID = s.readLocalFile(path, fileType)
+			}
+			attachment := s.files[fileID]
+			s.RequestFileIDs = append(s.RequestFileIDs, requestFileID)
+			s.RequestDocuments = append(
+				s.RequestDocuments,
+				&FormattedAttachment{
+					Filename: attachment.Filename,
+					Caption:  item.Caption,
+					Content:  attachment.Content,
+					FileType: fileType,
+				},
+			)
+			if item.Type == "photo" {
+				results = append(results, fmt.Sprintf(`{"message_id":123124,"photo":[{"file_id":"thumbnail"},{"file_id":%q}]}`, fileID))
+			} else {
+				results = append(results, fmt.Sprintf(`{"message_id":123124,%q:{"file_id":%q}}`, item.Type, fileID))
 			}
-		}()
-		var buf bytes.Buffer
-		if _, err := io.Copy(&buf, file); err != nil {
-			panic(fmt.Errorf("failed to copy file Content: %w", err))
 		}
-		s.RequestDocuments = append(
-			s.RequestDocuments,
-			&FormattedAttachment{
-				Filename: header.Filename,
-				Caption:  r.FormValue("caption"),
-				Content:  buf.Bytes(),
-				FileType: fileType,
-			},
-		)
+		s.RequestThreadIDs = append(s.RequestThreadIDs, r.FormValue("message_thread_id"))
+
+		response := `{"ok":true,"result":` + results[0] + `}`
+		if isSendMediaGroup {
+			s.RequestMediaGroups = append(s.RequestMediaGroups, len(items))
+			response = `{"ok":true,"result":[` + strings.Join(results, ",") + `]}`
+		}
+		if _, err := w.Write([]byte(response)); err != nil {
+			panic(fmt.Errorf("failed to write response: %w", err))
+		}
 	} else {
 		w.WriteHeader(404)
 		if _, err := w.Write([]byte("Error")); err != nil {
@@ -812,6 +984,47 @@ func (s *SuccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// upload stores the file of a form field and returns its file_id.
+func (s *SuccessHandler) upload(r *http.Request, field string, fileType int) string {
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(fmt.Errorf("failed to close file: %w", err))
+		}
+	}()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, file); err != nil {
+		panic(fmt.Errorf("failed to copy file Content: %w", err))
+	}
+	fileID := fmt.Sprintf("file-%d", len(s.files)+1)
+	s.files[fileID] = &FormattedAttachment{
+		Filename: header.Filename,
+		Content:  buf.Bytes(),
+		FileType: fileType,
+	}
+	return fileID
+}
+
+// readLocalFile stores a file:// attachment like a local Bot API server and
+// returns its file_id.
+func (s *SuccessHandler) readLocalFile(path string, fileType int) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	fileID := fmt.Sprintf("file-%d", len(s.files)+1)
+	s.files[fileID] = &FormattedAttachment{
+		// The server names the file after the last part of the path.
+		Filename: filepath.Base(path),
+		Content:  content,
+		FileType: fileType,
+	}
+	return fileID
+}
+
 type ErrorHandler struct{}
 
 func (s *ErrorHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
@@ -846,16 +1059,16 @@ func TestLoadFilterRules(t *testing.T) {
 
 	_, err = loadConfig(tmpfile.Name())
 	require.NoError(t, err)
-	require.Len(t, filterRules, 2)
-	require.Equal(t, "block-spam", filterRules[0].Name)
-	require.Equal(t, "all", filterRules[0].Match) // default
-	require.Equal(t, "block-domain", filterRules[1].Name)
+	require.Len(t, currentRules().FilterRules, 2)
+	require.Equal(t, "block-spam", currentRules().FilterRules[0].Name)
+	require.Equal(t, "all", currentRules().FilterRules[0].Match) // default
+	require.Equal(t, "block-domain", currentRules().FilterRules[1].Name)
 }
 
 func TestLoadFilterRulesEmptyFilename(t *testing.T) {
 	_, err := loadConfig("")
 	require.NoError(t, err)
-	require.Nil(t, filterRules)
+	require.Nil(t, currentRules().FilterRules)
 }
 
 func TestLoadFilterRulesNonExistentFile(t *testing.T) {
@@ -951,21 +1164,21 @@ func TestFilterRulesMatchAll(t *testing.T) {
 	require.NoError(t, err)
 
 	// Both conditions match - should reject (case-insensitive)
-	rejected, ruleName := checkFilterRules("sender@ecinetworks.com", "to@test.com", "Getting to know you", "body", "")
-	require.True(t, rejected)
-	require.Equal(t, "block-dating-spam", ruleName)
+	decision := checkFilterRules(&FilterInput{From: "sender@ecinetworks.com", To: "to@test.com", Subject: "Getting to know you", Body: "body"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-dating-spam", decision.RuleName)
 
 	// Only from matches - should not reject
-	rejected, _ = checkFilterRules("sender@ecinetworks.com", "to@test.com", "Hello", "body", "")
-	require.False(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "sender@ecinetworks.com", To: "to@test.com", Subject: "Hello", Body: "body"})
+	require.Empty(t, decision.Action)
 
 	// Only subject matches - should not reject
-	rejected, _ = checkFilterRules("sender@other.com", "to@test.com", "Getting to know you", "body", "")
-	require.False(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "sender@other.com", To: "to@test.com", Subject: "Getting to know you", Body: "body"})
+	require.Empty(t, decision.Action)
 
 	// Neither matches - should not reject
-	rejected, _ = checkFilterRules("sender@other.com", "to@test.com", "Hello", "body", "")
-	require.False(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "sender@other.com", To: "to@test.com", Subject: "Hello", Body: "body"})
+	require.Empty(t, decision.Action)
 }
 
 func TestFilterRulesMatchAny(t *testing.T) {
@@ -993,21 +1206,21 @@ func TestFilterRulesMatchAny(t *testing.T) {
 	require.NoError(t, err)
 
 	// First condition matches - should reject
-	rejected, ruleName := checkFilterRules("from@test.com", "to@test.com", "subject", "Visit cdnex.online", "")
-	require.True(t, rejected)
-	require.Equal(t, "block-spam-domains", ruleName)
+	decision := checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", Body: "Visit cdnex.online"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-spam-domains", decision.RuleName)
 
 	// Second condition matches - should reject
-	rejected, _ = checkFilterRules("from@test.com", "to@test.com", "subject", "Check spam-tracker.net", "")
-	require.True(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", Body: "Check spam-tracker.net"})
+	require.Equal(t, FilterActionReject, decision.Action)
 
 	// Third condition matches - should reject
-	rejected, _ = checkFilterRules("from@test.com", "to@test.com", "subject", "Click click-now.xyz", "")
-	require.True(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", Body: "Click click-now.xyz"})
+	require.Equal(t, FilterActionReject, decision.Action)
 
 	// None match - should not reject
-	rejected, _ = checkFilterRules("from@test.com", "to@test.com", "subject", "Clean body text", "")
-	require.False(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", Body: "Clean body text"})
+	require.Empty(t, decision.Action)
 }
 
 func TestFilterRulesFieldMatching(t *testing.T) {
@@ -1050,33 +1263,33 @@ func TestFilterRulesFieldMatching(t *testing.T) {
 	require.NoError(t, err)
 
 	// Test from field
-	rejected, ruleName := checkFilterRules("blocked@example.com", "to@test.com", "subject", "body", "html")
-	require.True(t, rejected)
-	require.Equal(t, "block-from", ruleName)
+	decision := checkFilterRules(&FilterInput{From: "blocked@example.com", To: "to@test.com", Subject: "subject", Body: "body", HTML: "html"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-from", decision.RuleName)
 
 	// Test to field
-	rejected, ruleName = checkFilterRules("from@test.com", "blocked-recipient@test.com", "subject", "body", "html")
-	require.True(t, rejected)
-	require.Equal(t, "block-to", ruleName)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "blocked-recipient@test.com", Subject: "subject", Body: "body", HTML: "html"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-to", decision.RuleName)
 
 	// Test subject field
-	rejected, ruleName = checkFilterRules("from@test.com", "to@test.com", "BLOCKED_SUBJECT here", "body", "html")
-	require.True(t, rejected)
-	require.Equal(t, "block-subject", ruleName)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "BLOCKED_SUBJECT here", Body: "body", HTML: "html"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-subject", decision.RuleName)
 
 	// Test body field
-	rejected, ruleName = checkFilterRules("from@test.com", "to@test.com", "subject", "Contains BLOCKED_BODY", "html")
-	require.True(t, rejected)
-	require.Equal(t, "block-body", ruleName)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", Body: "Contains BLOCKED_BODY", HTML: "html"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-body", decision.RuleName)
 
 	// Test html field
-	rejected, ruleName = checkFilterRules("from@test.com", "to@test.com", "subject", "body", "<p>BLOCKED_HTML</p>")
-	require.True(t, rejected)
-	require.Equal(t, "block-html", ruleName)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", Body: "body", HTML: "<p>BLOCKED_HTML</p>"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-html", decision.RuleName)
 
 	// Test no match
-	rejected, _ = checkFilterRules("good@example.com", "good@test.com", "good subject", "good body", "good html")
-	require.False(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "good@example.com", To: "good@test.com", Subject: "good subject", Body: "good body", HTML: "good html"})
+	require.Empty(t, decision.Action)
 }
 
 func TestFilterRulesBodyOrHtml(t *testing.T) {
@@ -1099,22 +1312,22 @@ func TestFilterRulesBodyOrHtml(t *testing.T) {
 	require.NoError(t, err)
 
 	// Pattern in body only - should reject
-	rejected, ruleName := checkFilterRules("from@test.com", "to@test.com", "subject", "Visit adnxs.com", "")
-	require.True(t, rejected)
-	require.Equal(t, "block-tracking-url", ruleName)
+	decision := checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", Body: "Visit adnxs.com"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-tracking-url", decision.RuleName)
 
 	// Pattern in html only - should reject
-	rejected, ruleName = checkFilterRules("from@test.com", "to@test.com", "subject", "", "<a href='http://adnxs.com'>link</a>")
-	require.True(t, rejected)
-	require.Equal(t, "block-tracking-url", ruleName)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", HTML: "<a href='http://adnxs.com'>link</a>"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-tracking-url", decision.RuleName)
 
 	// Pattern in both - should reject
-	rejected, _ = checkFilterRules("from@test.com", "to@test.com", "subject", "adnxs.com", "<a href='adnxs.com'>link</a>")
-	require.True(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", Body: "adnxs.com", HTML: "<a href='adnxs.com'>link</a>"})
+	require.Equal(t, FilterActionReject, decision.Action)
 
 	// Pattern in neither - should not reject
-	rejected, _ = checkFilterRules("from@test.com", "to@test.com", "subject", "clean body", "<p>clean html</p>")
-	require.False(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", Body: "clean body", HTML: "<p>clean html</p>"})
+	require.Empty(t, decision.Action)
 }
 
 func TestFilterRulesHtmlOnlyEmail(t *testing.T) {
@@ -1138,12 +1351,12 @@ func TestFilterRulesHtmlOnlyEmail(t *testing.T) {
 	require.NoError(t, err)
 
 	// URL only in HTML - should reject
-	rejected, _ := checkFilterRules("from@test.com", "to@test.com", "subject", "", "<a href='http://spam.xyz/click'>Click here</a>")
-	require.True(t, rejected)
+	decision := checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", HTML: "<a href='http://spam.xyz/click'>Click here</a>"})
+	require.Equal(t, FilterActionReject, decision.Action)
 
 	// Clean HTML - should not reject
-	rejected, _ = checkFilterRules("from@test.com", "to@test.com", "subject", "", "<p>Hello world</p>")
-	require.False(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "subject", HTML: "<p>Hello world</p>"})
+	require.Empty(t, decision.Action)
 }
 
 func TestFilterRulesFirstMatchWins(t *testing.T) {
@@ -1171,9 +1384,46 @@ func TestFilterRulesFirstMatchWins(t *testing.T) {
 	require.NoError(t, err)
 
 	// Both rules would match, but first wins
-	rejected, ruleName := checkFilterRules("from@test.com", "to@test.com", "test subject", "body", "")
-	require.True(t, rejected)
-	require.Equal(t, "first-rule", ruleName)
+	decision := checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "test subject", Body: "body"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "first-rule", decision.RuleName)
+}
+
+func TestFilterRulesFromAndEnvelopeFrom(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "filter_rules_envelope_from*.yaml")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(tmpfile.Name()) }()
+
+	content := `filter_rules:
+  - name: block-sender
+    conditions:
+      - field: from
+        pattern: '^spam@example\.com$'
+
+  - name: block-bounces
+    conditions:
+      - field: envelope_from
+        pattern: '@mailer\.example$'
+`
+	_, err = tmpfile.WriteString(content)
+	require.NoError(t, err)
+	require.NoError(t, tmpfile.Close())
+
+	_, err = loadConfig(tmpfile.Name())
+	require.NoError(t, err)
+
+	// The bare address of a display name matches anchored patterns
+	decision := checkFilterRules(&FilterInput{From: "Spammer <spam@example.com>", To: "to@test.com", Subject: "subject", Body: "body", EnvelopeFrom: "other@test.com"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-sender", decision.RuleName)
+
+	decision = checkFilterRules(&FilterInput{From: "News <news@example.com>", To: "to@test.com", Subject: "subject", Body: "body", EnvelopeFrom: "bounce-1@mailer.example"})
+	require.Equal(t, FilterActionReject, decision.Action)
+	require.Equal(t, "block-bounces", decision.RuleName)
+
+	// The header From doesn't match envelope_from rules
+	decision = checkFilterRules(&FilterInput{From: "bounce-1@mailer.example", To: "to@test.com", Subject: "subject", Body: "body", EnvelopeFrom: "news@example.com"})
+	require.Empty(t, decision.Action)
 }
 
 func TestFilterRulesCaseInsensitive(t *testing.T) {
@@ -1196,23 +1446,23 @@ func TestFilterRulesCaseInsensitive(t *testing.T) {
 	require.NoError(t, err)
 
 	// Pattern is lowercase, but should match uppercase
-	rejected, _ := checkFilterRules("from@test.com", "to@test.com", "SPAM MESSAGE", "body", "")
-	require.True(t, rejected)
+	decision := checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "SPAM MESSAGE", Body: "body"})
+	require.Equal(t, FilterActionReject, decision.Action)
 
 	// Mixed case should also match
-	rejected, _ = checkFilterRules("from@test.com", "to@test.com", "SpAm MeSsAgE", "body", "")
-	require.True(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "SpAm MeSsAgE", Body: "body"})
+	require.Equal(t, FilterActionReject, decision.Action)
 
 	// Lowercase should match too
-	rejected, _ = checkFilterRules("from@test.com", "to@test.com", "spam message", "body", "")
-	require.True(t, rejected)
+	decision = checkFilterRules(&FilterInput{From: "from@test.com", To: "to@test.com", Subject: "spam message", Body: "body"})
+	require.Equal(t, FilterActionReject, decision.Action)
 }
 
 func TestFilterRulesNoRulesLoaded(t *testing.T) {
-	filterRules = nil
+	activeRules.Store(nil)
 
-	rejected, _ := checkFilterRules("any@email.com", "to@test.com", "any subject", "any body", "any html")
-	require.False(t, rejected)
+	decision := checkFilterRules(&FilterInput{From: "any@email.com", To: "to@test.com", Subject: "any subject", Body: "any body", HTML: "any html"})
+	require.Empty(t, decision.Action)
 }
 
 func TestFilterRulesEmptyConditions(t *testing.T) {
@@ -1233,8 +1483,8 @@ func TestFilterRulesEmptyConditions(t *testing.T) {
 	require.NoError(t, err)
 
 	// Empty conditions should not match
-	rejected, _ := checkFilterRules("any@email.com", "to@test.com", "any subject", "any body", "")
-	require.False(t, rejected)
+	decision := checkFilterRules(&FilterInput{From: "any@email.com", To: "to@test.com", Subject: "any subject", Body: "any body"})
+	require.Empty(t, decision.Action)
 }
 
 func TestSMTPStartWithNonExistentFilterRulesFile(t *testing.T) {
@@ -1422,9 +1672,10 @@ func TestLoadConfigYAMLCredentialsWithoutHost(t *testing.T) {
 	require.NoError(t, err)
 	require.NoError(t, tmpfile.Close())
 
-	smtpOut, err := loadConfig(tmpfile.Name())
+	config, err := loadConfig(tmpfile.Name())
 	require.NoError(t, err)
-	require.NotNil(t, smtpOut)
+	require.NotNil(t, config)
+	smtpOut := config.SMTPOut
 	require.Empty(t, smtpOut.Host)
 	require.Equal(t, 587, smtpOut.Port)
 	require.Equal(t, "user@test", smtpOut.Username)
@@ -1442,7 +1693,7 @@ func TestFormatMessageMinimalHeaderOnHugeTo(t *testing.T) {
 	subject := "Hello"
 	text := "body"
 
-	full, truncated := FormatMessage(from, to, subject, text, "", "", "", 80)
+	full, truncated := FormatMessage(MessageContent{From: from, To: to, Subject: subject, Text: text}, 80, false)
 	require.NotEmpty(t, truncated)
 	// The truncated message must contain parseable From/To/Subject headers
 	headers, err := ParseMessageHeaders(truncated)
@@ -1453,3 +1704,61 @@ func TestFormatMessageMinimalHeaderOnHugeTo(t *testing.T) {
 	// Full message still contains everything
 	require.Contains(t, full, to)
 }
+
+func TestParseChatTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    ChatTarget
+		wantErr bool
+	}{
+		{name: "chat only", input: "42", want: ChatTarget{ChatID: 42}},
+		{name: "supergroup", input: "-1001234567890", want: ChatTarget{ChatID: -1001234567890}},
+		{name: "with thread", input: "-1001234567890:15", want: ChatTarget{ChatID: -1001234567890, ThreadID: 15}},
+		{name: "with spaces", input: " 42:3 ", want: ChatTarget{ChatID: 42, ThreadID: 3}},
+		{name: "invalid chat", input: "abc:3", wantErr: true},
+		{name: "invalid thread", input: "42:abc", wantErr: true},
+		{name: "zero thread", input: "42:0", wantErr: true},
+		{name: "empty thread", input: "42:", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseChatTarget(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, strings.TrimSpace(tt.input), got.String())
+		})
+	}
+}
+
+func TestForumTopicDelivery(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.ChatIDs = "42,-100142:7"
+	telegramConfig.ForwardedAttachmentMaxSize = 1024
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Test subj")
+	m.SetBody("text/plain", "Text body")
+	m.Attach("hey.txt", goMailBody([]byte("hi")))
+
+	di := gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "")
+	err := di.DialAndSend(m)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"42", "-100142"}, h.RequestChatIDs)
+	// message + attachment for each chat, in order
+	require.Equal(t, []string{"", "", "7", "7"}, h.RequestThreadIDs)
+}
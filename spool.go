@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	spoolDeadLetterDir = "dead"
+	spoolPollInterval  = 5 * time.Second
+	spoolRetryMin      = 30 * time.Second
+	spoolRetryMax      = 30 * time.Minute
+)
+
+// SpoolItem is an email waiting for delivery to Telegram, stored as JSON.
+type SpoolItem struct {
+	ID             string         `json:"id"`
+	RemoteIP       string         `json:"remote_ip"`
+	Helo           string         `json:"helo"`
+	MailFrom       mail.Address   `json:"mail_from"`
+	AuthUser       string         `json:"auth_user,omitempty"`
+	RcptTo         []mail.Address `json:"rcpt_to"`
+	DeliveryHeader string         `json:"delivery_header"`
+	Data           []byte         `json:"data"`
+	ReceivedAt     time.Time      `json:"received_at"`
+	Delivered      []string       `json:"delivered"` // chats which got the email
+	// AttachmentsPending are the chats which got the message, by its ID, but
+	// not all of its attachments.
+	AttachmentsPending map[string]json.Number `json:"attachments_pending,omitempty"`
+	Attempts           int                    `json:"attempts"`
+	NextAttempt        time.Time              `json:"next_attempt"`
+	LastError          string                 `json:"last_error"`
+}
+
+func (item *SpoolItem) envelope() *mail.Envelope {
+	envelope := &mail.Envelope{
+		RemoteIP:       item.RemoteIP,
+		Helo:           item.Helo,
+		MailFrom:       item.MailFrom,
+		RcptTo:         item.RcptTo,
+		DeliveryHeader: item.DeliveryHeader,
+		Values:         make(map[string]any),
+		QueuedId:       item.ID,
+	}
+	if item.AuthUser != "" {
+		envelope.Values[envelopeAuthUser] = item.AuthUser
+	}
+	envelope.Data.Write(item.Data)
+	return envelope
+}
+
+// Spool keeps emails that could not be delivered to Telegram on disk and
+// retries them with exponential backoff until they are older than maxAge,
+// after which they are moved to the dead-letter folder.
+type Spool struct {
+	dir            string
+	maxAge         time.Duration
+	telegramConfig *TelegramConfig
+	store          *MessageStore
+
+	mu     sync.Mutex // serializes delivery attempts
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewSpool(dir string, maxAge time.Duration, telegramConfig *TelegramConfig, store *MessageStore) (*Spool, error) {
+	if err := os.MkdirAll(filepath.Join(dir, spoolDeadLetterDir), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	return &Spool{dir: dir, maxAge: maxAge, telegramConfig: telegramConfig, store: store}, nil
+}
+
+// Enqueue stores the envelope for a later delivery attempt to the chats
+// which didn't get it yet.
+func (s *Spool) Enqueue(envelope *mail.Envelope, sent []SentMessage, cause error) error {
+	id, err := newSpoolID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	item := &SpoolItem{
+		ID:             id,
+		RemoteIP:       envelope.RemoteIP,
+		Helo:           envelope.Helo,
+		MailFrom:       envelope.MailFrom,
+		AuthUser:       authUser(envelope),
+		RcptTo:         envelope.RcptTo,
+		DeliveryHeader: envelope.DeliveryHeader,
+		Data:           envelope.Data.Bytes(),
+		ReceivedAt:     now,
+		Attempts:       1,
+		NextAttempt:    now.Add(spoolBackoff(1)),
+		LastError:      cause.Error(),
+	}
+	item.addSent(sent)
+	if err := s.save(item); err != nil {
+		return err
+	}
+	logger.Infof("Spooled email %s for retry: %s", id, cause)
+	return nil
+}
+
+// Start resumes the items left in the spool directory and keeps retrying
+// them in the background until Shutdown is called.
+func (s *Spool) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(spoolPollInterval)
+		defer ticker.Stop()
+		for {
+			s.processPending(ctx, false)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Shutdown stops the background worker and makes a final delivery attempt
+// for every pending item, regardless of its backoff, until ctx expires.
+// Items which still fail stay on disk and are resumed on the next start.
+func (s *Spool) Shutdown(ctx context.Context) {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	s.processPending(ctx, true)
+}
+
+func (s *Spool) processPending(ctx context.Context, force bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := s.pending()
+	if err != nil {
+		logger.Errorf("Failed to list spool directory: %s", err)
+		return
+	}
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return
+		}
+		s.process(path, force)
+	}
+}
+
+func (s *Spool) process(path string, force bool) {
+	item, err := loadSpoolItem(path)
+	if err != nil {
+		logger.Errorf("Failed to load spooled email %s: %s", path, err)
+		s.moveToDeadLetter(path)
+		return
+	}
+	now := time.Now()
+	if !force && now.Before(item.NextAttempt) {
+		return
+	}
+
+	delivered, err := item.sent()
+	if err != nil {
+		logger.Errorf("Failed to load spooled email %s: %s", path, err)
+		s.moveToDeadLetter(path)
+		return
+	}
+	sent, err := SendEmailToTelegram(item.envelope(), s.telegramConfig, s.store, delivered)
+	if err == nil {
+		logger.Infof("Delivered spooled email %s after %d attempts", item.ID, item.Attempts+1)
+		if err := os.Remove(path); err != nil {
+			logger.Errorf("Failed to remove delivered spooled email %s: %s", item.ID, err)
+		}
+		return
+	}
+
+	item.Attempts++
+	item.LastError = err.Error()
+	item.addSent(sent)
+	if !errors.Is(err, errSanitizedTelegramFail) {
+		if !errors.Is(err, errRejectedByFilter) {
+			metricEmailsFailed.Inc()
+		}
+		logger.Errorf("Spooled email %s failed permanently: %s", item.ID, err)
+		s.moveToDeadLetter(path)
+		return
+	}
+	if now.Sub(item.ReceivedAt) > s.maxAge {
+		metricEmailsFailed.Inc()
+		logger.Errorf("Spooled email %s expired after %d attempts: %s", item.ID, item.Attempts, err)
+		if err := s.save(item); err != nil {
+			logger.Errorf("Failed to update spooled email %s: %s", item.ID, err)
+		}
+		s.moveToDeadLetter(path)
+		return
+	}
+	item.NextAttempt = now.Add(spoolBackoff(item.Attempts))
+	logger.Warningf("Spooled email %s delivery attempt %d failed, next attempt at %s: %s",
+		item.ID, item.Attempts, item.NextAttempt.Format(time.RFC3339), err)
+	if err := s.save(item); err != nil {
+		logger.Errorf("Failed to update spooled email %s: %s", item.ID, err)
+	}
+}
+
+// pending returns the paths of spooled items, oldest first.
+func (s *Spool) pending() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".json") {
+			paths = append(paths, filepath.Join(s.dir, entry.Name()))
+		}
+	}
+	// IDs start with a timestamp, so lexical order is arrival order.
+	slices.Sort(paths)
+	return paths, nil
+}
+
+// save writes the item atomically so a crash never leaves a partial file.
+func (s *Spool) save(item *SpoolItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode spool item: %w", err)
+	}
+	path := filepath.Join(s.dir, item.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write spool item: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write spool item: %w", err)
+	}
+	return nil
+}
+
+func (s *Spool) moveToDeadLetter(path string) {
+	if err := os.Rename(path, filepath.Join(s.dir, spoolDeadLetterDir, filepath.Base(path))); err != nil {
+		logger.Errorf("Failed to move %s to the dead-letter folder: %s", path, err)
+	}
+}
+
+func loadSpoolItem(path string) (*SpoolItem, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // Path comes from listing the spool directory
+	if err != nil {
+		return nil, err
+	}
+	item := &SpoolItem{}
+	if err := json.Unmarshal(data, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// addSent records the messages sent by a delivery attempt.
+func (item *SpoolItem) addSent(sent []SentMessage) {
+	for _, m := range sent {
+		chat := m.Chat.String()
+		if m.AttachmentsPending {
+			if item.AttachmentsPending == nil {
+				item.AttachmentsPending = make(map[string]json.Number)
+			}
+			item.AttachmentsPending[chat] = m.MessageID
+			continue
+		}
+		delete(item.AttachmentsPending, chat)
+		item.Delivered = append(item.Delivered, chat)
+	}
+}
+
+// sent returns the messages sent by the earlier delivery attempts.
+func (item *SpoolItem) sent() ([]SentMessage, error) {
+	sent := make([]SentMessage, 0, len(item.Delivered)+len(item.AttachmentsPending))
+	for _, chat := range item.Delivered {
+		target, err := ParseChatTarget(chat)
+		if err != nil {
+			return nil, err
+		}
+		sent = append(sent, SentMessage{Chat: target})
+	}
+	for chat, messageID := range item.AttachmentsPending {
+		target, err := ParseChatTarget(chat)
+		if err != nil {
+			return nil, err
+		}
+		sent = append(sent, SentMessage{Chat: target, MessageID: messageID, AttachmentsPending: true})
+	}
+	return sent, nil
+}
+
+func spoolBackoff(attempts int) time.Duration {
+	backoff := spoolRetryMin
+	for range attempts - 1 {
+		backoff *= 2
+		if backoff >= spoolRetryMax {
+			return spoolRetryMax
+		}
+	}
+	return backoff
+}
+
+func newSpoolID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate spool id: %w", err)
+	}
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(b)), nil
+}
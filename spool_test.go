@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func startSMTPWithSpool(t *testing.T, telegramConfig *TelegramConfig, maxAge time.Duration) (*SMTPServer, *Spool) {
+	t.Helper()
+	smtpConfig := makeSMTPConfig()
+	_, err := loadConfig(smtpConfig.ConfigFile)
+	require.NoError(t, err)
+	spool, err := NewSpool(t.TempDir(), maxAge, telegramConfig, nil)
+	require.NoError(t, err)
+	d, err := SMTPStart(smtpConfig, telegramConfig, spool, nil)
+	require.NoError(t, err)
+	waitSMTP(smtpConfig.Listen)
+	return d, spool
+}
+
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.NoError(t, err)
+	return files
+}
+
+func TestSpoolAcceptsWhenTelegramUnreachable(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	d, spool := startSMTPWithSpool(t, telegramConfig, time.Hour)
+	defer d.Shutdown()
+
+	err := smtp.SendMail(makeSMTPConfig().Listen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	require.NoError(t, err)
+	require.Len(t, spoolFiles(t, spool.dir), 1)
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	spool.Shutdown(context.Background())
+	require.Empty(t, spoolFiles(t, spool.dir))
+	require.Len(t, h.RequestMessages, 2)
+	require.Equal(t, "From: from@test\nTo: to@test\nSubject: \n\nhi", h.RequestMessages[0])
+}
+
+func TestSpoolFilteredEmailIsNotSpooled(t *testing.T) {
+	path := writeTestConfig(t, `filter_rules:
+  - name: block-spam
+    conditions:
+      - field: body
+        pattern: 'spam'
+`)
+	telegramConfig := makeTelegramConfig()
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = path
+	_, err := loadConfig(path)
+	require.NoError(t, err)
+	spool, err := NewSpool(t.TempDir(), time.Hour, telegramConfig, nil)
+	require.NoError(t, err)
+	d, err := SMTPStart(smtpConfig, telegramConfig, spool, nil)
+	require.NoError(t, err)
+	defer d.Shutdown()
+	waitSMTP(smtpConfig.Listen)
+
+	err = smtp.SendMail(smtpConfig.Listen, nil, "from@test", []string{"to@test"}, []byte(`spam`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "554")
+	require.Empty(t, spoolFiles(t, spool.dir))
+}
+
+func TestSpoolExpiredItemMovedToDeadLetter(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	d, spool := startSMTPWithSpool(t, telegramConfig, 0)
+	defer d.Shutdown()
+
+	err := smtp.SendMail(makeSMTPConfig().Listen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	require.NoError(t, err)
+
+	spool.Shutdown(context.Background())
+	require.Empty(t, spoolFiles(t, spool.dir))
+	dead := spoolFiles(t, filepath.Join(spool.dir, spoolDeadLetterDir))
+	require.Len(t, dead, 1)
+
+	item, err := loadSpoolItem(dead[0])
+	require.NoError(t, err)
+	require.Equal(t, 2, item.Attempts)
+	require.Contains(t, item.LastError, errSanitizedTelegramFail.Error())
+	require.Contains(t, string(item.Data), "hi")
+}
+
+func TestSpoolResumesPendingItems(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	d, spool := startSMTPWithSpool(t, telegramConfig, time.Hour)
+	defer d.Shutdown()
+
+	err := smtp.SendMail(makeSMTPConfig().Listen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	require.NoError(t, err)
+
+	// A corrupt item must not block the others.
+	require.NoError(t, os.WriteFile(filepath.Join(spool.dir, "0-corrupt.json"), []byte("{"), 0o600))
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	// A fresh spool over the same directory, as after a restart.
+	restarted, err := NewSpool(spool.dir, time.Hour, telegramConfig, nil)
+	require.NoError(t, err)
+	restarted.Shutdown(context.Background())
+
+	require.Empty(t, spoolFiles(t, spool.dir))
+	require.Len(t, spoolFiles(t, filepath.Join(spool.dir, spoolDeadLetterDir)), 1)
+	require.Len(t, h.RequestMessages, 2)
+}
+
+func TestSpoolRetriesOnlyFailedChats(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	d, spool := startSMTPWithSpool(t, telegramConfig, time.Hour)
+	defer d.Shutdown()
+
+	// Chat 142 is unavailable until the spool retries
+	var failing atomic.Bool
+	failing.Store(true)
+	h := NewSuccessHandler()
+	s := HTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() && r.FormValue("chat_id") == "142" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	err := smtp.SendMail(makeSMTPConfig().Listen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	require.NoError(t, err)
+	files := spoolFiles(t, spool.dir)
+	require.Len(t, files, 1)
+	item, err := loadSpoolItem(files[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{"42"}, item.Delivered)
+
+	failing.Store(false)
+	spool.Shutdown(context.Background())
+	require.Empty(t, spoolFiles(t, spool.dir))
+	require.Equal(t, []string{"42", "142"}, h.RequestChatIDs)
+}
+
+func TestSpoolRetriesOnlyFailedAttachments(t *testing.T) {
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.ForwardedAttachmentMaxSize = 1024
+	d, spool := startSMTPWithSpool(t, telegramConfig, time.Hour)
+	defer d.Shutdown()
+
+	// The attachment can't be sent to chat 142 until the spool retries
+	var failing atomic.Bool
+	failing.Store(true)
+	h := NewSuccessHandler()
+	s := HTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() && !strings.Contains(r.URL.Path, "sendMessage") && r.FormValue("chat_id") == "142" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Test subj")
+	m.SetBody("text/plain", "Text body")
+	m.Attach("report.txt", gomail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write([]byte("report"))
+		return err
+	}))
+	require.NoError(t, gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "").DialAndSend(m))
+	files := spoolFiles(t, spool.dir)
+	require.Len(t, files, 1)
+	item, err := loadSpoolItem(files[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{"42"}, item.Delivered)
+	require.Equal(t, map[string]json.Number{"142": "123123"}, item.AttachmentsPending)
+
+	failing.Store(false)
+	spool.Shutdown(context.Background())
+	require.Empty(t, spoolFiles(t, spool.dir))
+	// The message isn't sent to chat 142 again, only the attachment
+	require.Equal(t, []string{"42", "142"}, h.RequestChatIDs)
+	require.Len(t, h.RequestDocuments, 2)
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	require.Equal(t, spoolRetryMin, spoolBackoff(1))
+	require.Equal(t, 2*spoolRetryMin, spoolBackoff(2))
+	require.Equal(t, 8*spoolRetryMin, spoolBackoff(4))
+	require.Equal(t, spoolRetryMax, spoolBackoff(100))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const messageStorePruneInterval = time.Hour
+
+var messagesBucket = []byte("messages")
+
+// StoredMessage is what we know about the email behind a Telegram message.
+type StoredMessage struct {
+	MessageID  string    `json:"message_id"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	CC         string    `json:"cc"`
+	ReplyTo    string    `json:"reply_to"`
+	Subject    string    `json:"subject"`
+	References string    `json:"references"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (m *StoredMessage) headers() ParsedHeaders {
+	return ParsedHeaders{
+		From:       m.From,
+		To:         m.To,
+		CC:         m.CC,
+		ReplyTo:    m.ReplyTo,
+		Subject:    m.Subject,
+		MessageID:  m.MessageID,
+		References: m.References,
+	}
+}
+
+// MessageStore maps Telegram messages sent by the bot to the emails they were
+// forwarded from, so replies don't depend on parsing the message text.
+type MessageStore struct {
+	db        *bolt.DB
+	retention time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// OpenMessageStore opens (or creates) the bbolt database at path. Records
+// older than retention are removed periodically; zero keeps them forever.
+func OpenMessageStore(path string, retention time.Duration) (*MessageStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(messagesBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize message store: %w", err)
+	}
+
+	s := &MessageStore{
+		db:        db,
+		retention: retention,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go s.pruneLoop()
+	return s, nil
+}
+
+func messageKey(chatID, messageID int64) []byte {
+	return []byte(strconv.FormatInt(chatID, 10) + ":" + strconv.FormatInt(messageID, 10))
+}
+
+// Put records the email behind a message sent to the chat.
+func (s *MessageStore) Put(chatID, messageID int64, msg *StoredMessage) error {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode stored message: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(messagesBucket).Put(messageKey(chatID, messageID), value)
+	})
+}
+
+// Get returns the email behind a message, or nil if it isn't known.
+func (s *MessageStore) Get(chatID, messageID int64) (*StoredMessage, error) {
+	var msg *StoredMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(messagesBucket).Get(messageKey(chatID, messageID))
+		if value == nil {
+			return nil
+		}
+		msg = &StoredMessage{}
+		return json.Unmarshal(value, msg)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stored message: %w", err)
+	}
+	return msg, nil
+}
+
+// Prune deletes the records created before now minus the retention.
+func (s *MessageStore) Prune(now time.Time) (int, error) {
+	if s.retention <= 0 {
+		return 0, nil
+	}
+	cutoff := now.Add(-s.retention)
+	deleted := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket)
+		// Deleting while iterating makes the cursor skip keys, so collect first.
+		var expired [][]byte
+		err := bucket.ForEach(func(key, value []byte) error {
+			msg := &StoredMessage{}
+			if err := json.Unmarshal(value, msg); err != nil || msg.CreatedAt.Before(cutoff) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		deleted = len(expired)
+		return nil
+	})
+	return deleted, err
+}
+
+func (s *MessageStore) pruneLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(messageStorePruneInterval)
+	defer ticker.Stop()
+	for {
+		if deleted, err := s.Prune(time.Now()); err != nil {
+			logger.Errorf("Failed to prune message store: %s", err)
+		} else if deleted > 0 {
+			logger.Infof("Pruned %d expired records from the message store", deleted)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rememberMessage stores the email behind a forwarded message, if the store
+// is enabled (s isn't nil). Failures only affect replies, so they are logged
+// and ignored.
+func (s *MessageStore) rememberMessage(chatID int64, sentMessage *TelegramAPIMessage, message *FormattedEmail) {
+	if s == nil || sentMessage == nil {
+		return
+	}
+	messageID, err := sentMessage.MessageID.Int64()
+	if err != nil {
+		logger.Warningf("Not storing message with invalid ID %q: %s", sentMessage.MessageID, err)
+		return
+	}
+	err = s.Put(chatID, messageID, &StoredMessage{
+		MessageID:  message.MessageID,
+		From:       message.From,
+		To:         message.To,
+		CC:         message.CC,
+		ReplyTo:    message.ReplyTo,
+		Subject:    message.Subject,
+		References: message.References,
+	})
+	if err != nil {
+		logger.Errorf("Failed to store message %d in chat %d: %s", messageID, chatID, err)
+	}
+}
+
+// rememberReply stores the reply sent for a Telegram message, so that the
+// conversation can continue from the bot's confirmation. The record keeps the
+// original correspondents, with the reply as the latest message of the thread.
+func (s *MessageStore) rememberReply(chatID, messageID int64, original *ParsedHeaders, replyMessageID, references string) {
+	if s == nil {
+		return
+	}
+	err := s.Put(chatID, messageID, &StoredMessage{
+		MessageID:  replyMessageID,
+		From:       original.From,
+		To:         original.To,
+		CC:         original.CC,
+		ReplyTo:    original.ReplyTo,
+		Subject:    original.Subject,
+		References: references,
+	})
+	if err != nil {
+		logger.Errorf("Failed to store reply to message %d in chat %d: %s", messageID, chatID, err)
+	}
+}
+
+// linkReplyConfirmation makes the bot's confirmation message point to the
+// same record as the reply it confirms.
+func (s *MessageStore) linkReplyConfirmation(chatID, replyMessageID, confirmationID int64) {
+	if s == nil || confirmationID == 0 {
+		return
+	}
+	stored, err := s.Get(chatID, replyMessageID)
+	if err != nil || stored == nil {
+		return
+	}
+	if err := s.Put(chatID, confirmationID, stored); err != nil {
+		logger.Errorf("Failed to store confirmation %d in chat %d: %s", confirmationID, chatID, err)
+	}
+}
+
+func (s *MessageStore) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+	return s.db.Close()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func openTestMessageStore(t *testing.T, path string) *MessageStore {
+	t.Helper()
+	store, err := OpenMessageStore(path, 24*time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+// tempMessageStore opens a message store in a temporary directory.
+func tempMessageStore(t *testing.T) *MessageStore {
+	t.Helper()
+	return openTestMessageStore(t, filepath.Join(t.TempDir(), "messages.db"))
+}
+
+func TestMessageStorePutGet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	store, err := OpenMessageStore(path, time.Hour)
+	require.NoError(t, err)
+
+	msg := &StoredMessage{MessageID: "<1@test>", From: "a@test", To: "b@test", Subject: "Hi"}
+	require.NoError(t, store.Put(-100, 7, msg))
+
+	got, err := store.Get(-100, 7)
+	require.NoError(t, err)
+	require.Equal(t, "<1@test>", got.MessageID)
+	require.False(t, got.CreatedAt.IsZero())
+
+	got, err = store.Get(100, 7)
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	// Records survive a restart.
+	require.NoError(t, store.Close())
+	store = openTestMessageStore(t, path)
+	got, err = store.Get(-100, 7)
+	require.NoError(t, err)
+	require.Equal(t, "Hi", got.Subject)
+}
+
+func TestMessageStorePrune(t *testing.T) {
+	store := openTestMessageStore(t, filepath.Join(t.TempDir(), "messages.db"))
+	now := time.Now()
+	require.NoError(t, store.Put(42, 1, &StoredMessage{From: "old@test", CreatedAt: now.Add(-48 * time.Hour)}))
+	require.NoError(t, store.Put(42, 2, &StoredMessage{From: "new@test", CreatedAt: now.Add(-time.Hour)}))
+
+	deleted, err := store.Prune(now)
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+
+	got, err := store.Get(42, 1)
+	require.NoError(t, err)
+	require.Nil(t, got)
+	got, err = store.Get(42, 2)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+}
+
+func TestForwardedEmailIsStored(t *testing.T) {
+	store := tempMessageStore(t)
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	_, err := loadConfig(smtpConfig.ConfigFile)
+	require.NoError(t, err)
+	d, err := SMTPStart(smtpConfig, telegramConfig, nil, store)
+	require.NoError(t, err)
+	defer d.Shutdown()
+	waitSMTP(smtpConfig.Listen)
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "from@test")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Cc", "cc@test")
+	m.SetHeader("Subject", "Stored")
+	m.SetHeader("Message-ID", "<orig@test>")
+	m.SetHeader("References", "<parent@test>")
+	m.SetBody("text/plain", "body")
+	di := gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	// SuccessHandler answers every sendMessage with message_id 123123.
+	for _, chatID := range []int64{42, 142} {
+		got, err := store.Get(chatID, 123123)
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		require.Equal(t, "<orig@test>", got.MessageID)
+		require.Equal(t, "<parent@test>", got.References)
+		require.Equal(t, "Stored", got.Subject)
+		require.Equal(t, "cc@test", got.CC)
+	}
+}
+
+func TestHandleTelegramReply_UsesMessageStore(t *testing.T) {
+	store := tempMessageStore(t)
+	require.NoError(t, store.Put(42, 50, &StoredMessage{
+		From:    "sender@test",
+		To:      "me@test, other@test",
+		Subject: "Multi\nline subject",
+	}))
+
+	received := make(chan testEmail, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	go runTestSMTPServer(t, ln, received)
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	// The message text alone can't be parsed.
+	update := makeBotReplyUpdate(999, "[truncated]", "My reply")
+	notification := HandleTelegramReply(update, &SMTPOutConfig{Host: host, Port: port}, store, 999, []string{"."}, nil)
+	require.Contains(t, notification, "Email sent from me@test to sender@test, other@test")
+
+	msg := <-received
+	require.Equal(t, "me@test", msg.from)
+	require.Contains(t, msg.data, "My reply")
+}
+
+func TestHandleTelegramReply_FallsBackToText(t *testing.T) {
+	store := tempMessageStore(t)
+
+	update := makeBotReplyUpdate(999, "just some random text", "Reply text")
+	notification := HandleTelegramReply(update, &SMTPOutConfig{Host: "localhost", Port: 25}, store, 999, []string{"."}, nil)
+	require.Contains(t, notification, "Could not parse")
+}
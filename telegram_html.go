@@ -0,0 +1,371 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Telegram supports only a small subset of HTML, see
+// https://core.telegram.org/bots/api#html-style
+
+// telegramInlineTags maps email HTML elements to the supported formatting tags.
+var telegramInlineTags = map[atom.Atom]string{
+	atom.B:      "b",
+	atom.Strong: "b",
+	atom.I:      "i",
+	atom.Em:     "i",
+	atom.Cite:   "i",
+	atom.U:      "u",
+	atom.Ins:    "u",
+	atom.S:      "s",
+	atom.Strike: "s",
+	atom.Del:    "s",
+	atom.Code:   "code",
+	atom.Kbd:    "code",
+	atom.Samp:   "code",
+	atom.Tt:     "code",
+}
+
+// Elements separated from the surrounding text by an empty line.
+var htmlParagraphElements = map[atom.Atom]bool{
+	atom.P: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Ul: true, atom.Ol: true, atom.Dl: true, atom.Table: true, atom.Blockquote: true, atom.Pre: true,
+}
+
+// Elements starting on a new line.
+var htmlLineElements = map[atom.Atom]bool{
+	atom.Div: true, atom.Tr: true, atom.Li: true, atom.Dt: true, atom.Dd: true, atom.Hr: true,
+	atom.Section: true, atom.Article: true, atom.Header: true, atom.Footer: true, atom.Nav: true,
+	atom.Main: true, atom.Aside: true, atom.Address: true, atom.Center: true, atom.Figure: true,
+	atom.Form: true, atom.Fieldset: true, atom.Caption: true, atom.Tbody: true, atom.Thead: true,
+	atom.Tfoot: true,
+}
+
+// Elements whose content is never shown.
+var htmlSkippedElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Title: true, atom.Script: true, atom.Style: true, atom.Template: true,
+	atom.Noscript: true, atom.Select: true, atom.Button: true,
+}
+
+// ConvertHTMLToTelegram renders an email HTML body as Telegram HTML: supported
+// formatting is kept, block elements become line breaks, table cells are
+// separated with " | " and everything else is escaped.
+func ConvertHTMLToTelegram(src string) string {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		// html.Parse only fails on reader errors.
+		return escapeHTML(src)
+	}
+	c := &htmlConverter{}
+	c.walk(doc)
+	return strings.TrimSpace(c.sb.String())
+}
+
+type htmlConverter struct {
+	sb       strings.Builder
+	hasText  bool // anything visible has been written
+	newlines int  // newlines at the end of the output, ignoring tags
+	pending  int  // newlines to write before the next text
+	space    bool // whitespace to write before the next text
+	verbatim int  // depth of pre/code elements, which can't contain other tags
+	inLink   bool
+}
+
+func (c *htmlConverter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		c.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			c.walk(child)
+		}
+		return
+	}
+
+	if htmlSkippedElements[n.DataAtom] {
+		return
+	}
+	switch n.DataAtom {
+	case atom.Br:
+		c.flush()
+		if c.hasText {
+			c.sb.WriteByte('\n')
+			c.newlines++
+		}
+		c.space = false
+		return
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			c.text("[" + alt + "]")
+		}
+		return
+	case atom.Td, atom.Th:
+		if n.PrevSibling != nil {
+			c.text(" | ")
+		}
+	}
+
+	switch {
+	case htmlParagraphElements[n.DataAtom]:
+		c.breakLines(2)
+		defer c.breakLines(2)
+	case htmlLineElements[n.DataAtom]:
+		c.breakLines(1)
+		defer c.breakLines(1)
+	}
+	if n.DataAtom == atom.Li {
+		c.text("• ")
+	}
+	if n.DataAtom == atom.Hr {
+		c.text("――――――――")
+	}
+
+	var tag string
+	switch {
+	case n.DataAtom == atom.Pre || n.DataAtom == atom.Blockquote:
+		tag = n.Data
+	case isHeading(n.DataAtom):
+		tag = "b"
+	case n.DataAtom == atom.A:
+		if href := attr(n, "href"); !c.inLink && isSafeLink(href) {
+			tag = "a"
+		}
+	default:
+		tag = telegramInlineTags[n.DataAtom]
+	}
+	if c.verbatim > 0 {
+		tag = "" // no formatting inside code blocks
+	}
+
+	if tag != "" {
+		c.flush()
+		if c.space && c.hasText && c.newlines == 0 {
+			c.sb.WriteByte(' ')
+			c.space = false
+		}
+		if tag == "a" {
+			c.write(`<a href="` + escapeHTML(attr(n, "href")) + `">`)
+			c.inLink = true
+		} else {
+			c.write("<" + tag + ">")
+		}
+		if tag == "pre" || tag == "code" {
+			c.verbatim++
+		}
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.walk(child)
+	}
+	if tag != "" {
+		c.write("</" + tag + ">")
+		switch tag {
+		case "a":
+			c.inLink = false
+		case "pre", "code":
+			c.verbatim--
+		}
+	}
+}
+
+func isHeading(a atom.Atom) bool {
+	switch a {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		return true
+	}
+	return false
+}
+
+// text writes escaped text, collapsing whitespace outside of code blocks.
+func (c *htmlConverter) text(s string) {
+	if c.verbatim > 0 {
+		if s == "" {
+			return
+		}
+		c.flush()
+		c.write(escapeHTML(s))
+		if trimmed := strings.TrimRight(s, "\n"); trimmed == "" {
+			c.newlines += len(s)
+		} else {
+			c.newlines = len(s) - len(trimmed)
+		}
+		return
+	}
+
+	words := strings.Fields(s)
+	leadingSpace := s != "" && unicode.IsSpace(rune(s[0]))
+	trailingSpace := s != "" && unicode.IsSpace(rune(s[len(s)-1]))
+	if len(words) == 0 {
+		c.space = c.space || leadingSpace
+		return
+	}
+	c.flush()
+	if (c.space || leadingSpace) && c.hasText && c.newlines == 0 {
+		c.sb.WriteByte(' ')
+	}
+	c.write(escapeHTML(strings.Join(words, " ")))
+	c.newlines = 0
+	c.space = trailingSpace
+}
+
+func (c *htmlConverter) breakLines(n int) {
+	c.pending = max(c.pending, n)
+}
+
+// flush writes the pending line breaks, if there is text before them.
+func (c *htmlConverter) flush() {
+	if !c.hasText {
+		c.pending = 0
+		c.space = false
+		return
+	}
+	if c.pending > c.newlines {
+		c.sb.WriteString(strings.Repeat("\n", c.pending-c.newlines))
+		c.newlines = c.pending
+	}
+	if c.pending > 0 {
+		c.space = false
+	}
+	c.pending = 0
+}
+
+// write appends markup or escaped text to the output.
+func (c *htmlConverter) write(s string) {
+	c.sb.WriteString(s)
+	if !strings.HasPrefix(s, "<") {
+		c.hasText = true
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func isSafeLink(href string) bool {
+	lower := strings.ToLower(strings.TrimSpace(href))
+	for _, scheme := range []string{"http://", "https://", "mailto:", "tg://"} {
+		if strings.HasPrefix(lower, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func escapeHTML(s string) string {
+	return html.EscapeString(s)
+}
+
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// htmlText returns the text Telegram shows for s sent with parse_mode=HTML.
+func htmlText(s string) string {
+	return html.UnescapeString(htmlTagRe.ReplaceAllString(s, ""))
+}
+
+// truncateHTML cuts s to at most limit runes without breaking a tag or an
+// entity, closing the elements left open at the cut.
+func truncateHTML(s string, limit uint) string {
+	return closeHTML(s[:htmlCutIndex(s, limit)])
+}
+
+// htmlCutIndex returns the last position in s where it can be cut so that it
+// takes at most limit runes with the elements left open closed.
+func htmlCutIndex(s string, limit uint) int {
+	// The cost of cutting at a position is the runes before it plus the
+	// closing tags needed there. It never decreases, so the last position
+	// within the limit is the best one.
+	var stack []string
+	closersLen := 0
+	runes := uint(0)
+	best := 0
+	for i := 0; i < len(s); {
+		if runes+uint(closersLen) > limit {
+			break
+		}
+		best = i
+
+		token := s[i:]
+		switch s[i] {
+		case '<':
+			if end := strings.IndexByte(token, '>'); end >= 0 {
+				token = token[:end+1]
+				if name, closing := htmlTagName(token); closing {
+					if len(stack) > 0 {
+						closersLen -= len(stack[len(stack)-1]) + 3
+						stack = stack[:len(stack)-1]
+					}
+				} else {
+					stack = append(stack, name)
+					closersLen += len(name) + 3
+				}
+			} else {
+				_, size := utf8.DecodeRuneInString(token)
+				token = token[:size]
+			}
+		case '&':
+			if end := strings.IndexByte(token, ';'); end >= 0 && !strings.ContainsAny(token[1:end], " <&") {
+				token = token[:end+1]
+			} else {
+				token = token[:1]
+			}
+		default:
+			_, size := utf8.DecodeRuneInString(token)
+			token = token[:size]
+		}
+		i += len(token)
+		runes += uint(utf8.RuneCountInString(token))
+		if i == len(s) && runes+uint(closersLen) <= limit {
+			best = i
+		}
+	}
+	return best
+}
+
+// closeHTML closes the elements left open in s.
+func closeHTML(s string) string {
+	var stack []string
+	for i := 0; i < len(s); {
+		end := strings.IndexByte(s[i:], '<')
+		if end < 0 {
+			break
+		}
+		i += end
+		tagEnd := strings.IndexByte(s[i:], '>')
+		if tagEnd < 0 {
+			break
+		}
+		if name, closing := htmlTagName(s[i : i+tagEnd+1]); closing {
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		} else {
+			stack = append(stack, name)
+		}
+		i += tagEnd + 1
+	}
+	var sb strings.Builder
+	sb.WriteString(s)
+	for i := len(stack) - 1; i >= 0; i-- {
+		sb.WriteString("</" + stack[i] + ">")
+	}
+	return sb.String()
+}
+
+// htmlTagName returns the name of a tag like <a href="..."> or </a>.
+func htmlTagName(tag string) (name string, closing bool) {
+	tag = strings.TrimSuffix(strings.TrimPrefix(tag, "<"), ">")
+	tag, closing = strings.CutPrefix(tag, "/")
+	name, _, _ = strings.Cut(tag, " ")
+	return name, closing
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+func TestConvertHTMLToTelegram(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "formatting",
+			html: `<p>Job <b>backup</b> <em>failed</em> on <strong>db1</strong></p>`,
+			want: "Job <b>backup</b> <i>failed</i> on <b>db1</b>",
+		},
+		{
+			name: "escaping",
+			html: `<p>1 &lt; 2 &amp; <span class="x">3 > 2</span></p>`,
+			want: "1 &lt; 2 &amp; 3 &gt; 2",
+		},
+		{
+			name: "links",
+			html: `<a href="https://example.com/?a=1&amp;b=2">details</a> <a href="javascript:alert(1)">bad</a>`,
+			want: `<a href="https://example.com/?a=1&amp;b=2">details</a> bad`,
+		},
+		{
+			name: "paragraphs and line breaks",
+			html: "<html><head><title>T</title><style>p{}</style></head><body>" +
+				"<h1>Alert</h1><p>first\n   line<br>second line</p><div>third</div><p>fourth</p></body></html>",
+			want: "<b>Alert</b>\n\nfirst line\nsecond line\n\nthird\n\nfourth",
+		},
+		{
+			name: "lists",
+			html: "<ul><li>one</li><li>two</li></ul>",
+			want: "• one\n• two",
+		},
+		{
+			name: "tables",
+			html: "<table><tr><th>Host</th><th>Status</th></tr><tr><td>db1</td><td><b>down</b></td></tr></table>",
+			want: "Host | Status\ndb1 | <b>down</b>",
+		},
+		{
+			name: "code blocks",
+			html: "<pre>if a &lt; b {\n  <b>return</b>\n}</pre><p>inline <code>x <i>y</i></code></p>",
+			want: "<pre>if a &lt; b {\n  return\n}</pre>\n\ninline <code>x y</code>",
+		},
+		{
+			name: "blockquote",
+			html: "<p>wrote:</p><blockquote><p>quoted</p></blockquote>",
+			want: "wrote:\n\n<blockquote>quoted</blockquote>",
+		},
+		{
+			name: "unclosed tags",
+			html: "<b>bold <i>both",
+			want: "<b>bold <i>both</i></b>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, ConvertHTMLToTelegram(tt.html))
+		})
+	}
+}
+
+func TestTruncateHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     string
+		limit uint
+		want  string
+	}{
+		{"fits", "<b>abc</b>", 10, "<b>abc</b>"},
+		{"closes open tags", "<b>abcdef</b>", 9, "<b>ab</b>"},
+		{"never splits a tag", `ab<a href="https://x">cd</a>`, 10, "ab"},
+		{"never splits an entity", "ab&amp;cd", 4, "ab"},
+		{"nested", "<b><i>abcdef</i></b>", 16, "<b><i>ab</i></b>"},
+		{"after closed element", "<b>ab</b>cdef", 11, "<b>ab</b>cd"},
+		{"unicode", "приветствую", 6, "привет"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateHTML(tt.s, tt.limit)
+			require.Equal(t, tt.want, got)
+			require.LessOrEqual(t, len([]rune(got)), int(tt.limit))
+		})
+	}
+}
+
+func TestFormatMessageHTMLTruncation(t *testing.T) {
+	body := strings.Repeat("<b>bold &amp; text</b> <a href=\"https://example.com\">link</a>\n", 20)
+	full, truncated := FormatMessage(MessageContent{
+		From:    "Alice <alice@example.com>",
+		To:      "bob@example.com",
+		Subject: "a < b",
+		Text:    body,
+	}, 200, true)
+
+	require.Contains(t, full, "From: Alice &lt;alice@example.com&gt;\n")
+	require.NotEmpty(t, truncated)
+	require.LessOrEqual(t, len([]rune(truncated)), 200)
+	require.Regexp(t, `\n\n\[truncated: \d+ characters, \d+ lines\]$`, truncated)
+	require.Equal(t, strings.Count(truncated, "<b>"), strings.Count(truncated, "</b>"))
+	require.Equal(t, strings.Count(truncated, "<a "), strings.Count(truncated, "</a>"))
+
+	headers, err := ParseMessageHeaders(htmlText(truncated))
+	require.NoError(t, err)
+	require.Equal(t, "Alice <alice@example.com>", headers.From)
+	require.Equal(t, "bob@example.com", headers.To)
+	require.Equal(t, "a < b", headers.Subject)
+}
+
+func TestHTMLMessageFormat(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.MessageFormat = MessageFormatHTML
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "Monitoring <from@test>")
+	m.SetHeader("To", "to@test")
+	m.SetHeader("Subject", "Disk <full>")
+	m.SetBody("text/html", `<p>Host <b>db1</b> is <a href="https://example.com/db1">down</a></p>`)
+
+	di := gomail.NewDialer(testSMTPListenHost, testSMTPListenPort, "", "")
+	require.NoError(t, di.DialAndSend(m))
+
+	require.Len(t, h.RequestMessages, 2)
+	require.Equal(t, "HTML", h.RequestParseModes[0])
+	require.Equal(t,
+		"From: Monitoring &lt;from@test&gt;\n"+
+			"To: to@test\n"+
+			"Subject: Disk &lt;full&gt;\n"+
+			"\n"+
+			`Host <b>db1</b> is <a href="https://example.com/db1">down</a>`,
+		h.RequestMessages[0])
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Telegram limits: about one message per second in a chat and 20 messages per
+// minute in a group. See https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+const (
+	telegramChatInterval = time.Second
+	telegramGroupLimit   = 20
+	telegramGroupWindow  = time.Minute
+
+	// Longest wait for a send slot or a retry_after before giving up, so
+	// that the email is rejected (or spooled) before the SMTP save timeout.
+	telegramMaxWait    = 20 * time.Second
+	telegramMaxRetries = 3
+
+	// Longest time to forward one email to all its chats. It is below the
+	// 30s save timeout of guerrilla, which answers the client on its own
+	// once it expires while the email may still be forwarded.
+	telegramEmailTimeout = 25 * time.Second
+)
+
+var (
+	telegramSender = NewTelegramSender(telegramChatInterval, telegramGroupLimit)
+
+	errTelegramRateLimited = errors.New("telegram rate limit exceeded")
+)
+
+// TelegramAPIError is the body of an unsuccessful Bot API response.
+type TelegramAPIError struct {
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// TelegramSender paces Bot API requests per chat and retries the ones
+// rejected with 429 after the delay requested by Telegram. It is shared by
+// all the senders of the process, so the limits hold across save workers.
+type TelegramSender struct {
+	chatInterval time.Duration
+	groupLimit   int
+
+	mu    sync.Mutex
+	chats map[int64]*chatSchedule
+}
+
+type chatSchedule struct {
+	blockedUntil time.Time   // set from retry_after
+	sent         []time.Time // reserved send times within the last group window
+}
+
+// NewTelegramSender returns a sender allowing one request per chatInterval in
+// every chat and at most groupLimit requests per minute in a group. Zero
+// values disable the corresponding limit.
+func NewTelegramSender(chatInterval time.Duration, groupLimit int) *TelegramSender {
+	return &TelegramSender{
+		chatInterval: chatInterval,
+		groupLimit:   groupLimit,
+		chats:        make(map[int64]*chatSchedule),
+	}
+}
+
+// Do sends the request built by newRequest to the chat, waiting for a free
+// slot first. Responses other than 429 are returned to the caller as is.
+// newRequest is called for every attempt, since a request body can only be
+// read once.
+func (s *TelegramSender) Do(
+	ctx context.Context,
+	client *http.Client,
+	chatID int64,
+	newRequest func() (*http.Request, error),
+) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := s.wait(ctx, chatID); err != nil {
+			return nil, err
+		}
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		observeTelegramRequest(req, start, resp, err)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			logger.Warningf("Failed to close response body: %v", closeErr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errReadingJSON, err)
+		}
+		retryAfter := parseRetryAfter(body)
+		if attempt >= telegramMaxRetries || retryAfter > maxWait(ctx) {
+			return nil, fmt.Errorf("%w: (%d) %s", errTelegramRateLimited, resp.StatusCode, EscapeMultiLine(body))
+		}
+		logger.Warningf("Telegram rate limit hit for chat %d, retrying in %s", chatID, retryAfter)
+		s.block(chatID, time.Now().Add(retryAfter))
+	}
+}
+
+// wait blocks until the chat may receive the next request. The slot is given
+// back if the request won't be sent.
+func (s *TelegramSender) wait(ctx context.Context, chatID int64) error {
+	now := time.Now()
+	delay := s.reserve(chatID, now)
+	at := now.Add(delay)
+	if delay <= 0 {
+		return nil
+	}
+	if delay > maxWait(ctx) {
+		s.release(chatID, at)
+		return fmt.Errorf("%w: chat %d is busy for %s", errTelegramRateLimited, chatID, delay.Round(time.Second))
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		s.release(chatID, at)
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// maxWait returns how long a request may wait for a slot or a retry_after
+// within the deadline of ctx.
+func maxWait(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return min(telegramMaxWait, time.Until(deadline))
+	}
+	return telegramMaxWait
+}
+
+// reserve books the earliest send slot for the chat and returns how long to
+// wait for it.
+func (s *TelegramSender) reserve(chatID int64, now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, ok := s.chats[chatID]
+	if !ok {
+		chat = &chatSchedule{}
+		s.chats[chatID] = chat
+	}
+
+	at := now
+	if chat.blockedUntil.After(at) {
+		at = chat.blockedUntil
+	}
+	if n := len(chat.sent); n > 0 && s.chatInterval > 0 {
+		if next := chat.sent[n-1].Add(s.chatInterval); next.After(at) {
+			at = next
+		}
+	}
+	// Negative chat IDs are groups, supergroups and channels.
+	if chatID < 0 && s.groupLimit > 0 && len(chat.sent) >= s.groupLimit {
+		if next := chat.sent[len(chat.sent)-s.groupLimit].Add(telegramGroupWindow); next.After(at) {
+			at = next
+		}
+	}
+
+	// Forget the slots which no longer affect any limit.
+	keep := 0
+	for keep < len(chat.sent) && chat.sent[keep].Add(telegramGroupWindow).Before(at) {
+		keep++
+	}
+	chat.sent = append(chat.sent[keep:], at)
+	return at.Sub(now)
+}
+
+// release gives back a slot booked by reserve. The slots booked after it
+// keep their times.
+func (s *TelegramSender) release(chatID int64, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chat, ok := s.chats[chatID]
+	if !ok {
+		return
+	}
+	if i := slices.IndexFunc(chat.sent, at.Equal); i >= 0 {
+		chat.sent = slices.Delete(chat.sent, i, i+1)
+	}
+}
+
+func (s *TelegramSender) block(chatID int64, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chat, ok := s.chats[chatID]
+	if !ok {
+		chat = &chatSchedule{}
+		s.chats[chatID] = chat
+	}
+	if until.After(chat.blockedUntil) {
+		chat.blockedUntil = until
+	}
+}
+
+func parseRetryAfter(body []byte) time.Duration {
+	apiErr := &TelegramAPIError{}
+	if err := json.Unmarshal(body, apiErr); err != nil || apiErr.Parameters.RetryAfter <= 0 {
+		return time.Second
+	}
+	return time.Duration(apiErr.Parameters.RetryAfter) * time.Second
+}
+
+// newFormRequest returns a request builder for TelegramSender.Do posting the
+// given body with the content type.
+func newFormRequest(ctx context.Context, apiURL, contentType string, body []byte) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		return req, nil
+	}
+}
+
+// newMultipartRequest returns a request builder for TelegramSender.Do posting
+// the multipart form written by writeForm. The form is streamed through a pipe
+// while the request is sent instead of being buffered, and it is written again
+// for every attempt, so writeForm must only read data which doesn't change.
+func newMultipartRequest(ctx context.Context, apiURL string, writeForm func(w *multipart.Writer) error) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		pr, pw := io.Pipe()
+		w := multipart.NewWriter(pw)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, pr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		// The client closes the body when it is done with the request, which
+		// stops the writer if the request fails before the whole form is sent.
+		go func() {
+			err := writeForm(w)
+			if err == nil {
+				err = w.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		return req, nil
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTelegramSenderChatInterval(t *testing.T) {
+	s := NewTelegramSender(time.Second, 20)
+	now := time.Now()
+
+	require.Equal(t, time.Duration(0), s.reserve(42, now))
+	require.Equal(t, time.Second, s.reserve(42, now))
+	require.Equal(t, 2*time.Second, s.reserve(42, now))
+	// Other chats are independent.
+	require.Equal(t, time.Duration(0), s.reserve(142, now))
+	// A free slot in the past is not reused.
+	require.Equal(t, time.Duration(0), s.reserve(42, now.Add(time.Minute)))
+}
+
+func TestTelegramSenderGroupLimit(t *testing.T) {
+	s := NewTelegramSender(0, 3)
+	now := time.Now()
+
+	for range 3 {
+		require.Equal(t, time.Duration(0), s.reserve(-100, now))
+	}
+	require.Equal(t, time.Minute, s.reserve(-100, now))
+	// Private chats only have the per-chat interval.
+	for range 5 {
+		require.Equal(t, time.Duration(0), s.reserve(100, now))
+	}
+}
+
+func TestTelegramSenderBlockedByRetryAfter(t *testing.T) {
+	s := NewTelegramSender(0, 0)
+	now := time.Now()
+	s.block(42, now.Add(5*time.Second))
+
+	require.Equal(t, 5*time.Second, s.reserve(42, now))
+	require.Equal(t, time.Duration(0), s.reserve(142, now))
+}
+
+func TestTelegramSenderWaitReleasesSlot(t *testing.T) {
+	s := NewTelegramSender(time.Second, 0)
+	now := time.Now()
+	require.Equal(t, time.Duration(0), s.reserve(42, now))
+
+	// The next slot is a second away, past the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.wait(ctx, 42), errTelegramRateLimited)
+
+	// A canceled wait gives its slot back too
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, s.wait(ctx, 42), context.Canceled)
+
+	require.Equal(t, time.Second, s.reserve(42, now))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	body := `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 3","parameters":{"retry_after":3}}`
+	require.Equal(t, 3*time.Second, parseRetryAfter([]byte(body)))
+	require.Equal(t, time.Second, parseRetryAfter([]byte("Error")))
+}
+
+// RateLimitHandler answers 429 to the first requests, then behaves like SuccessHandler.
+type RateLimitHandler struct {
+	*SuccessHandler
+	mu         sync.Mutex
+	limited    int
+	retryAfter string
+}
+
+func (h *RateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.limited > 0 {
+		h.limited--
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests","parameters":{"retry_after":` + h.retryAfter + `}}`))
+		return
+	}
+	h.SuccessHandler.ServeHTTP(w, r)
+}
+
+func TestTelegramRateLimitRetried(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.ChatIDs = "42"
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := &RateLimitHandler{SuccessHandler: NewSuccessHandler(), limited: 1, retryAfter: "1"}
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	start := time.Now()
+	err := smtp.SendMail(smtpConfig.Listen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+	require.Len(t, h.RequestMessages, 1)
+}
+
+func TestTelegramRateLimitTooLong(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.ChatIDs = "42"
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+
+	h := &RateLimitHandler{SuccessHandler: NewSuccessHandler(), limited: 1, retryAfter: "3600"}
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	err := smtp.SendMail(smtpConfig.Listen, nil, "from@test", []string{"to@test"}, []byte(`hi`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), errTelegramRateLimited.Error())
+	require.Empty(t, h.RequestMessages)
+}
+
+func TestMultipartRequest(t *testing.T) {
+	content := []byte("large attachment")
+	newRequest := newMultipartRequest(context.Background(), "http://bot-api/sendDocument", func(w *multipart.Writer) error {
+		if err := w.WriteField("chat_id", "42"); err != nil {
+			return err
+		}
+		fileWriter, err := w.CreateFormFile("document", "a.txt")
+		if err != nil {
+			return err
+		}
+		_, err = fileWriter.Write(content)
+		return err
+	})
+
+	// Every attempt gets the whole form
+	for range 2 {
+		req, err := newRequest()
+		require.NoError(t, err)
+		require.NoError(t, req.ParseMultipartForm(1024))
+		require.Equal(t, "42", req.FormValue("chat_id"))
+		file, _, err := req.FormFile("document")
+		require.NoError(t, err)
+		got, err := io.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+	}
+
+	// Errors of the form writer fail the request
+	errForm := errors.New("form error")
+	req, err := newMultipartRequest(context.Background(), "http://bot-api/sendDocument", func(*multipart.Writer) error {
+		return errForm
+	})()
+	require.NoError(t, err)
+	_, err = io.ReadAll(req.Body)
+	require.ErrorIs(t, err, errForm)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/gomail.v2"
+)
+
+var errNoRecipients = errors.New("no recipients given")
+
+func sendTestCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "send-test",
+		Usage: "Send a test email through the relay and print the Telegram messages it became",
+		Description: "The email is sent to --smtp-listen of a running smtp_to_telegram, " +
+			"which reports the Telegram messages in its SMTP response. With --direct " +
+			"the email is forwarded by this process, using the Telegram flags and " +
+			"--config-file. Exits with 1 if the email is rejected.",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:     "to",
+				Usage:    "Recipients of the email",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "from",
+				Usage: "Sender of the email",
+				Value: "send-test@localhost",
+			},
+			&cli.StringFlag{
+				Name:  "subject",
+				Usage: "Subject of the email",
+				Value: "smtp_to_telegram test",
+			},
+			&cli.StringFlag{
+				Name:  "body",
+				Usage: "Text body of the email",
+				Value: "This is a test email sent with smtp_to_telegram send-test.",
+			},
+			&cli.StringSliceFlag{
+				Name:  "attach",
+				Usage: "Files to attach",
+			},
+			&cli.StringFlag{
+				Name:  "username",
+				Usage: "Authenticate with SMTP AUTH as this user",
+			},
+			&cli.StringFlag{
+				Name:    "password",
+				Usage:   "Password of --username",
+				Sources: cli.EnvVars("ST_SEND_TEST_PASSWORD"),
+			},
+			&cli.BoolFlag{
+				Name:  "direct",
+				Usage: "Forward the email without SMTP",
+			},
+		},
+		Action: func(_ context.Context, cmd *cli.Command) error {
+			email := &TestEmail{
+				From:        cmd.String("from"),
+				To:          cmd.StringSlice("to"),
+				Subject:     cmd.String("subject"),
+				Body:        cmd.String("body"),
+				Attachments: cmd.StringSlice("attach"),
+				Username:    cmd.String("username"),
+				Password:    cmd.String("password"),
+			}
+			w := cmd.Root().Writer
+			if !cmd.Bool("direct") {
+				response, err := SendTestEmail(cmd.String("smtp-listen"), email)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(w, response)
+				return nil
+			}
+
+			if err := requireTelegramFlags(cmd); err != nil {
+				return err
+			}
+			telegramConfig, err := newTelegramConfig(cmd)
+			if err != nil {
+				return err
+			}
+			logger, err = log.GetLogger(log.OutputStderr.String(), log.WarnLevel.String())
+			if err != nil {
+				return err
+			}
+			if filename := cmd.String("config-file"); filename != "" {
+				if _, err := loadConfig(filename); err != nil {
+					return fmt.Errorf("%s: %w", filename, err)
+				}
+			}
+			sent, err := DeliverTestEmail(email, telegramConfig)
+			if err != nil {
+				return err
+			}
+			if len(sent) == 0 {
+				fmt.Fprintln(w, "Discarded by a filter rule")
+				return nil
+			}
+			fmt.Fprintf(w, "Forwarded as %s\n", describeSentMessages(sent))
+			return nil
+		},
+	}
+}
+
+// TestEmail is a synthetic email sent with send-test.
+type TestEmail struct {
+	From        string
+	To          []string
+	Subject     string
+	Body        string
+	Attachments []string // file paths
+	Username    string   // SMTP AUTH user, no AUTH if empty
+	Password    string
+}
+
+func (email *TestEmail) bytes() ([]byte, error) {
+	if len(email.To) == 0 {
+		return nil, errNoRecipients
+	}
+	m := gomail.NewMessage()
+	m.SetHeader("From", email.From)
+	m.SetHeader("To", email.To...)
+	m.SetHeader("Subject", email.Subject)
+	m.SetBody("text/plain", email.Body)
+	for _, path := range email.Attachments {
+		m.Attach(path)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("failed to compose test email: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SendTestEmail sends the email to the SMTP listener at addr and returns the
+// final response, which lists the Telegram messages.
+func SendTestEmail(addr string, email *TestEmail) (string, error) {
+	data, err := email.bytes()
+	if err != nil {
+		return "", err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = c.Close() }()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		// The certificate of the relay's own listener is often not issued
+		// for the listen address.
+		//nolint:gosec // Only a test email is sent
+		if err := c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: true}); err != nil {
+			return "", err
+		}
+	}
+	if email.Username != "" {
+		// PlainAuth refuses to send the password in cleartext but to
+		// localhost.
+		if err := c.Auth(smtp.PlainAuth("", email.Username, email.Password, host)); err != nil {
+			return "", fmt.Errorf("smtp auth failed: %w", err)
+		}
+	}
+	if err := c.Mail(bareAddress(email.From)); err != nil {
+		return "", err
+	}
+	for _, rcpt := range email.To {
+		if err := c.Rcpt(bareAddress(rcpt)); err != nil {
+			return "", err
+		}
+	}
+
+	// Client.Data discards the response to the message, send it by hand.
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return "", err
+	}
+	dw := c.Text.DotWriter()
+	if _, err := io.Copy(dw, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	if err := dw.Close(); err != nil {
+		return "", err
+	}
+	code, msg, err := c.Text.ReadResponse(250)
+	if err != nil {
+		return "", err
+	}
+	_ = c.Quit()
+	return fmt.Sprintf("%d %s", code, msg), nil
+}
+
+// DeliverTestEmail forwards the email like a received one, without SMTP.
+func DeliverTestEmail(email *TestEmail, telegramConfig *TelegramConfig) ([]SentMessage, error) {
+	data, err := email.bytes()
+	if err != nil {
+		return nil, err
+	}
+	envelope := &mail.Envelope{
+		RemoteIP: "127.0.0.1",
+		Helo:     "localhost",
+		MailFrom: envelopeAddressOf(bareAddress(email.From)),
+		Values:   make(map[string]any),
+	}
+	for _, rcpt := range email.To {
+		envelope.RcptTo = append(envelope.RcptTo, envelopeAddressOf(bareAddress(rcpt)))
+	}
+	envelope.Data.Write(data)
+	return SendEmailToTelegram(envelope, telegramConfig, nil, nil)
+}
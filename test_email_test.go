@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendTestEmail(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = writeTestConfig(t, `filter_rules:
+  - name: reject-spam
+    conditions:
+      - field: subject
+        pattern: 'spam'
+`)
+	telegramConfig := makeTelegramConfig()
+	telegramConfig.ForwardedAttachmentMaxSize = 1024
+	d := startSMTP(t, smtpConfig, telegramConfig)
+	defer d.Shutdown()
+	defer activeRules.Store(nil)
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	attachment := filepath.Join(t.TempDir(), "report.txt")
+	require.NoError(t, os.WriteFile(attachment, []byte("report"), 0o600))
+	email := &TestEmail{
+		From:        "Monitoring <from@test>",
+		To:          []string{"to@test"},
+		Subject:     "Test",
+		Body:        "Test body",
+		Attachments: []string{attachment},
+	}
+
+	response, err := SendTestEmail(smtpConfig.Listen, email)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(response, "250 "), response)
+	require.Contains(t, response, "Telegram messages 123123 in 42, 123123 in 142")
+	require.Len(t, h.RequestMessages, 2)
+	require.Contains(t, h.RequestMessages[0], "From: Monitoring <from@test>")
+	require.Contains(t, h.RequestMessages[0], "Subject: Test")
+	require.Len(t, h.RequestDocuments, 2)
+
+	rejected := metricEmailsRejected.Value("filter_rule", "reject-spam")
+	email.Subject = "spam"
+	_, err = SendTestEmail(smtpConfig.Listen, email)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "reject-spam")
+	require.Len(t, h.RequestMessages, 2)
+	require.Equal(t, rejected+1, metricEmailsRejected.Value("filter_rule", "reject-spam"))
+}
+
+func TestSendTestEmailAuth(t *testing.T) {
+	smtpConfig := makeSMTPConfig()
+	smtpConfig.ConfigFile = testAuthConfig(t)
+	d := startSMTP(t, smtpConfig, makeTelegramConfig())
+	defer d.Shutdown()
+	defer activeRules.Store(nil)
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	email := &TestEmail{From: "from@test", To: []string{"to@test"}, Subject: "Test", Body: "Test body"}
+	_, err := SendTestEmail(smtpConfig.Listen, email)
+	require.ErrorContains(t, err, errSMTPAuthRequired.Error())
+
+	email.Username, email.Password = "monitoring", "wrong"
+	_, err = SendTestEmail(smtpConfig.Listen, email)
+	require.ErrorContains(t, err, "535")
+
+	email.Password = "secret"
+	response, err := SendTestEmail(smtpConfig.Listen, email)
+	require.NoError(t, err)
+	require.Contains(t, response, "Telegram messages 123123 in -1004")
+	require.Equal(t, []string{"-1004"}, h.RequestChatIDs)
+}
+
+func TestReportsSentMessages(t *testing.T) {
+	require.True(t, reportsSentMessages(&mail.Envelope{RemoteIP: "127.0.0.1"}))
+	require.True(t, reportsSentMessages(&mail.Envelope{RemoteIP: "::1"}))
+	require.False(t, reportsSentMessages(&mail.Envelope{RemoteIP: "192.0.2.1"}))
+	require.True(t, reportsSentMessages(&mail.Envelope{
+		RemoteIP: "192.0.2.1",
+		Values:   map[string]any{envelopeAuthUser: "monitoring"},
+	}))
+}
+
+func TestDeliverTestEmail(t *testing.T) {
+	_, err := loadConfig(writeTestConfig(t, `filter_rules:
+  - name: drop-promo
+    action: discard
+    conditions:
+      - field: subject
+        pattern: 'promo'
+routes:
+  - recipient: ops@test
+    chat_ids: ['-100123:7']
+`))
+	require.NoError(t, err)
+	defer activeRules.Store(nil)
+
+	h := NewSuccessHandler()
+	s := HTTPServer(t, h)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	email := &TestEmail{From: "from@test", To: []string{"ops@test"}, Subject: "Test", Body: "Test body"}
+	sent, err := DeliverTestEmail(email, makeTelegramConfig())
+	require.NoError(t, err)
+	require.Equal(t, "Telegram messages 123123 in -100123:7", describeSentMessages(sent))
+	require.Equal(t, "7", h.RequestThreadIDs[0])
+
+	email.Subject = "promo"
+	sent, err = DeliverTestEmail(email, makeTelegramConfig())
+	require.NoError(t, err)
+	require.Empty(t, sent)
+
+	_, err = DeliverTestEmail(&TestEmail{From: "from@test"}, makeTelegramConfig())
+	require.ErrorIs(t, err, errNoRecipients)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// truncationWindow is the part of the limit, 1/truncationWindow, a body may
+// be cut short by to end at a paragraph, line, sentence or word boundary.
+const truncationWindow = 4
+
+// truncationMarkerAttempts bounds the search for a detailed marker which fits
+// together with the body it is sized for.
+const truncationMarkerAttempts = 4
+
+var urlRe = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+`)
+
+// truncateBody cuts the body to at most limit runes. It prefers the last
+// blank line, then line break, then sentence end, then whitespace in the
+// window before the limit, or else cuts at the limit but never inside a URL.
+// HTML is cut outside of tags and the elements left open are closed. It
+// returns the kept text and the text left out.
+func truncateBody(s string, limit uint, htmlMode bool) (kept, omitted string) {
+	hard := runeIndex(s, limit)
+	if htmlMode {
+		hard = htmlCutIndex(s, limit)
+	}
+	if hard >= len(s) {
+		return s, ""
+	}
+	n := uint(utf8.RuneCountInString(s[:hard]))
+	lo := runeIndex(s, n-min(n, limit/truncationWindow))
+	cut := bodyCutIndex(s, lo, hard, htmlMode)
+
+	kept = strings.TrimRightFunc(s[:cut], unicode.IsSpace)
+	if htmlMode {
+		kept = closeHTML(kept)
+	}
+	return kept, strings.TrimLeftFunc(s[cut:], unicode.IsSpace)
+}
+
+// bodyCutIndex returns the position to cut s at, between lo and hard.
+func bodyCutIndex(s string, lo, hard int, htmlMode bool) int {
+	outsideTag := func(i int) bool {
+		// Any < of HTML mode text starts a tag, the text is escaped.
+		return !htmlMode || strings.LastIndexByte(s[:i], '<') <= strings.LastIndexByte(s[:i], '>')
+	}
+	valid := func(i int) bool {
+		return i > 0 && outsideTag(i)
+	}
+	for _, sep := range []string{"\n\n", "\n"} {
+		end := min(hard+len(sep), len(s))
+		if i := strings.LastIndex(s[lo:end], sep); i >= 0 && valid(lo+i) {
+			return lo + i
+		}
+	}
+	for i := hard; i >= lo; i-- {
+		if i > 0 && isBlank(s[i]) && strings.IndexByte(".!?", s[i-1]) >= 0 && valid(i) {
+			return i
+		}
+	}
+	for i := hard; i >= lo; i-- {
+		if isBlank(s[i]) && valid(i) {
+			return i
+		}
+	}
+
+	// No boundary nearby, cut in the word unless it is a URL. A URL is left
+	// out whole, even if nothing is kept.
+	start := strings.LastIndexFunc(s[:hard], unicode.IsSpace) + 1
+	end := len(s)
+	if i := strings.IndexFunc(s[hard:], unicode.IsSpace); i >= 0 {
+		end = hard + i
+	}
+	for _, loc := range urlRe.FindAllStringIndex(s[start:end], -1) {
+		if start+loc[0] < hard && hard < start+loc[1] && outsideTag(start+loc[0]) {
+			return start + loc[0]
+		}
+	}
+	return hard
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+// runeIndex returns the position of the rune n of s, or the length of s if it
+// is shorter.
+func runeIndex(s string, n uint) int {
+	for i := range s {
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(s)
+}
+
+// truncateWithMarker cuts the body so that it fits in limit runes together
+// with the marker telling how much of it was left out. The marker is sized
+// from the text actually left out. The plain BodyTruncated is used when the
+// detailed marker leaves no room for the body, or doesn't fit at all.
+func truncateWithMarker(s string, limit uint, htmlMode bool) (kept, marker string) {
+	plainKept, _ := truncateBody(s, limit-uint(utf8.RuneCountInString(BodyTruncated)), htmlMode)
+
+	// The marker gets longer as less of the body is kept, by a few digits.
+	markerLength := uint(utf8.RuneCountInString(BodyTruncated))
+	for range truncationMarkerAttempts {
+		if markerLength >= limit {
+			break
+		}
+		kept, omitted := truncateBody(s, limit-markerLength, htmlMode)
+		marker := truncatedMarker(omitted, htmlMode)
+		if n := uint(utf8.RuneCountInString(marker)); n > markerLength {
+			markerLength = n
+			continue
+		}
+		if kept != "" || plainKept == "" {
+			return kept, marker
+		}
+		break
+	}
+	return plainKept, BodyTruncated
+}
+
+// truncatedMarker returns the end of a truncated body telling how much of it
+// was left out.
+func truncatedMarker(omitted string, htmlMode bool) string {
+	if htmlMode {
+		omitted = htmlText(omitted)
+	}
+	omitted = strings.TrimSpace(omitted)
+	details := pluralize(utf8.RuneCountInString(omitted), "character")
+	if lines := strings.Count(omitted, "\n") + 1; lines > 1 {
+		details += ", " + pluralize(lines, "line")
+	}
+	return fmt.Sprintf(BodyTruncatedDetails, details)
+}
+
+func pluralize(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
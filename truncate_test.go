@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncateBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		s           string
+		limit       uint
+		htmlMode    bool
+		wantKept    string
+		wantOmitted string
+	}{
+		{"fits", "short text", 20, false, "short text", ""},
+		{"paragraph", "Para one is here\n\nTwo. Three", 20, false, "Para one is here", "Two. Three"},
+		{"line", "Line one\nline two\nline three", 22, false, "Line one\nline two", "line three"},
+		{"sentence", "The disk is almost full. Please clean up the logs", 32, false, "The disk is almost full.", "Please clean up the logs"},
+		{"whitespace", "one two three four", 16, false, "one two three", "four"},
+		{"boundary out of the window", "a " + strings.Repeat("x", 30), 20, false, "a " + strings.Repeat("x", 18), strings.Repeat("x", 12)},
+		{"never inside a URL", "abcdefghij https://example.com/path", 20, false, "abcdefghij", "https://example.com/path"},
+		{"URL inside a word", "abcdefghij(https://example.com/path)", 20, false, "abcdefghij(", "https://example.com/path)"},
+		{"URL at the start", "https://example.com/long/path", 20, false, "", "https://example.com/long/path"},
+		{"unicode", "привет мир и всем", 11, false, "привет мир", "и всем"},
+		{"html tag attributes", `<b>bold text</b> <a href="https://example.com">link</a>`, 40, true, "<b>bold text</b>", `<a href="https://example.com">link</a>`},
+		{"html open element", "<b>one two three</b>", 16, true, "<b>one two</b>", "three</b>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, omitted := truncateBody(tt.s, tt.limit, tt.htmlMode)
+			require.Equal(t, tt.wantKept, kept)
+			require.Equal(t, tt.wantOmitted, omitted)
+			require.LessOrEqual(t, len([]rune(kept)), int(tt.limit))
+		})
+	}
+}
+
+func TestTruncatedMarker(t *testing.T) {
+	require.Equal(t, "\n\n[truncated: 1 character]", truncatedMarker("x", false))
+	require.Equal(t, "\n\n[truncated: 13 characters, 2 lines]", truncatedMarker("\none\ntwo three\n", false))
+	require.Equal(t, "\n\n[truncated: 7 characters]", truncatedMarker("<b>a &amp; b</b> c", true))
+}
+
+func TestTruncateWithMarker(t *testing.T) {
+	tests := []struct {
+		name       string
+		s          string
+		limit      uint
+		wantKept   string
+		wantMarker string
+	}{
+		{"detailed", strings.Repeat("x", 50), 40, strings.Repeat("x", 12), "\n\n[truncated: 38 characters]"},
+		{"plain when the detailed doesn't fit", strings.Repeat("x", 50), 20, strings.Repeat("x", 7), BodyTruncated},
+		{"URL at the start", "https://example.com/long/path", 40, "", "\n\n[truncated: 29 characters]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, marker := truncateWithMarker(tt.s, tt.limit, false)
+			require.Equal(t, tt.wantKept, kept)
+			require.Equal(t, tt.wantMarker, marker)
+			require.LessOrEqual(t, len([]rune(kept+marker)), int(tt.limit))
+		})
+	}
+}
+
+func TestFormatMessageTruncationLimit(t *testing.T) {
+	bodies := []string{
+		strings.Repeat("word ", 500),
+		strings.Repeat("A sentence. ", 300),
+		strings.Repeat("line\n", 600),
+		strings.Repeat("paragraph\n\n", 300),
+		strings.Repeat("https://example.com/"+strings.Repeat("x", 50)+" ", 50),
+		strings.Repeat("x", 3000),
+	}
+	for _, body := range bodies {
+		for _, limit := range []uint{150, 200, 500, 1000} {
+			for _, htmlMode := range []bool{false, true} {
+				full, truncated := FormatMessage(MessageContent{From: "from@test", To: "to@test", Subject: "Subject", Text: body}, limit, htmlMode)
+				require.Greater(t, len([]rune(full)), int(limit))
+				require.LessOrEqual(t, len([]rune(truncated)), int(limit))
+				require.Contains(t, truncated, "[truncated: ")
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	UpdateModePolling = "polling"
+	UpdateModeWebhook = "webhook"
+
+	webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+	webhookMaxBodySize  = 1 << 20
+	webhookQueueSize    = 100
+)
+
+var (
+	errInvalidUpdateMode = errors.New("invalid telegram update mode")
+	errWebhookURLMissing = errors.New("--telegram-webhook-url is required in webhook mode")
+	errWebhookNotOk      = errors.New("webhook request returned not ok")
+)
+
+// WebhookConfig configures receiving Telegram updates through a webhook.
+type WebhookConfig struct {
+	URL    string // public HTTPS URL registered with setWebhook
+	Listen string // local address serving the path of URL
+	Secret string // X-Telegram-Bot-Api-Secret-Token, generated if empty
+}
+
+// TelegramWebhook serves updates pushed by Telegram.
+type TelegramWebhook struct {
+	telegramConfig *TelegramConfig
+	handler        *updateHandler
+	secret         string
+	server         *http.Server
+	addr           net.Addr
+
+	// Updates are acknowledged once queued and handled in order by a single
+	// worker, so that a slow reply doesn't make Telegram deliver it again.
+	updates chan TelegramUpdate
+	done    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// StartTelegramWebhook starts serving the webhook and registers it with
+// setWebhook. Updates are handled like the ones from PollTelegramUpdates.
+func StartTelegramWebhook(
+	ctx context.Context,
+	telegramConfig *TelegramConfig,
+	smtpOutConfig *SMTPOutConfig,
+	store *MessageStore,
+	webhookConfig *WebhookConfig,
+	allowedChatIDs []int64,
+	allowedHosts []string,
+) (*TelegramWebhook, error) {
+	if webhookConfig.URL == "" {
+		return nil, errWebhookURLMissing
+	}
+	webhookURL, err := url.Parse(webhookConfig.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	secret := webhookConfig.Secret
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate webhook secret: %w", err)
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	client := &http.Client{Timeout: 40 * time.Second}
+	botUserID, err := GetBotUserID(ctx, telegramConfig, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bot identity: %s", SanitizeBotToken(err.Error(), telegramConfig.BotToken))
+	}
+
+	processCtx, cancel := context.WithCancel(context.Background())
+	w := &TelegramWebhook{
+		telegramConfig: telegramConfig,
+		handler: &updateHandler{
+			telegramConfig: telegramConfig,
+			smtpOutConfig:  smtpOutConfig,
+			store:          store,
+			client:         client,
+			botUserID:      botUserID,
+			allowedChatIDs: allowedChatIDs,
+			allowedHosts:   allowedHosts,
+		},
+		secret:  secret,
+		updates: make(chan TelegramUpdate, webhookQueueSize),
+		done:    make(chan struct{}),
+		ctx:     processCtx,
+		cancel:  cancel,
+	}
+
+	path := webhookURL.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("POST "+path, w)
+	w.server = &http.Server{
+		Addr:              webhookConfig.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ln, err := net.Listen("tcp", webhookConfig.Listen)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start webhook listener: %w", err)
+	}
+	w.addr = ln.Addr()
+	go w.processUpdates()
+	go func() {
+		if err := w.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("Webhook server error: %s", err)
+		}
+	}()
+
+	params := url.Values{
+		"url":                  {webhookConfig.URL},
+		"secret_token":         {secret},
+		"allowed_updates":      {`["message"]`},
+		"drop_pending_updates": {"true"},
+	}
+	if err := w.callWebhookMethod(ctx, "setWebhook", params); err != nil {
+		cancel()
+		_ = w.server.Close()
+		return nil, err
+	}
+	logger.Infof("Bot user ID: %d, receiving Telegram updates on %s", botUserID, w.addr)
+	return w, nil
+}
+
+// ServeHTTP queues an update pushed by Telegram. Any response other than 200
+// makes Telegram deliver the update again later.
+func (w *TelegramWebhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(webhookSecretHeader)), []byte(w.secret)) != 1 {
+		http.Error(rw, "invalid secret token", http.StatusUnauthorized)
+		return
+	}
+	var update TelegramUpdate
+	if err := json.NewDecoder(io.LimitReader(r.Body, webhookMaxBodySize)).Decode(&update); err != nil {
+		// Retrying won't make a malformed update valid.
+		logger.Warningf("Ignoring malformed webhook update: %s", err)
+		return
+	}
+	select {
+	case w.updates <- update:
+	default:
+		http.Error(rw, "too many pending updates", http.StatusServiceUnavailable)
+	}
+}
+
+func (w *TelegramWebhook) processUpdates() {
+	defer close(w.done)
+	for update := range w.updates {
+		w.handler.processUpdate(w.ctx, update)
+	}
+}
+
+// Shutdown unregisters the webhook with deleteWebhook, stops the server and
+// waits for the queued updates to be handled until ctx expires.
+func (w *TelegramWebhook) Shutdown(ctx context.Context) {
+	defer w.cancel()
+	if err := w.callWebhookMethod(ctx, "deleteWebhook", url.Values{}); err != nil {
+		logger.Warningf("Failed to delete webhook: %s", err)
+	}
+	if err := w.server.Shutdown(ctx); err != nil {
+		logger.Warningf("Webhook server shutdown error: %v", err)
+		return
+	}
+	// No request is left to queue updates.
+	close(w.updates)
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		logger.Warningf("Webhook updates left unhandled on shutdown: %v", ctx.Err())
+	}
+}
+
+// Addr returns the address the webhook is served on.
+func (w *TelegramWebhook) Addr() net.Addr {
+	return w.addr
+}
+
+func (w *TelegramWebhook) callWebhookMethod(ctx context.Context, method string, params url.Values) error {
+	apiURL := fmt.Sprintf("%sbot%s/%s", w.telegramConfig.APIPrefix, w.telegramConfig.BotToken, method)
+	req, err := newFormRequest(ctx, apiURL, "application/x-www-form-urlencoded", []byte(params.Encode()))()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	resp, err := w.handler.client.Do(req)
+	observeTelegramRequest(req, start, resp, err)
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", method, SanitizeBotToken(err.Error(), w.telegramConfig.BotToken))
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			logger.Warningf("Failed to close response body: %v", closeErr)
+		}
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errReadingJSON, err)
+	}
+	var result struct {
+		Ok bool `json:"ok"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || resp.StatusCode != http.StatusOK || !result.Ok {
+		return fmt.Errorf("%w: %s: (%d) %s", errWebhookNotOk, method, resp.StatusCode, EscapeMultiLine(body))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWebhookTelegram records the webhook calls and notifications of the bot.
+type fakeWebhookTelegram struct {
+	mu            sync.Mutex
+	setWebhook    []map[string]string
+	deleteWebhook int
+	notifications []string
+}
+
+func (f *fakeWebhookTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_ = r.ParseForm()
+	switch path := r.URL.Path; {
+	case path == "/bot42:ZZZ/getMe":
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"id":999,"is_bot":true}}`))
+	case path == "/bot42:ZZZ/setWebhook":
+		f.setWebhook = append(f.setWebhook, map[string]string{
+			"url":          r.PostForm.Get("url"),
+			"secret_token": r.PostForm.Get("secret_token"),
+		})
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+	case path == "/bot42:ZZZ/deleteWebhook":
+		f.deleteWebhook++
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+	case path == "/bot42:ZZZ/sendMessage":
+		f.notifications = append(f.notifications, r.PostForm.Get("text"))
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":7}}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func postWebhookUpdate(t *testing.T, webhook *TelegramWebhook, secret string, update TelegramUpdate) int {
+	t.Helper()
+	body, err := json.Marshal(update)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, "http://"+webhook.Addr().String()+"/telegram/hook", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestTelegramWebhook(t *testing.T) {
+	fake := &fakeWebhookTelegram{}
+	s := HTTPServer(t, fake)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	received := make(chan testEmail, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	webhook, err := StartTelegramWebhook(context.Background(), makeTelegramConfig(),
+		&SMTPOutConfig{Host: host, Port: port}, nil,
+		&WebhookConfig{URL: "https://bot.example.com/telegram/hook", Listen: "127.0.0.1:0", Secret: "s3cret"},
+		[]int64{42}, []string{"."})
+	require.NoError(t, err)
+	require.Equal(t, []map[string]string{{"url": "https://bot.example.com/telegram/hook", "secret_token": "s3cret"}}, fake.setWebhook)
+
+	update := makeBotReplyUpdate(999, "From: sender@test\nTo: me@test\nSubject: Hello\n\nOriginal body", "My reply")
+	require.Equal(t, http.StatusUnauthorized, postWebhookUpdate(t, webhook, "wrong", update))
+	// The update is acknowledged before the reply email can be sent
+	require.Equal(t, http.StatusOK, postWebhookUpdate(t, webhook, "s3cret", update))
+	go runTestSMTPServer(t, ln, received)
+
+	msg := <-received
+	require.Contains(t, msg.data, "My reply")
+
+	// Shutdown waits for the update to be handled
+	webhook.Shutdown(context.Background())
+	require.Equal(t, 1, fake.deleteWebhook)
+	fake.mu.Lock()
+	require.Len(t, fake.notifications, 1)
+	require.Contains(t, fake.notifications[0], "Email sent")
+	fake.mu.Unlock()
+}
+
+func TestTelegramWebhookRequiresURL(t *testing.T) {
+	_, err := StartTelegramWebhook(context.Background(), makeTelegramConfig(), &SMTPOutConfig{Host: "localhost"}, nil,
+		&WebhookConfig{Listen: "127.0.0.1:0"}, nil, nil)
+	require.ErrorIs(t, err, errWebhookURLMissing)
+}